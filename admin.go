@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// newAdminMux builds the admin API. It has no authentication, so
+// -admin-addr should stay on localhost or a management network.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", handleRecentConnections)
+	mux.HandleFunc("GET /breakers", handleBreakers)
+	mux.HandleFunc("GET /quarantine", handleQuarantine)
+	mux.HandleFunc("GET /circuits", handleCircuits)
+	mux.HandleFunc("GET /drain", handleDrain)
+	mux.HandleFunc("POST /drain", handleDrain)
+	mux.HandleFunc("DELETE /drain", handleDrain)
+	mux.HandleFunc("GET /pool", handleGetPool)
+	mux.HandleFunc("POST /pool", handleAddPool)
+	mux.HandleFunc("DELETE /pool/{spec...}", handleRemovePool)
+	return mux
+}
+
+// serveAdmin runs the admin API on addr in the background.
+func serveAdmin(addr string) {
+	mux := newAdminMux()
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			sugar.Errorw("Admin API server stopped", "addr", addr, "error", err)
+		}
+	}()
+	sugar.Infof("Serving admin API on http://%s/", addr)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		sugar.Debugw("Failed writing admin API response", "error", err)
+	}
+}
+
+// handleRecentConnections returns the recent connection ring buffer,
+// newest first.
+func handleRecentConnections(w http.ResponseWriter, r *http.Request) {
+	records := recentConns.snapshot()
+	if records == nil {
+		records = []connRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// handleBreakers returns the reset circuit breaker state of every source IP
+// with recent upstream resets.
+func handleBreakers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, breakerSnapshot())
+}
+
+// handleQuarantine returns the dial health of every source IP with recent
+// failed dials or an active quarantine.
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, quarantineSnapshot())
+}
+
+// handleCircuits returns the dial circuit breaker of every source IP with
+// failed dials since its last success.
+func handleCircuits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, circuitSnapshot())
+}
+
+// handleDrain reports drain mode and the number of active connections.
+// POST enters drain mode and DELETE leaves it.
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		setDraining(true)
+	case http.MethodDelete:
+		setDraining(false)
+	}
+	writeJSON(w, http.StatusOK, currentDrainStatus())
+}
+
+// poolStatus is the GET /pool response. Addresses are listed as single IPs
+// or start-end ranges.
+type poolStatus struct {
+	Size    string   `json:"size"`
+	Ranges  []string `json:"ranges"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+func intervalStrings(ivs []ipInterval) []string {
+	out := make([]string, len(ivs))
+	for i, iv := range ivs {
+		out[i] = iv.String()
+	}
+	return out
+}
+
+// handleGetPool returns the active pool and the edits made through the
+// admin API.
+func handleGetPool(w http.ResponseWriter, r *http.Request) {
+	refreshMu.Lock()
+	pool := currentPool()
+	status := poolStatus{
+		Size:    pool.count(),
+		Ranges:  intervalStrings(pool.intervals()),
+		Added:   intervalStrings(poolEdits.added),
+		Removed: intervalStrings(poolEdits.removed),
+	}
+	refreshMu.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleAddPool adds the IPs, CIDRs, or start-end ranges in the request
+// body, {"ips": [...]}, to the pool.
+func handleAddPool(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IPs []string `json:"ips"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if len(req.IPs) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `no addresses given, want {"ips": [...]}`})
+		return
+	}
+	ivs := make([]ipInterval, 0, len(req.IPs))
+	for _, spec := range req.IPs {
+		iv, err := parseInterval(spec)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		ivs = append(ivs, iv)
+	}
+	updatePool(w, r, ivs, nil)
+}
+
+// handleRemovePool removes an IP, CIDR, or start-end range from the pool.
+func handleRemovePool(w http.ResponseWriter, r *http.Request) {
+	iv, err := parseInterval(r.PathValue("spec"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	updatePool(w, r, nil, []ipInterval{iv})
+}
+
+func updatePool(w http.ResponseWriter, r *http.Request, add, remove []ipInterval) {
+	if err := editPool(add, remove); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	sugar.Infow("Pool edited through admin API",
+		"added", intervalStrings(add),
+		"removed", intervalStrings(remove),
+		"remote_addr", r.RemoteAddr,
+	)
+	handleGetPool(w, r)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// loadCredentials parses a file of "username:password" lines. Blank lines
+// and lines starting with '#' are ignored.
+func loadCredentials(filePath string) (socks5.StaticCredentials, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open auth file '%s': %w", filePath, err)
+	}
+	defer file.Close()
+
+	creds := make(socks5.StaticCredentials)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, pass, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("auth file '%s' line %d: expected username:password", filePath, lineNumber)
+		}
+		creds[user] = pass
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning auth file '%s': %w", filePath, err)
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("no credentials found in auth file '%s'", filePath)
+	}
+	return creds, nil
+}
+
+// reloadableCredentials is a socks5.CredentialStore whose contents can be
+// swapped while the server is running. Only new handshakes see the change.
+type reloadableCredentials struct {
+	mu    sync.RWMutex
+	path  string
+	creds socks5.StaticCredentials
+}
+
+func newReloadableCredentials(path string) (*reloadableCredentials, error) {
+	creds, err := loadCredentials(path)
+	if err != nil {
+		return nil, err
+	}
+	return &reloadableCredentials{path: path, creds: creds}, nil
+}
+
+func (r *reloadableCredentials) Valid(user, password string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.creds.Valid(user, password)
+}
+
+// Reload re-reads the auth file. On failure the previous credentials stay
+// in effect.
+func (r *reloadableCredentials) Reload() error {
+	creds, err := loadCredentials(r.path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.creds = creds
+	r.mu.Unlock()
+	sugar.Infow("Reloaded SOCKS credentials", "file", r.path, "users", len(creds))
+	return nil
+}
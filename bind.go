@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// bindWait is how long a BIND waits for the incoming connection.
+var bindWait = 2 * time.Minute
+
+// handleBind serves a BIND request, as used for active-mode FTP data
+// connections. It listens on a pool IP picked the same way as for a
+// CONNECT, so the incoming connection also reaches a spoofed address, and
+// replies twice: once with the listening address and once with the peer
+// that connected. A connection from another IP than the request's
+// destination, unless that is unspecified, is refused and the wait goes on.
+func (s *socksServer) handleBind(ctx context.Context, req *socks5.Request, conn net.Conn, bufConn *bufio.Reader, reply replyFunc) error {
+	ctx, ok := s.rules.Allow(ctx, req)
+	if !ok {
+		if err := reply(conn, replyRuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("bind for %v blocked by rules", req.DestAddr)
+	}
+
+	l, err := listenFromPool(ctx, req.DestAddr.Address())
+	if err != nil {
+		if err := reply(conn, replyForError(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("bind for %v failed: %w", req.DestAddr, err)
+	}
+	defer l.Close()
+	bound := l.Addr().(*net.TCPAddr)
+	if err := reply(conn, replySucceeded, &socks5.AddrSpec{IP: bound.IP, Port: bound.Port}); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	connLog(ctx).Infow("Waiting for BIND connection",
+		"local_addr", bound.String(),
+		"dest_addr", req.DestAddr.String(),
+		"wait", bindWait,
+	)
+
+	peer, err := acceptPeer(l, req.DestAddr.IP)
+	if err != nil {
+		if err := reply(conn, replyForError(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("bind on %v: %w", bound, err)
+	}
+	defer peer.Close()
+	l.Close()
+	remote := peer.RemoteAddr().(*net.TCPAddr)
+	if err := reply(conn, replySucceeded, &socks5.AddrSpec{IP: remote.IP, Port: remote.Port}); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	connLog(ctx).Infow("Accepted BIND connection",
+		"local_addr", bound.String(),
+		"remote_addr", remote.String(),
+	)
+	return relay(conn, bufConn, peer)
+}
+
+// listenFromPool opens a TCP listener on a pool IP selected for destAddr.
+func listenFromPool(ctx context.Context, destAddr string) (*net.TCPListener, error) {
+	localIP, err := sourceSelector.Select(ctx, "tcp", destAddr)
+	if err == nil && (localIP == nil || localIP.IsUnspecified()) {
+		err = errNoAvailableIP
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a valid source IP to listen on: %w", err)
+	}
+	network := "tcp6"
+	if localIP.To4() != nil {
+		network = "tcp4"
+	}
+	lc := net.ListenConfig{Control: controlSocket}
+	l, err := lc.Listen(ctx, network, net.JoinHostPort(localIP.String(), "0"))
+	if err != nil {
+		markSourceFailed(localIP)
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// acceptPeer waits up to bindWait for a connection on l from want, or from
+// anyone when want is nil or unspecified.
+func acceptPeer(l *net.TCPListener, want net.IP) (*net.TCPConn, error) {
+	if err := l.SetDeadline(time.Now().Add(bindWait)); err != nil {
+		return nil, err
+	}
+	for {
+		peer, err := l.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("no connection within %v: %w", bindWait, err)
+		}
+		ip := peer.RemoteAddr().(*net.TCPAddr).IP
+		if want == nil || want.IsUnspecified() || ip.Equal(want) {
+			return peer, nil
+		}
+		sugar.Warnw("Refusing BIND connection from unexpected address", "remote_addr", peer.RemoteAddr().String(), "want", want.String())
+		peer.Close()
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reset circuit breaker settings. Some upstreams start resetting
+// established connections from a source IP after heavy use; once an IP
+// collects resetThreshold resets within resetWindow it is left out of
+// selection for resetCooldown. This is separate from the connect-time
+// cooldown in health.go. A zero threshold disables the breaker.
+var (
+	resetThreshold int
+	resetWindow    = time.Minute
+	resetCooldown  = 5 * time.Minute
+)
+
+var breakerTrips = newCounter("scoreproxy_reset_breaker_trips_total", "Times a source IP was paused after repeated upstream resets.")
+
+// resetBreaker tracks upstream resets for one source IP.
+type resetBreaker struct {
+	resets    []time.Time // within the current window, oldest first
+	openUntil time.Time
+}
+
+var (
+	breakerMu sync.Mutex
+	breakers  = make(map[netip.Addr]*resetBreaker)
+)
+
+// recordReset notes that an established connection from ip was reset by
+// the upstream, tripping the breaker once the threshold is reached.
+func recordReset(ip net.IP) {
+	if resetThreshold <= 0 {
+		return
+	}
+	now := time.Now()
+	key := addrKey(ip)
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	b := breakers[key]
+	if b == nil {
+		b = &resetBreaker{}
+		breakers[key] = b
+	}
+	b.prune(now)
+	b.resets = append(b.resets, now)
+	connLogger().Debugw("Upstream reset on established connection",
+		"local_ip", ip.String(),
+		"recent_resets", len(b.resets),
+	)
+	if len(b.resets) < resetThreshold || now.Before(b.openUntil) {
+		return
+	}
+	b.openUntil = now.Add(resetCooldown)
+	b.resets = nil
+	breakerTrips.Inc()
+	sugar.Warnw("Circuit breaker tripped, pausing source IP after upstream resets",
+		"local_ip", ip.String(),
+		"threshold", resetThreshold,
+		"window", resetWindow,
+		"cooldown", resetCooldown,
+	)
+}
+
+// breakerOpen reports whether ip is paused by its reset breaker, closing
+// breakers whose cooldown has passed.
+func breakerOpen(ip net.IP) bool {
+	if resetThreshold <= 0 {
+		return false
+	}
+	key := addrKey(ip)
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	b, ok := breakers[key]
+	if !ok || b.openUntil.IsZero() {
+		return false
+	}
+	if time.Now().Before(b.openUntil) {
+		return true
+	}
+	b.openUntil = time.Time{}
+	if len(b.resets) == 0 {
+		delete(breakers, key)
+	}
+	sugar.Infow("Circuit breaker reset, source IP back in selection", "local_ip", ip.String())
+	return false
+}
+
+// prune drops resets that have left the window.
+func (b *resetBreaker) prune(now time.Time) {
+	cutoff := now.Add(-resetWindow)
+	i := 0
+	for i < len(b.resets) && b.resets[i].Before(cutoff) {
+		i++
+	}
+	b.resets = b.resets[i:]
+}
+
+// breakerStatus is one source IP's breaker state as shown by the admin API.
+type breakerStatus struct {
+	SourceIP     string     `json:"source_ip"`
+	RecentResets int        `json:"recent_resets"`
+	Open         bool       `json:"open"`
+	OpenUntil    *time.Time `json:"open_until,omitempty"`
+}
+
+// breakerSnapshot returns the state of every source IP with recent resets
+// or an open breaker, sorted by IP.
+func breakerSnapshot() []breakerStatus {
+	now := time.Now()
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	out := make([]breakerStatus, 0, len(breakers))
+	for key, b := range breakers {
+		b.prune(now)
+		open := now.Before(b.openUntil)
+		if !open && len(b.resets) == 0 {
+			continue
+		}
+		s := breakerStatus{SourceIP: key.String(), RecentResets: len(b.resets), Open: open}
+		if open {
+			until := b.openUntil
+			s.OpenUntil = &until
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return netip.MustParseAddr(out[i].SourceIP).Less(netip.MustParseAddr(out[j].SourceIP))
+	})
+	return out
+}
+
+// tcpClose is TCP_CLOSE from the kernel's TCP state enum, the state a
+// socket enters once it has received a reset.
+const tcpClose = 7
+
+// resetByUpstream reports whether err is a connection reset caused by the
+// upstream side of conn. A spliced copy reports a reset from either side
+// the same way, so the upstream socket's own TCP state decides: only a
+// socket that received the RST has moved to TCP_CLOSE.
+func resetByUpstream(err error, conn *net.TCPConn) bool {
+	if !errors.Is(err, syscall.ECONNRESET) {
+		return false
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || sockErr != nil {
+		return false
+	}
+	return info.State == tcpClose
+}
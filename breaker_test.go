@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestResetByUpstream(t *testing.T) {
+	conn, peer := tcpPair(t)
+	// Closing with a zero linger sends a RST instead of a FIN.
+	peer.SetLinger(0)
+	peer.Close()
+	_, err := conn.Read(make([]byte, 1))
+	if !resetByUpstream(err, conn) {
+		t.Errorf("read error %v after the peer's RST not seen as an upstream reset", err)
+	}
+
+	conn, peer = tcpPair(t)
+	peer.Close()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after the peer's FIN = %v, want EOF", err)
+	}
+	// A reset reported by the other side of a splice leaves this socket
+	// open.
+	if resetByUpstream(syscall.ECONNRESET, conn) {
+		t.Error("reset seen on a socket that received none")
+	}
+}
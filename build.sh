@@ -1,4 +1,4 @@
 #!/bin/bash
 
-CGO_ENABLED=0 go build -o scoreproxy -ldflags '-extldflags "-static"' main.go
+CGO_ENABLED=0 go build -o scoreproxy -ldflags '-extldflags "-static"' .
 strip scoreproxy
\ No newline at end of file
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Linux capability bit numbers (linux/capability.h).
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+// effectiveCaps reads the effective capability mask of this process.
+func effectiveCaps() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			return strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("CapEff not found in /proc/self/status")
+}
+
+// ipv6FreebindMissing is set when the kernel lacks IPV6_FREEBIND (before
+// Linux 4.15). IPv6 dials then rely on net.ipv6.ip_nonlocal_bind instead.
+var ipv6FreebindMissing bool
+
+// probeBind checks that a socket can be bound to ip the way every dial
+// does, with IP_FREEBIND (IPV6_FREEBIND for IPv6) when freebind is set.
+func probeBind(ip net.IP, freebind bool) error {
+	family, level, opt, optName := syscall.AF_INET, syscall.IPPROTO_IP, syscall.IP_FREEBIND, "IP_FREEBIND"
+	var sa syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family, level, opt, optName = syscall.AF_INET6, syscall.IPPROTO_IPV6, ipv6Freebind, "IPV6_FREEBIND"
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if freebind {
+		if err := syscall.SetsockoptInt(fd, level, opt, 1); err != nil {
+			return fmt.Errorf("setsockopt %s: %w", optName, err)
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return fmt.Errorf("bind %s: %w", ip, err)
+	}
+	return nil
+}
+
+// nonlocalBindSysctl names the sysctl that lets sockets of ip's family bind
+// addresses the host does not own.
+func nonlocalBindSysctl(ip net.IP) string {
+	if ip.To4() != nil {
+		return "net.ipv4.ip_nonlocal_bind"
+	}
+	return "net.ipv6.ip_nonlocal_bind"
+}
+
+func sysctlPath(name string) string {
+	return "/proc/sys/" + strings.ReplaceAll(name, ".", "/")
+}
+
+func readSysctl(name string) (string, error) {
+	b, err := os.ReadFile(sysctlPath(name))
+	return strings.TrimSpace(string(b)), err
+}
+
+func writeSysctl(name, value string) error {
+	return os.WriteFile(sysctlPath(name), []byte(value+"\n"), 0)
+}
+
+// checkNonlocalBind makes sure dials can bind ip. When freebind alone
+// fails and the nonlocal bind sysctl is off, it either returns an error
+// saying how to fix that or, with fix set, turns the sysctl on itself.
+func checkNonlocalBind(ip net.IP, fix bool) error {
+	err := probeBind(ip, true)
+	if err == nil {
+		return nil
+	}
+	freebindMissing := ip.To4() == nil && errors.Is(err, syscall.ENOPROTOOPT)
+	name := nonlocalBindSysctl(ip)
+	if v, _ := readSysctl(name); v != "1" {
+		if !fix {
+			return fmt.Errorf("source IP spoofing will not work, binding %s with freebind failed: %w; run 'sysctl -w %s=1' or start with -fix-sysctl", ip, err, name)
+		}
+		if err := writeSysctl(name, "1"); err != nil {
+			return fmt.Errorf("-fix-sysctl could not set %s=1: %w", name, err)
+		}
+		sugar.Warnw("Enabled nonlocal binds for source IP spoofing; this lasts until reboot", "sysctl", name)
+	}
+	if freebindMissing {
+		ipv6FreebindMissing = true
+		sugar.Warnw("Kernel lacks IPV6_FREEBIND, relying on the nonlocal bind sysctl for IPv6", "sysctl", name)
+	}
+	if err := probeBind(ip, !freebindMissing); err != nil {
+		return fmt.Errorf("source IP spoofing will not work, binding %s failed even with %s=1: %w", ip, name, err)
+	}
+	return nil
+}
+
+// checkCapabilities reports whether spoofing will work before the first
+// real dial, binding each of probeIPs (one per pool family). It returns an
+// error for settings that are certain to fail. fixSysctl is -fix-sysctl.
+func checkCapabilities(probeIPs []net.IP, fixSysctl bool) error {
+	caps, err := effectiveCaps()
+	if err != nil {
+		sugar.Warnw("Could not read process capabilities", "error", err)
+	}
+	netAdmin := caps&(1<<capNetAdmin) != 0
+	netRaw := caps&(1<<capNetRaw) != 0
+
+	var bindErr error
+	for _, ip := range probeIPs {
+		if bindErr = checkNonlocalBind(ip, fixSysctl); bindErr != nil {
+			break
+		}
+	}
+	nonlocal4, _ := readSysctl("net.ipv4.ip_nonlocal_bind")
+	nonlocal6, _ := readSysctl("net.ipv6.ip_nonlocal_bind")
+	sugar.Infow("Capability check",
+		"cap_net_admin", netAdmin,
+		"cap_net_raw", netRaw,
+		"freebind_ok", len(probeIPs) > 0 && bindErr == nil,
+		"probe_ips", probeIPs,
+		"ipv4_nonlocal_bind", nonlocal4,
+		"ipv6_nonlocal_bind", nonlocal6,
+	)
+
+	if bindErr != nil {
+		return bindErr
+	}
+	if fwmark > 0 && !netAdmin {
+		return fmt.Errorf("-fwmark needs CAP_NET_ADMIN to set SO_MARK; run as root or grant it with setcap cap_net_admin+ep")
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dial circuit breaker settings. After circuitFailures consecutive failed
+// dials from a source IP its circuit opens and the IP is left out of
+// selection for circuitOpenTime. The circuit then goes half-open: the IP
+// is offered for one probe dial at a time, and the probe's outcome closes
+// the circuit or opens it again. Unlike quarantine, one success resets the
+// count, so only IPs that fail every time are sidelined. A zero
+// circuitFailures disables the breaker.
+var (
+	circuitFailures int
+	circuitOpenTime = 30 * time.Second
+)
+
+var circuitOpens = newCounter("scoreproxy_circuit_opens_total", "Times a source IP's dial circuit breaker opened.")
+
+// Circuit states.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// dialCircuit is the circuit breaker of one source IP.
+type dialCircuit struct {
+	state       string
+	consecutive int       // failed dials in a row
+	openUntil   time.Time // when an open circuit goes half-open
+	nextProbe   time.Time // when a half-open circuit offers the IP again
+}
+
+var (
+	circuitMu sync.Mutex
+	circuits  = make(map[netip.Addr]*dialCircuit)
+)
+
+// recordCircuit feeds a dial's outcome from ip into its circuit breaker.
+func recordCircuit(ip net.IP, failed bool) {
+	if circuitFailures <= 0 {
+		return
+	}
+	key := addrKey(ip)
+	circuitMu.Lock()
+	defer circuitMu.Unlock()
+	c := circuits[key]
+	if !failed {
+		if c != nil && c.state == circuitHalfOpen {
+			sugar.Infow("Probe dial succeeded, circuit closed", "local_ip", ip.String())
+		}
+		delete(circuits, key)
+		return
+	}
+	if c == nil {
+		c = &dialCircuit{state: circuitClosed}
+		circuits[key] = c
+	}
+	c.consecutive++
+	if c.state == circuitOpen || (c.state == circuitClosed && c.consecutive < circuitFailures) {
+		return
+	}
+	// A failed probe reopens the circuit straight away.
+	c.state = circuitOpen
+	c.openUntil = time.Now().Add(circuitOpenTime)
+	circuitOpens.Inc()
+	sugar.Warnw("Circuit breaker opened, pausing source IP after consecutive dial failures",
+		"local_ip", ip.String(),
+		"consecutive_failures", c.consecutive,
+		"open", circuitOpenTime,
+	)
+}
+
+// circuitBlocked reports whether ip's circuit keeps it out of selection.
+// A half-open circuit lets one caller through per dialTimeout, so a probe
+// whose selection did not lead to a dial does not block the IP for good.
+func circuitBlocked(ip net.IP) bool {
+	if circuitFailures <= 0 {
+		return false
+	}
+	key := addrKey(ip)
+	circuitMu.Lock()
+	defer circuitMu.Unlock()
+	c, ok := circuits[key]
+	if !ok || c.state == circuitClosed {
+		return false
+	}
+	now := time.Now()
+	if c.state == circuitOpen {
+		if now.Before(c.openUntil) {
+			return true
+		}
+		c.state = circuitHalfOpen
+		sugar.Infow("Circuit breaker half-open, probing source IP", "local_ip", ip.String())
+	} else if now.Before(c.nextProbe) {
+		return true
+	}
+	c.nextProbe = now.Add(dialTimeout)
+	return false
+}
+
+// circuitStatus is one source IP's circuit as shown by the admin API.
+type circuitStatus struct {
+	SourceIP            string     `json:"source_ip"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+// circuitSnapshot returns every source IP with failed dials since its last
+// success, sorted by IP.
+func circuitSnapshot() []circuitStatus {
+	now := time.Now()
+	circuitMu.Lock()
+	defer circuitMu.Unlock()
+	out := make([]circuitStatus, 0, len(circuits))
+	for key, c := range circuits {
+		s := circuitStatus{SourceIP: key.String(), State: c.state, ConsecutiveFailures: c.consecutive}
+		if c.state == circuitOpen {
+			if now.Before(c.openUntil) {
+				until := c.openUntil
+				s.OpenUntil = &until
+			} else {
+				// Goes half-open on its next selection.
+				s.State = circuitHalfOpen
+			}
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return netip.MustParseAddr(out[i].SourceIP).Less(netip.MustParseAddr(out[j].SourceIP))
+	})
+	return out
+}
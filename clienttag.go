@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Client tags label each SOCKS session with the tool that opened it, so
+// per-connection logs and metrics can be attributed without correlating
+// client IPs by hand. A tag comes from the username option tag=NAME (with
+// -username-hint) or from -client-tag-map, and must be in the configured
+// set to keep metric cardinality bounded.
+
+// untagged is the metrics label for sessions without a client tag.
+const untagged = "untagged"
+
+// clientTagNet labels clients connecting from one CIDR.
+type clientTagNet struct {
+	ipNet *net.IPNet
+	tag   string
+}
+
+var (
+	allowedClientTags map[string]bool
+	clientTagNets     []clientTagNet
+)
+
+var clientConns = newCounterVec("scoreproxy_client_connections_total", "SOCKS requests by client tag.", "client_tag")
+
+// setupClientTags parses -client-tags (a comma-separated list of allowed
+// tags) and -client-tag-map (comma-separated CIDR=tag pairs). Tags named in
+// the map are allowed implicitly.
+func setupClientTags(allowed, cidrMap string) error {
+	tags := make(map[string]bool)
+	for _, t := range strings.Split(allowed, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags[t] = true
+		}
+	}
+	var nets []clientTagNet
+	for _, pair := range strings.Split(cidrMap, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		cidr, tag, ok := strings.Cut(pair, "=")
+		if !ok || tag == "" {
+			return fmt.Errorf("invalid -client-tag-map entry %q (want CIDR=tag)", pair)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid -client-tag-map entry %q: %w", pair, err)
+		}
+		nets = append(nets, clientTagNet{ipNet: ipNet, tag: tag})
+		tags[tag] = true
+	}
+	allowedClientTags = tags
+	clientTagNets = nets
+	return nil
+}
+
+// clientTagFor picks the tag for a session: an allowed tag=NAME username
+// option first, then the first -client-tag-map CIDR containing the client.
+func clientTagFor(client net.Addr, username string) string {
+	if len(allowedClientTags) == 0 {
+		return ""
+	}
+	if usernameHints && username != "" {
+		_, opts := parseUsername(username)
+		if tag, ok := opts["tag"]; ok {
+			if allowedClientTags[tag] {
+				return tag
+			}
+			sugar.Warnw("Ignoring client tag not in -client-tags", "client_addr", client.String(), "tag", tag)
+		}
+	}
+	if tcpAddr, ok := client.(*net.TCPAddr); ok {
+		for _, n := range clientTagNets {
+			if n.ipNet.Contains(tcpAddr.IP) {
+				return n.tag
+			}
+		}
+	}
+	return ""
+}
+
+// withClientTag records tag on ctx and counts the session under it.
+func withClientTag(ctx context.Context, tag string) context.Context {
+	if len(allowedClientTags) == 0 {
+		return ctx
+	}
+	if tag == "" {
+		clientConns.Inc(untagged)
+		return ctx
+	}
+	clientConns.Inc(tag)
+	return context.WithValue(ctx, ctxClientTag, tag)
+}
+
+// clientTag returns the session's client tag, or "" if it has none.
+func clientTag(ctx context.Context) string {
+	tag, _ := ctx.Value(ctxClientTag).(string)
+	return tag
+}
+
+// connLog returns the logger for per-connection messages, carrying the
+// client_tag field when the session has one.
+func connLog(ctx context.Context) *zap.SugaredLogger {
+	if tag := clientTag(ctx); tag != "" {
+		return connLogger().With("client_tag", tag)
+	}
+	return connLogger()
+}
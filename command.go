@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Subcommands. Without one, scoreproxy serves, as it always has.
+const (
+	cmdServe    = "serve"
+	cmdValidate = "validate"
+	cmdGen      = "gen"
+	cmdCheck    = "check"
+	cmdRelay    = "relay"
+	cmdSelfTest = "selftest"
+)
+
+// genLimit caps how many addresses gen writes, so an IPv6 pool does not
+// fill the disk.
+const genLimit = 1 << 24
+
+// parseCommand removes a leading subcommand from os.Args, so the flag
+// package sees only flags, and returns it.
+func parseCommand() string {
+	if len(os.Args) > 1 {
+		switch cmd := os.Args[1]; cmd {
+		case cmdServe, cmdValidate, cmdGen, cmdCheck, cmdRelay, cmdSelfTest:
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			return cmd
+		}
+	}
+	return cmdServe
+}
+
+// usage prints the subcommands followed by the flag defaults.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage: %[1]s [command] [flags]
+
+Commands:
+  serve               run the proxy (the default)
+  validate            load the configuration and pool, report problems, and exit
+  gen                 write every pool IP to stdout, one per line
+  check HOST:PORT     make one dial to HOST:PORT from a pool IP and exit
+  relay               accept a -reverse tunnel and expose its SOCKS service locally
+  selftest            check spoofing locally, or with -target dial HOST:PORT from
+                      -selftest-ips pool IPs and report which ones get through
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// runGen writes every address of p to w, one per line.
+func runGen(w io.Writer, p *ipPool) error {
+	if p.len() > genLimit {
+		return fmt.Errorf("pool has %s IPs, more than gen writes (%d); use the ranges instead", p.count(), genLimit)
+	}
+	out := bufio.NewWriter(w)
+	for i := uint64(0); i < p.len(); i++ {
+		if _, err := fmt.Fprintln(out, p.at(u128{0, i})); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// runCheck makes one dial to target through the proxy's dial path and
+// reports the source IP it used.
+func runCheck(target string) error {
+	start := time.Now()
+	conn, err := customDialer(context.Background(), "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(os.Stdout, "OK: connected to %s from %s in %v\n", target, conn.LocalAddr(), time.Since(start).Round(time.Millisecond))
+	return nil
+}
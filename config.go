@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variable for each flag:
+// SCOREPROXY_ plus the flag name upper-cased with dashes as underscores,
+// e.g. SCOREPROXY_ON_EMPTY_POOL.
+const envPrefix = "SCOREPROXY_"
+
+// envName returns the environment variable that sets flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag not given on the command line from its
+// environment variable, if set. Repeatable flags take a comma-separated
+// list.
+func applyEnv() error {
+	onCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || onCommandLine[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %w", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// applyConfigFile sets flags from a YAML or TOML file (picked by a .toml
+// extension) whose top-level keys are flag names:
+//
+//	file: [pool-a.txt, pool-b.txt]
+//	selection: coverage
+//	retries: 2
+//
+// Repeatable flags take a list. Flags given on the command line or through
+// the environment (see applyEnv, which must run first) win over the file.
+func applyConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file '%s': %w", path, err)
+	}
+	values := make(map[string]any)
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file '%s': %w", path, err)
+	}
+
+	alreadySet := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { alreadySet[f.Name] = true })
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("config file '%s': unknown setting %q", path, name)
+		}
+		if alreadySet[name] {
+			continue
+		}
+		if err := setFlagFromConfig(f, values[name]); err != nil {
+			return fmt.Errorf("config file '%s': %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// setFlagFromConfig sets f from a decoded config value: a scalar, or a
+// list for repeatable flags.
+func setFlagFromConfig(f *flag.Flag, value any) error {
+	switch v := value.(type) {
+	case []any:
+		if _, ok := f.Value.(*stringList); !ok {
+			return fmt.Errorf("takes a single value, not a list")
+		}
+		for _, item := range v {
+			if err := setFlagFromConfig(f, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		return fmt.Errorf("takes a value, not a table")
+	case nil:
+		return fmt.Errorf("missing value")
+	default:
+		return f.Value.Set(fmt.Sprint(v))
+	}
+}
+
+// effectiveConfig returns every flag's effective value, keyed by flag name,
+// merged with derived settings that don't map to a single flag.
+func effectiveConfig(derived map[string]any) map[string]any {
+	cfg := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		cfg[f.Name] = f.Value.String()
+	})
+	for k, v := range derived {
+		cfg[k] = v
+	}
+	return cfg
+}
+
+// printConfig writes cfg to stdout as indented JSON.
+func printConfig(cfg map[string]any) error {
+	out, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(out))
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// halfClose controls what happens when one side of a relayed connection
+// finishes sending. By default the CloseWrite call made by proxy is
+// propagated as a TCP half-close so the other direction keeps flowing;
+// only a connection that cannot half-close is closed. -half-close=false
+// tears the connection down in both directions instead.
+var halfClose = true
+
+// noDelay is applied as TCP_NODELAY to both sides of every relayed
+// connection. Go already disables Nagle's algorithm on new TCP connections;
+// setting it explicitly keeps the behavior visible and lets -nodelay=false
+// turn batching back on.
+var noDelay = true
+
+// setNoDelay applies noDelay to conn. side names the connection in the
+// warning logged when conn is not a TCP connection.
+func setNoDelay(conn net.Conn, side string) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		sugar.Warnw("Cannot set TCP_NODELAY, not a TCP connection", "side", side, "type", fmt.Sprintf("%T", conn))
+		return
+	}
+	if err := tcpConn.SetNoDelay(noDelay); err != nil {
+		sugar.Warnw("Failed to set TCP_NODELAY", "side", side, "nodelay", noDelay, "error", err)
+	}
+}
+
+// sourceConn is an upstream connection returned by customDialer.
+//
+// A TCP connection cannot change its source address mid-stream, so the
+// source IP is chosen exactly once per dial and is fixed for the life of the
+// connection. Every byte relayed over a kept-alive SOCKS session egresses
+// from that one IP; a new source IP is only picked on the next dial.
+type sourceConn struct {
+	net.Conn  // a *net.TCPConn, or a userspace stack connection with -userspace
+	sourceIP  net.IP
+	dest      string
+	clientTag string
+	start     time.Time
+
+	sent, received atomic.Uint64
+	resetSeen      atomic.Bool
+	closeOnce      sync.Once
+}
+
+// newSourceConn wraps conn and verifies the kernel actually bound it to
+// sourceIP, so the per-connection invariant cannot silently drift.
+func newSourceConn(conn net.Conn, sourceIP net.IP, dest, clientTag string) (*sourceConn, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || !local.IP.Equal(sourceIP) {
+		return nil, fmt.Errorf("connection bound to %v, expected source IP %s", conn.LocalAddr(), sourceIP)
+	}
+	ip := make(net.IP, len(sourceIP))
+	copy(ip, sourceIP)
+	return &sourceConn{Conn: conn, sourceIP: ip, dest: dest, clientTag: clientTag, start: time.Now()}, nil
+}
+
+// SourceIP returns a copy of the source IP this connection egresses from.
+func (c *sourceConn) SourceIP() net.IP {
+	ip := make(net.IP, len(c.sourceIP))
+	copy(ip, c.sourceIP)
+	return ip
+}
+
+func (c *sourceConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(uint64(n))
+	c.checkReset(err)
+	return n, err
+}
+
+func (c *sourceConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(uint64(n))
+	c.checkReset(err)
+	return n, err
+}
+
+// ReadFrom and WriteTo keep io.Copy's splice fast path for kernel
+// connections while still counting bytes.
+func (c *sourceConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.Conn, r)
+	c.sent.Add(uint64(n))
+	c.checkReset(err)
+	return n, err
+}
+
+func (c *sourceConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, c.Conn)
+	c.received.Add(uint64(n))
+	c.checkReset(err)
+	return n, err
+}
+
+// checkReset feeds an upstream reset into the source IP's circuit
+// breaker, counting at most one reset per connection.
+func (c *sourceConn) checkReset(err error) {
+	tcpConn, ok := c.Conn.(*net.TCPConn)
+	if err == nil || !ok || !resetByUpstream(err, tcpConn) {
+		return
+	}
+	if c.resetSeen.CompareAndSwap(false, true) {
+		recordReset(c.sourceIP)
+	}
+}
+
+// CloseWrite is called by proxy once the client has finished sending. An
+// upstream that cannot half-close, such as a wrapped one, is closed.
+func (c *sourceConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); halfClose && ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+func (c *sourceConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		end := time.Now()
+		recentConns.add(connRecord{
+			SourceIP:      c.sourceIP.String(),
+			Dest:          c.dest,
+			Start:         c.start,
+			End:           &end,
+			BytesSent:     c.sent.Load(),
+			BytesReceived: c.received.Load(),
+			Reason:        "closed",
+			ClientTag:     c.clientTag,
+		})
+	})
+	return err
+}
+
+// clientConn wraps an accepted client connection so that the CloseWrite
+// proxy calls once the upstream has finished sending honors -half-close
+// too.
+type clientConn struct {
+	*net.TCPConn
+}
+
+// wrapClientConn returns conn wrapped as a clientConn when it is TCP, or
+// as a halfCloseConn when it can otherwise half-close, like TLS.
+func wrapClientConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*net.TCPConn); ok {
+		return &clientConn{TCPConn: c}
+	}
+	if _, ok := conn.(closeWriter); ok {
+		return &halfCloseConn{Conn: conn}
+	}
+	return conn
+}
+
+func (c *clientConn) CloseWrite() error {
+	if halfClose {
+		return c.TCPConn.CloseWrite()
+	}
+	return c.Close()
+}
+
+// halfCloseConn is clientConn for other client connections with a
+// CloseWrite, such as TLS (which sends close_notify) or PROXY protocol ones.
+type halfCloseConn struct {
+	net.Conn
+}
+
+func (c *halfCloseConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); halfClose && ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// startSourceRecorder runs a server that counts the bytes of every
+// connection it accepts and records the source address of each read.
+func startSourceRecorder(t *testing.T) (addr string, sources func() (conns int, ips []string, n int)) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		conns int
+		seen  = make(map[string]bool)
+		total int
+	)
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					mu.Lock()
+					seen[conn.RemoteAddr().(*net.TCPAddr).IP.String()] = true
+					total += len(line)
+					mu.Unlock()
+					if err != nil {
+						return
+					}
+					fmt.Fprintf(conn, "ok\n")
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() (int, []string, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		var ips []string
+		for ip := range seen {
+			ips = append(ips, ip)
+		}
+		return conns, ips, total
+	}
+}
+
+func TestConnectionKeepsOneSourceIP(t *testing.T) {
+	needLoopbackPool(t)
+	usePool(t, "127.0.0.2-127.0.0.9")
+	proxyAddr := startProxy(t)
+	target, sources := startSourceRecorder(t)
+
+	dialer, err := netproxy.SOCKS5("tcp", proxyAddr, nil, netproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("CONNECT through proxy: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	const writes = 50
+	sent := 0
+	for i := range writes {
+		line := fmt.Sprintf("write %d of one kept-alive connection\n", i)
+		if _, err := io.WriteString(conn, line); err != nil {
+			t.Fatal(err)
+		}
+		sent += len(line)
+		// Wait for each answer so every write is a separate segment.
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatalf("reading answer %d: %v", i, err)
+		}
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, n := sources(); n >= sent || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conns, ips, n := sources()
+	if conns != 1 {
+		t.Errorf("server accepted %d connections, want 1", conns)
+	}
+	if len(ips) != 1 {
+		t.Errorf("%d writes arrived from %v, want a single source IP", writes, ips)
+	}
+	if n != sent {
+		t.Errorf("server read %d bytes, want %d", n, sent)
+	}
+}
+
+func TestNewSourceConnChecksLocalAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := newSourceConn(conn, net.IPv4(127, 0, 0, 1), l.Addr().String(), ""); err != nil {
+		t.Errorf("newSourceConn with the bound IP: %v", err)
+	}
+	if _, err := newSourceConn(conn, net.IPv4(127, 0, 0, 2), l.Addr().String(), ""); err == nil {
+		t.Error("newSourceConn accepted a source IP the connection is not bound to")
+	}
+}
+
+// useHalfClose sets -half-close for the rest of the test.
+func useHalfClose(t *testing.T, on bool) {
+	t.Helper()
+	prev := halfClose
+	t.Cleanup(func() { halfClose = prev })
+	halfClose = on
+}
+
+// startCounter runs a server that reads until the client half-closes, then
+// answers with the number of bytes it read.
+func startCounter(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				fmt.Fprintf(conn, "got %d bytes\n", len(b))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// shutdownThenRead sends a request through the proxy, shuts down its write
+// half and returns whatever the server sends back.
+func shutdownThenRead(t *testing.T, proxyAddr, target string) string {
+	t.Helper()
+	dialer, err := netproxy.SOCKS5("tcp", proxyAddr, nil, netproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("CONNECT through proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "request"); err != nil {
+		t.Fatal(err)
+	}
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		t.Fatalf("SOCKS client connection %T cannot half-close", conn)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(conn)
+	return string(b)
+}
+
+func TestHalfClose(t *testing.T) {
+	usePool(t, "127.0.0.1")
+	// Half-close is propagated by default.
+	proxyAddr := startProxy(t)
+	target := startCounter(t)
+
+	if got := shutdownThenRead(t, proxyAddr, target); got != "got 7 bytes\n" {
+		t.Errorf("after shutting down writes the client read %q, want the server's answer", got)
+	}
+}
+
+func TestCloseWriteWithoutHalfCloseSupport(t *testing.T) {
+	useHalfClose(t, true)
+	upstream, peer := net.Pipe()
+	defer peer.Close()
+	c := &sourceConn{Conn: upstream, sourceIP: net.IPv4(127, 0, 0, 1)}
+	// net.Pipe has no CloseWrite, so the connection is closed instead.
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("peer read error = %v, want EOF after close", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// dadProber checks IPv4 pool IPs for other hosts before their first use,
+// or is nil when -dad is off.
+var dadProber *arpProber
+
+var dadConflicts = newCounter("scoreproxy_dad_conflicts_total", "Pool IPs skipped because another host answered an ARP probe for them.")
+
+// dadProbeWorkers bounds how many ARP probes are in flight at once, which
+// also paces the probes sent for a large pool.
+const dadProbeWorkers = 256
+
+// arpProber performs duplicate address detection (RFC 5227 probes) for pool
+// IPs on one interface. Probes run in the background, for every IP when a
+// pool is installed and for any IP selection meets before then. Outcomes
+// are remembered while the IP stays in a pool.
+type arpProber struct {
+	ifi      *net.Interface
+	fd       int
+	timeout  time.Duration
+	slots    chan struct{} // one per probe in flight
+	disabled atomic.Bool   // set when reading replies fails
+
+	mu     sync.Mutex
+	probes map[netip.Addr]*dadProbe
+}
+
+// dadProbe is the state of one IP's probe.
+type dadProbe struct {
+	done     chan struct{} // closed once the outcome is known
+	finished bool
+	owner    net.HardwareAddr // the MAC that claimed the IP, if any
+}
+
+// startARPProber opens the probing socket on iface. A probe waits timeout
+// for another host to answer.
+func startARPProber(iface string, timeout time.Duration) (*arpProber, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -dad interface: %w", err)
+	}
+	if len(ifi.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("-dad interface %s is not Ethernet", iface)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open AF_PACKET socket (needs CAP_NET_RAW): %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: ifi.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind AF_PACKET socket to %s: %w", iface, err)
+	}
+	p := &arpProber{
+		ifi:     ifi,
+		fd:      fd,
+		timeout: timeout,
+		slots:   make(chan struct{}, dadProbeWorkers),
+		probes:  make(map[netip.Addr]*dadProbe),
+	}
+	go p.readReplies()
+	sugar.Infow("Probing pool IPs for conflicts before first use", "interface", iface, "timeout", timeout)
+	return p, nil
+}
+
+// dadClaimed reports whether ip must be skipped because another host on
+// the segment uses it or its probe has not finished yet. It never waits:
+// an IP seen for the first time has its probe started in the background.
+// IPv6 addresses are not probed.
+func dadClaimed(ip net.IP) bool {
+	if dadProber == nil || ip.To4() == nil || dadProber.disabled.Load() {
+		return false
+	}
+	return dadProber.claimed(ip.To4())
+}
+
+func (p *arpProber) claimed(ip net.IP) bool {
+	key := addrKey(ip)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.probes[key]
+	if !ok {
+		pr = p.add(key)
+		go p.probe(ip, pr)
+	}
+	return !pr.finished || pr.owner != nil
+}
+
+// add records a pending probe for key. p.mu must be held.
+func (p *arpProber) add(key netip.Addr) *dadProbe {
+	pr := &dadProbe{done: make(chan struct{})}
+	p.probes[key] = pr
+	return pr
+}
+
+// probePools forgets the outcomes for IPs that left every pool, then probes
+// the IPv4 addresses of the active and listener pools not probed yet,
+// returning once those probes have finished. It runs at startup and after
+// each reload.
+func (p *arpProber) probePools() {
+	p.mu.Lock()
+	for key := range p.probes {
+		if !anyPoolContains(key.AsSlice()) {
+			delete(p.probes, key)
+		}
+	}
+	p.mu.Unlock()
+
+	pools := []*ipPool{currentPool()}
+	for _, lp := range extraListeners {
+		pools = append(pools, lp.pool)
+	}
+	var wg sync.WaitGroup
+	for _, pool := range pools {
+		for _, iv := range pool.family(familyIPv4).intervals() {
+			for a := iv.lo; ; a = a.add(u128{0, 1}) {
+				if p.disabled.Load() {
+					return
+				}
+				ip := iv.ip(a)
+				key := addrKey(ip)
+				p.mu.Lock()
+				_, ok := p.probes[key]
+				var pr *dadProbe
+				if !ok {
+					pr = p.add(key)
+				}
+				p.mu.Unlock()
+				if !ok {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						p.probe(ip, pr)
+					}()
+				}
+				if a == iv.hi {
+					break
+				}
+			}
+		}
+	}
+	wg.Wait()
+}
+
+// probe sends an ARP probe for ip and waits up to the timeout for a claim.
+// An IP that cannot be probed is treated as free.
+func (p *arpProber) probe(ip net.IP, pr *dadProbe) {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	if _, err := syscall.Write(p.fd, p.probeFrame(ip)); err != nil {
+		sugar.Warnw("Failed to send ARP probe, using IP unchecked", "local_ip", ip.String(), "error", err)
+	} else {
+		timer := time.NewTimer(p.timeout)
+		select {
+		case <-pr.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr.finish()
+}
+
+// finish marks the probe's outcome as known. The prober's mutex must be
+// held.
+func (pr *dadProbe) finish() {
+	if !pr.finished {
+		pr.finished = true
+		close(pr.done)
+	}
+}
+
+// probeFrame builds an ARP probe: a request for ip with an all-zero sender
+// address, which other hosts answer without caching anything about us.
+func (p *arpProber) probeFrame(ip net.IP) []byte {
+	frame := make([]byte, ethHeaderLen+arpPacketLen)
+	copy(frame[0:6], net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:12], p.ifi.HardwareAddr)
+	binary.BigEndian.PutUint16(frame[12:14], syscall.ETH_P_ARP)
+	a := frame[ethHeaderLen:]
+	binary.BigEndian.PutUint16(a[0:2], 1)
+	binary.BigEndian.PutUint16(a[2:4], syscall.ETH_P_IP)
+	a[4], a[5] = 6, 4
+	binary.BigEndian.PutUint16(a[6:8], 1)
+	copy(a[8:14], p.ifi.HardwareAddr)
+	copy(a[24:28], ip)
+	return frame
+}
+
+// readReplies watches ARP on the interface for traffic from another host
+// using an IP that is being probed: its reply to the probe, or any ARP it
+// sends from that address. If the socket fails, detection is turned off
+// and every IP is used unchecked.
+func (p *arpProber) readReplies() {
+	buf := make([]byte, 1514)
+	for {
+		n, from, err := syscall.Recvfrom(p.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			sugar.Errorw("ARP prober failed to read frames, disabling duplicate address detection", "interface", p.ifi.Name, "error", err)
+			p.disabled.Store(true)
+			p.mu.Lock()
+			for _, pr := range p.probes {
+				pr.finish()
+			}
+			p.mu.Unlock()
+			return
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		if n < ethHeaderLen+arpPacketLen {
+			continue
+		}
+		a := buf[ethHeaderLen:n]
+		senderMAC, senderIP := a[8:14], net.IP(a[14:18])
+		if p.ours(senderMAC) || senderIP.IsUnspecified() {
+			continue
+		}
+		key := addrKey(senderIP)
+		p.mu.Lock()
+		if pr, ok := p.probes[key]; ok && !pr.finished {
+			pr.owner = append(net.HardwareAddr(nil), senderMAC...)
+			pr.finish()
+			dadConflicts.Inc()
+			sugar.Warnw("Pool IP is in use by another host, skipping it",
+				"local_ip", senderIP.String(),
+				"owner_mac", pr.owner.String(),
+				"interface", p.ifi.Name,
+			)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// ours reports whether mac belongs to this proxy: the interface itself, or
+// the -userspace stack, which answers probes for pool IPs.
+func (p *arpProber) ours(mac []byte) bool {
+	if bytes.Equal(mac, p.ifi.HardwareAddr) {
+		return true
+	}
+	return userspaceNet != nil && bytes.Equal(mac, userspaceNet.mac)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"net"
+)
+
+// Values for -distribution.
+const (
+	distUniform = "uniform"
+	distZipf    = "zipf"
+)
+
+// distribution shapes random selection. uniform draws every address
+// equally often (or by weight); zipf makes a few addresses hot with a long
+// tail of rarely used ones, like a real user population.
+var distribution = distUniform
+
+// zipfSkew is the Zipf exponent s, which must be greater than 1. Larger
+// values concentrate more traffic on the hottest addresses.
+var zipfSkew = 1.2
+
+// randomFrom returns a random address of a non-empty pool according to
+// -distribution.
+func randomFrom(p *ipPool, r intSource) net.IP {
+	if distribution == distZipf {
+		return p.at(u128{0, zipfRank(p.len()-1, zipfSkew, r)})
+	}
+	return p.random(r)
+}
+
+// zipfRank draws a rank in [0, imax] with P(k) proportional to
+// (k+1)^-s, s > 1, by rejection-inversion (Hörmann and Derflinger), as
+// math/rand's Zipf does. It is reimplemented here so any intSource,
+// including -crypto-rand, can drive it. Rank k is the pool address at
+// offset k, so with -shuffle the hot set is spread across the pool instead
+// of being its lowest addresses.
+func zipfRank(imax uint64, s float64, r intSource) uint64 {
+	const v = 1.0
+	oneMinusQ := 1 - s
+	oneMinusQInv := 1 / oneMinusQ
+	h := func(x float64) float64 { return math.Exp(oneMinusQ*math.Log(v+x)) * oneMinusQInv }
+	hinv := func(x float64) float64 { return math.Exp(oneMinusQInv*math.Log(oneMinusQ*x)) - v }
+	hxm := h(float64(imax) + 0.5)
+	hx0MinusHxm := h(0.5) - math.Exp(math.Log(v)*-s) - hxm
+	squeeze := 1 - hinv(h(1.5)-math.Exp(-s*math.Log(v+1)))
+
+	for {
+		u := float64(randUint64(r)>>11) / (1 << 53)
+		ur := hxm + u*hx0MinusHxm
+		x := hinv(ur)
+		k := math.Floor(x + 0.5)
+		if k-x <= squeeze || ur >= h(k+0.5)-math.Exp(-math.Log(k+v)*s) {
+			return min(uint64(k), imax)
+		}
+	}
+}
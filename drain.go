@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Drain mode takes the proxy out of rotation without cutting off work in
+// progress: new connections are closed as soon as they are accepted, while
+// sessions already being served run to completion. Unlike shutdown it can
+// be undone, after which connections are accepted again.
+var draining atomic.Bool
+
+// activeSessions counts client connections currently being served.
+var activeSessions atomic.Int64
+
+var drainRejected = newCounter("scoreproxy_drain_rejected_total", "Client connections closed on accept because the proxy was draining.")
+
+// setDraining enters or leaves drain mode.
+func setDraining(on bool) {
+	if draining.Swap(on) == on {
+		return
+	}
+	if on {
+		sugar.Warnw("Entering drain mode, new connections will be refused", "active_connections", activeSessions.Load())
+	} else {
+		sugar.Infow("Leaving drain mode, accepting connections again")
+	}
+}
+
+// drainStatus is the drain state reported by the admin API.
+type drainStatus struct {
+	Draining          bool  `json:"draining"`
+	ActiveConnections int64 `json:"active_connections"`
+}
+
+func currentDrainStatus() drainStatus {
+	return drainStatus{Draining: draining.Load(), ActiveConnections: activeSessions.Load()}
+}
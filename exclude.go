@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// parseInterval parses a single IP address, a CIDR block, or a start-end
+// range.
+func parseInterval(spec string) (ipInterval, error) {
+	switch {
+	case strings.Contains(spec, "/"):
+		return cidrInterval(spec)
+	case strings.Contains(spec, "-"):
+		start, end, _ := strings.Cut(spec, "-")
+		return parseIPRange(strings.TrimSpace(start), strings.TrimSpace(end))
+	}
+	ip := net.ParseIP(spec)
+	if ip == nil {
+		return ipInterval{}, fmt.Errorf("invalid IP address, CIDR, or range %q", spec)
+	}
+	return singleIP(ip), nil
+}
+
+// parseExclusions turns -exclude values into intervals. Each value is an
+// IP, CIDR, or range, or else the path of a file listing those one per
+// line with '#' comments.
+func parseExclusions(specs []string) ([]ipInterval, error) {
+	var out []ipInterval
+	for _, spec := range specs {
+		iv, err := parseInterval(spec)
+		if err == nil {
+			out = append(out, iv)
+			continue
+		}
+		if _, statErr := os.Stat(spec); statErr != nil {
+			return nil, err
+		}
+		fromFile, err := loadExclusionFile(spec)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fromFile...)
+	}
+	return out, nil
+}
+
+// loadExclusionFile reads one IP, CIDR, or range per line.
+func loadExclusionFile(path string) ([]ipInterval, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open exclude file '%s': %w", path, err)
+	}
+	defer f.Close()
+	var out []ipInterval
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		iv, err := parseInterval(line)
+		if err != nil {
+			return nil, fmt.Errorf("exclude file '%s' line %d: %w", path, lineNumber, err)
+		}
+		out = append(out, iv)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading exclude file '%s': %w", path, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// sourceCooldown is how long a source IP is skipped after a failed dial.
+// Zero disables cooldowns.
+var sourceCooldown time.Duration
+
+var (
+	cooldownMu    sync.Mutex
+	cooldownUntil = make(map[netip.Addr]time.Time)
+)
+
+// addrKey converts ip to an allocation-free map key, so the selection hot
+// path doesn't build a string per lookup.
+func addrKey(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+// markSourceFailed puts ip into cooldown after a failed dial.
+func markSourceFailed(ip net.IP) {
+	if sourceCooldown <= 0 {
+		return
+	}
+	cooldownMu.Lock()
+	cooldownUntil[addrKey(ip)] = time.Now().Add(sourceCooldown)
+	cooldownMu.Unlock()
+	connLogger().Debugw("Source IP placed in cooldown", "local_ip", ip.String(), "cooldown", sourceCooldown)
+}
+
+// inCooldown reports whether ip is still cooling down, expiring stale entries.
+func inCooldown(ip net.IP) bool {
+	if sourceCooldown <= 0 {
+		return false
+	}
+	key := addrKey(ip)
+	cooldownMu.Lock()
+	defer cooldownMu.Unlock()
+	until, ok := cooldownUntil[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(cooldownUntil, key)
+		return false
+	}
+	return true
+}
+
+// ipAvailable reports whether ip may be selected right now. Every reason to
+// skip an IP is checked here, so selection has a single place to consult.
+// With -dad, an IPv4 address's first check waits for its ARP probe.
+func ipAvailable(ip net.IP) bool {
+	return !inCooldown(ip) && !breakerOpen(ip) && !quarantined(ip) && !circuitBlocked(ip) && !dadClaimed(ip)
+}
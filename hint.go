@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+// Username hints let a client request per-session options through the SOCKS5
+// username. The username is split on '+': the first part is the account name
+// checked against -authfile (and may be empty without one), and each
+// following part is a key=value option:
+//
+//	scorebot+src=10.1.2.3   use 10.1.2.3 as the source IP for this session
+//	scorebot+tag=nmap       label this session with a -client-tags tag
+//
+// Hints are only honored when -username-hint is set.
+
+// usernameHints enables parsing options out of SOCKS5 usernames.
+var usernameHints bool
+
+// hintOffPool allows a src= hint to name an IP outside the pool.
+var hintOffPool bool
+
+// parseUsername splits a SOCKS5 username into its account name and options.
+func parseUsername(username string) (string, map[string]string) {
+	parts := strings.Split(username, "+")
+	opts := make(map[string]string)
+	for _, part := range parts[1:] {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			opts[k] = v
+		}
+	}
+	return parts[0], opts
+}
+
+// hintCredentials checks only the account part of a hinted username
+// against next. With a nil next, any username and password is accepted.
+type hintCredentials struct {
+	next socks5.CredentialStore
+}
+
+func (h hintCredentials) Valid(user, password string) bool {
+	if h.next == nil {
+		return true
+	}
+	account, _ := parseUsername(user)
+	return h.next.Valid(account, password)
+}
+
+type ctxKey int
+
+const (
+	ctxSourceHint ctxKey = iota
+	ctxClientTag
+	ctxDialTrace
+	ctxSOCKSClient
+	ctxListenerPool
+	ctxDialRequest
+)
+
+// hintRule is a socks5.RuleSet that turns a src= username hint into a
+// source IP carried on the dial context. Invalid hints are ignored with a
+// warning and normal selection applies.
+type hintRule struct{}
+
+func (hintRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.AuthContext == nil {
+		return ctx, true
+	}
+	username := req.AuthContext.Payload["Username"]
+	_, opts := parseUsername(username)
+	src, ok := opts["src"]
+	if !ok {
+		return ctx, true
+	}
+	ip := net.ParseIP(src)
+	switch {
+	case ip == nil:
+		sugar.Warnw("Ignoring invalid source IP hint", "username", username, "hint", src)
+	case !hintOffPool && !poolContains(ip):
+		sugar.Warnw("Ignoring source IP hint outside the pool", "username", username, "hint", src)
+	default:
+		connLog(ctx).Debugw("Using client-requested source IP", "username", username, "local_ip", ip.String())
+		return context.WithValue(ctx, ctxSourceHint, normalizeIP(ip)), true
+	}
+	return ctx, true
+}
+
+// sourceHint returns the source IP requested for this dial, if any.
+func sourceHint(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(ctxSourceHint).(net.IP)
+	return ip
+}
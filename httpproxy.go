@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+
+	"github.com/armon/go-socks5"
+)
+
+// httpProxy serves HTTP proxy clients, tunneling CONNECT requests and
+// forwarding plain http:// requests. It shares the SOCKS server's
+// authentication, rules, resolver and dialer, so both flavors pick source
+// IPs the same way.
+type httpProxy struct {
+	socks   *socksServer
+	forward *httputil.ReverseProxy
+}
+
+// dialRequest is the SOCKS request an HTTP proxy request stands for, carried
+// on the context so the forwarding transport can apply rules to it.
+type dialRequest struct {
+	req *socks5.Request
+}
+
+func newHTTPProxy(s *socksServer) *httpProxy {
+	h := &httpProxy{socks: s}
+	h.forward = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL = r.In.URL
+			r.Out.Host = r.In.Host
+		},
+		// One upstream connection per request, so every request gets its own
+		// source IP as it would through SOCKS.
+		Transport: &http.Transport{
+			DialContext:       h.dialForward,
+			DisableKeepAlives: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			connLog(r.Context()).Infow("http: request failed", "client_addr", r.RemoteAddr, "url", r.URL.String(), "error", err)
+			w.WriteHeader(statusForError(err))
+		},
+	}
+	return h
+}
+
+// serveHTTPProxy serves HTTP proxy clients on addr, a -http-listen value,
+// until the process exits.
+func serveHTTPProxy(s *socksServer, addr string) error {
+	network, address := splitListenAddr(addr)
+	l, err := listen(network, address, "")
+	if err != nil {
+		return err
+	}
+	return (&http.Server{Handler: newHTTPProxy(s)}).Serve(l)
+}
+
+func (h *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		drainRejected.Inc()
+		http.Error(w, "proxy is draining", http.StatusServiceUnavailable)
+		return
+	}
+	activeSessions.Add(1)
+	defer activeSessions.Add(-1)
+
+	authContext, ok := h.authenticate(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="scoreproxy"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		if r.URL.Scheme != "http" || r.URL.Host == "" {
+			http.Error(w, "only CONNECT and absolute http:// URLs are supported", http.StatusBadRequest)
+			return
+		}
+		target = r.URL.Host
+		if r.URL.Port() == "" {
+			target = net.JoinHostPort(r.URL.Hostname(), "80")
+		}
+	}
+	dest, err := parseDest(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	req := &socks5.Request{Version: socks5Version, Command: socks5.ConnectCommand, DestAddr: dest, AuthContext: authContext}
+	var username string
+	if authContext != nil {
+		username = authContext.Payload["Username"]
+	}
+	ctx := r.Context()
+	if client != nil {
+		req.RemoteAddr = &socks5.AddrSpec{IP: client.IP, Port: client.Port}
+		ctx = withClientTag(ctx, clientTagFor(client, username))
+		ctx = withSOCKSClient(ctx, client, username)
+	}
+	logRequest(ctx, req, stringAddr(r.RemoteAddr))
+
+	if r.Method != http.MethodConnect {
+		ctx = context.WithValue(ctx, ctxDialRequest, dialRequest{req})
+		h.forward.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+	if err := h.tunnel(ctx, w, req); err != nil {
+		connLog(ctx).Infow("http: request failed", "client_addr", r.RemoteAddr, "error", err)
+	}
+}
+
+// authenticate checks Proxy-Authorization against the SOCKS server's
+// username/password store. Clients may skip it only when the SOCKS server
+// also accepts clients without auth.
+func (h *httpProxy) authenticate(r *http.Request) (*socks5.AuthContext, bool) {
+	store, noAuth := h.socks.authPolicy()
+	user, password, ok := proxyBasicAuth(r)
+	if !ok {
+		return nil, noAuth
+	}
+	if store != nil && !store.Valid(user, password) {
+		return nil, false
+	}
+	return &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: map[string]string{"Username": user}}, true
+}
+
+// proxyBasicAuth returns the credentials of a Basic Proxy-Authorization
+// header.
+func proxyBasicAuth(r *http.Request) (user, password string, ok bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	return (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+}
+
+// tunnel serves a CONNECT request: it dials the destination and relays
+// data between it and the hijacked client connection.
+func (h *httpProxy) tunnel(ctx context.Context, w http.ResponseWriter, req *socks5.Request) error {
+	target, err := h.socks.dialConnect(ctx, req)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return err
+	}
+	defer target.Close()
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return fmt.Errorf("failed to hijack connection: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return err
+	}
+
+	return relay(wrapClientConn(conn), buf.Reader, target)
+}
+
+// errBlocked is returned for destinations the rules refuse.
+var errBlocked = errors.New("blocked by rules")
+
+// dialForward is the forwarding transport's dialer. The destination comes
+// from the request on ctx rather than addr, so rules see what the client
+// asked for.
+func (h *httpProxy) dialForward(ctx context.Context, network, addr string) (net.Conn, error) {
+	dr, ok := ctx.Value(ctxDialRequest).(dialRequest)
+	if !ok {
+		return nil, fmt.Errorf("no proxy request for %s", addr)
+	}
+	return h.socks.dialConnect(ctx, dr.req)
+}
+
+// parseDest parses a HOST:PORT proxy target.
+func parseDest(target string) (*socks5.AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid target port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &socks5.AddrSpec{IP: ip, Port: port}, nil
+	}
+	return &socks5.AddrSpec{FQDN: host, Port: port}, nil
+}
+
+// statusForError maps a dial error to an HTTP status, following the SOCKS
+// reply it would get.
+func statusForError(err error) int {
+	if errors.Is(err, errBlocked) {
+		return http.StatusForbidden
+	}
+	switch replyForError(err) {
+	case replyServerFailure:
+		return http.StatusServiceUnavailable
+	case replyTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// stringAddr is a client address known only as a string.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
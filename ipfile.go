@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IP files use one grammar for every per-IP attribute:
+//
+//	IP[/prefix][,WEIGHT] [key=value ...]   # optional trailing comment
+//	START-END[,WEIGHT] [key=value ...]
+//
+// Blank lines and lines starting with '#' are ignored. A /prefix or a
+// START-END range stands for every address it covers. Supported keys:
+//
+//	tag=NAME       bucket selected with -tag / -udp-tag (default "default")
+//	proto=tcp|udp  restrict the entry to the main (TCP) pool or the UDP pool
+//	               built with -udp-file / -udp-tag (default both)
+//	weight=N       positive integer; random selection draws each address N
+//	               times as often as an address of weight 1 (default 1)
+//
+// ",WEIGHT" after the address is shorthand for weight=WEIGHT.
+//
+// For compatibility, a bare second field without '=' is read as the tag
+// ("10.1.2.3 web").
+
+// ipEntry is one parsed line of an IP file.
+type ipEntry struct {
+	iv     ipInterval
+	tag    string
+	proto  string
+	weight int
+}
+
+// parseIPLine parses one line of an IP file. ok is false for blank and
+// comment lines.
+func parseIPLine(line string) (entry ipEntry, ok bool, err error) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ipEntry{}, false, nil
+	}
+
+	entry = ipEntry{tag: defaultTag, weight: 1}
+	addr, weight, hasWeight := strings.Cut(fields[0], ",")
+	if entry.iv, err = parseInterval(addr); err != nil {
+		return ipEntry{}, false, err
+	}
+	attrs := fields[1:]
+	bareTag := 0 // index in attrs of the field that may be a bare tag
+	if hasWeight {
+		attrs = append([]string{"weight=" + weight}, attrs...)
+		bareTag = 1
+	}
+	for i, field := range attrs {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			if i != bareTag {
+				return ipEntry{}, false, fmt.Errorf("expected key=value, got %q", field)
+			}
+			key, value = "tag", field
+		}
+		switch key {
+		case "tag":
+			if value == "" {
+				return ipEntry{}, false, fmt.Errorf("empty tag")
+			}
+			entry.tag = value
+		case "proto":
+			if value != "tcp" && value != "udp" {
+				return ipEntry{}, false, fmt.Errorf("invalid proto %q (want tcp or udp)", value)
+			}
+			entry.proto = value
+		case "weight":
+			w, err := strconv.Atoi(value)
+			if err != nil || w < 1 {
+				return ipEntry{}, false, fmt.Errorf("invalid weight %q (want a positive integer)", value)
+			}
+			entry.weight = w
+		default:
+			return ipEntry{}, false, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return entry, true, nil
+}
+
+// matches reports whether the entry belongs in a pool filtered by tag and
+// proto. An empty filter matches everything.
+func (e ipEntry) matches(tag, proto string) bool {
+	if tag != "" && tag != e.tag {
+		return false
+	}
+	return proto == "" || e.proto == "" || e.proto == proto
+}
+
+// stringList is a flag.Value that collects every use of a repeatable flag,
+// also splitting each value on commas.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// ipSet merges address intervals from several sources into one pool.
+type ipSet struct {
+	pool *ipPool
+}
+
+// add merges ivs into the set and returns how many addresses were new,
+// formatted for logs.
+func (s *ipSet) add(ivs []ipInterval) string {
+	before := s.pool.total()
+	s.pool = newIPPool(append(s.pool.intervals(), ivs...))
+	return countString(s.pool.total().sub(before))
+}
+
+// countIPs returns how many distinct addresses ivs hold, formatted for
+// logs.
+func countIPs(ivs []ipInterval) string {
+	return newIPPool(ivs).count()
+}
+
+// loadIPFiles loads every file in paths through loadIPsFromFile and
+// returns all their entries, logging how many distinct IPs each file adds.
+// A file that cannot be read fails the load; a file with no matching IPs
+// is only warned about, as long as the merged pool is not empty.
+func loadIPFiles(paths []string, tag, proto string) ([]ipEntry, error) {
+	var set ipSet
+	var all []ipEntry
+	for _, path := range paths {
+		entries, err := loadIPsFromFile(path, tag, proto)
+		if err != nil {
+			if !errors.Is(err, errEmptyPool) {
+				return nil, err
+			}
+			sugar.Warnw("IP file contributed no IPs", "file", path, "error", err)
+			continue
+		}
+		ivs := entryIntervals(entries)
+		sugar.Infow("Loaded IP file", "file", path, "ips", countIPs(ivs), "new", set.add(ivs))
+		all = append(all, entries...)
+	}
+	if set.pool.empty() {
+		return nil, fmt.Errorf("no valid IPs found in %d file(s): %w", len(paths), errEmptyPool)
+	}
+	if len(paths) > 1 {
+		sugar.Infow("Merged IP files", "files", len(paths), "total_ips", set.pool.count())
+	}
+	return all, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseIPLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		ok     bool
+		iv     string
+		tag    string
+		proto  string
+		weight int
+		err    string
+	}{
+		// Bare addresses, the original one-IP-per-line format.
+		{line: "10.1.2.3", ok: true, iv: "10.1.2.3", tag: defaultTag, weight: 1},
+		{line: "2001:db8::1", ok: true, iv: "2001:db8::1", tag: defaultTag, weight: 1},
+		{line: "  10.1.2.3  ", ok: true, iv: "10.1.2.3", tag: defaultTag, weight: 1},
+
+		// CIDR blocks and ranges.
+		{line: "10.1.2.0/30", ok: true, iv: "10.1.2.0-10.1.2.3", tag: defaultTag, weight: 1},
+		{line: "10.1.2.3/32", ok: true, iv: "10.1.2.3", tag: defaultTag, weight: 1},
+		{line: "2001:db8::/126", ok: true, iv: "2001:db8::-2001:db8::3", tag: defaultTag, weight: 1},
+		{line: "10.1.2.10-10.1.2.20", ok: true, iv: "10.1.2.10-10.1.2.20", tag: defaultTag, weight: 1},
+
+		// Weights, as ",N" shorthand or weight=N.
+		{line: "10.1.2.3,5", ok: true, iv: "10.1.2.3", tag: defaultTag, weight: 5},
+		{line: "10.1.2.0/30,2", ok: true, iv: "10.1.2.0-10.1.2.3", tag: defaultTag, weight: 2},
+		{line: "10.1.2.3 weight=7", ok: true, iv: "10.1.2.3", tag: defaultTag, weight: 7},
+		{line: "10.1.2.3,2 weight=7", ok: true, iv: "10.1.2.3", tag: defaultTag, weight: 7},
+
+		// Tags and protocols.
+		{line: "10.1.2.3 web", ok: true, iv: "10.1.2.3", tag: "web", weight: 1},
+		{line: "10.1.2.3 tag=web proto=udp", ok: true, iv: "10.1.2.3", tag: "web", proto: "udp", weight: 1},
+		{line: "10.1.2.3,3 dns proto=tcp", ok: true, iv: "10.1.2.3", tag: "dns", proto: "tcp", weight: 3},
+
+		// Comments and blank lines.
+		{line: "", ok: false},
+		{line: "   ", ok: false},
+		{line: "# scored range", ok: false},
+		{line: "   # indented comment", ok: false},
+		{line: "10.1.2.3 tag=web # team web box", ok: true, iv: "10.1.2.3", tag: "web", weight: 1},
+		{line: "10.1.2.3#no space", ok: true, iv: "10.1.2.3", tag: defaultTag, weight: 1},
+
+		// Invalid lines.
+		{line: "10.1.2.256", err: "invalid IP address"},
+		{line: "not-an-ip", err: "invalid"},
+		{line: "10.1.2.0/33", err: "invalid"},
+		{line: "10.1.2.3,0", err: "invalid weight"},
+		{line: "10.1.2.3,x", err: "invalid weight"},
+		{line: "10.1.2.3 weight=-1", err: "invalid weight"},
+		{line: "10.1.2.3 tag=", err: "empty tag"},
+		{line: "10.1.2.3 proto=icmp", err: "invalid proto"},
+		{line: "10.1.2.3 color=red", err: "unknown key"},
+		{line: "10.1.2.3 web dns", err: "expected key=value"},
+	}
+	for _, tt := range tests {
+		entry, ok, err := parseIPLine(tt.line)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseIPLine(%q) error = %v, want one containing %q", tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseIPLine(%q) error = %v", tt.line, err)
+			continue
+		}
+		if ok != tt.ok {
+			t.Errorf("parseIPLine(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := entry.iv.String(); got != tt.iv {
+			t.Errorf("parseIPLine(%q) interval = %s, want %s", tt.line, got, tt.iv)
+		}
+		if entry.tag != tt.tag || entry.proto != tt.proto || entry.weight != tt.weight {
+			t.Errorf("parseIPLine(%q) = tag %q proto %q weight %d, want tag %q proto %q weight %d",
+				tt.line, entry.tag, entry.proto, entry.weight, tt.tag, tt.proto, tt.weight)
+		}
+	}
+}
+
+// writeIPFile writes content to a file in a temporary directory and
+// returns its path.
+func writeIPFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ips.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadIPsFromFileReportsInvalidLines(t *testing.T) {
+	logs := observeLogs(t)
+	path := writeIPFile(t, strings.Join([]string{
+		"# pool for the web team",
+		"10.1.2.3",
+		"10.1.2.999",
+		"",
+		"10.1.3.0/30 tag=web",
+		"10.1.4.1 color=red",
+		"10.1.4.2,3 proto=udp",
+	}, "\n"))
+
+	entries, err := loadIPsFromFile(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("loaded %d entries, want 3", len(entries))
+	}
+
+	invalid := logs.FilterMessage("Ignoring invalid line in IP file").All()
+	wantLines := []int64{3, 6}
+	if len(invalid) != len(wantLines) {
+		t.Fatalf("got %d invalid line warnings, want %d", len(invalid), len(wantLines))
+	}
+	for i, e := range invalid {
+		fields := e.ContextMap()
+		if fields["line_number"] != wantLines[i] {
+			t.Errorf("warning %d reports line %v, want %d", i, fields["line_number"], wantLines[i])
+		}
+		if fields["file"] != path {
+			t.Errorf("warning %d reports file %v, want %s", i, fields["file"], path)
+		}
+	}
+}
+
+func TestLoadIPsFromFileFilters(t *testing.T) {
+	path := writeIPFile(t, "10.1.2.1 tag=web\n10.1.2.2 tag=dns proto=udp\n10.1.2.3 proto=tcp\n")
+	tests := []struct {
+		tag, proto string
+		want       []string
+	}{
+		{"", "", []string{"10.1.2.1", "10.1.2.2", "10.1.2.3"}},
+		{"web", "", []string{"10.1.2.1"}},
+		{"", "udp", []string{"10.1.2.1", "10.1.2.2"}},
+		{"", "tcp", []string{"10.1.2.1", "10.1.2.3"}},
+	}
+	for _, tt := range tests {
+		entries, err := loadIPsFromFile(path, tt.tag, tt.proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.iv.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("tag %q proto %q: got %v, want %v", tt.tag, tt.proto, got, tt.want)
+		}
+	}
+}
+
+func TestLoadIPsFromFileLongLines(t *testing.T) {
+	logs := observeLogs(t)
+	// 100KB of junk without a newline, past bufio.Scanner's 64KB limit,
+	// followed by a normal line.
+	long := strings.Repeat("x", 100*1024)
+	path := writeIPFile(t, "10.1.2.1\n"+long+"\n10.1.2.2\n")
+
+	entries, err := loadIPsFromFile(path, "", "")
+	if err != nil {
+		t.Fatalf("loading a file with a 100KB line: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("loaded %d entries, want the 2 around the long line", len(entries))
+	}
+	invalid := logs.FilterMessage("Ignoring invalid line in IP file").All()
+	if len(invalid) != 1 {
+		t.Fatalf("got %d invalid line warnings, want 1", len(invalid))
+	}
+	fields := invalid[0].ContextMap()
+	if fields["line_number"] != int64(2) || fields["line_length"] != int64(len(long)) {
+		t.Errorf("warning reports line %v of length %v, want line 2 of length %d", fields["line_number"], fields["line_length"], len(long))
+	}
+	if line, _ := fields["line"].(string); len(line) > 100 {
+		t.Errorf("warning logs %d bytes of the line, want it truncated", len(line))
+	}
+}
+
+func TestLoadIPsFromFileLastLineWithoutNewline(t *testing.T) {
+	// A whole file that is one long line, as when addresses are separated
+	// by spaces instead of newlines, must load rather than fail.
+	var b strings.Builder
+	for i := range 20000 {
+		fmt.Fprintf(&b, "10.%d.%d.1 ", i/256, i%256)
+	}
+	path := writeIPFile(t, b.String())
+	if _, err := loadIPsFromFile(path, "", ""); err != nil && !errors.Is(err, errEmptyPool) {
+		t.Fatalf("loading a %dKB single-line file: %v", b.Len()/1024, err)
+	}
+	path = writeIPFile(t, "10.1.2.1\n10.1.2.2")
+	entries, err := loadIPsFromFile(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("loaded %d entries, want 2 including the unterminated last line", len(entries))
+	}
+}
+
+func TestUnusableFilePoolFailsStartup(t *testing.T) {
+	logs := observeLogs(t)
+	path := writeIPFile(t, "0.0.0.0\n0.0.0.0/32\nnot-an-ip\n10.1.2.999\n")
+	prev := currentPool()
+	t.Cleanup(func() { activePool.Store(prev) })
+	activePool.Store(nil)
+
+	// The same steps main takes before it starts serving.
+	ips, err := buildPool(poolSources{files: []string{path}}, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("buildPool: %v", err)
+	}
+	err = setPool(ips)
+	if !errors.Is(err, errEmptyPool) {
+		t.Fatalf("setPool = %v, want errEmptyPool", err)
+	}
+	for _, want := range []string{"no usable unicast address", "unspecified"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("setPool error %q does not mention %q", err, want)
+		}
+	}
+	if got := logs.FilterMessage("Ignoring invalid line in IP file").Len(); got != 2 {
+		t.Errorf("got %d invalid line warnings, want 2", got)
+	}
+	if !currentPool().empty() {
+		t.Error("an unusable pool was installed")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// ipv6Freebind is IPV6_FREEBIND from linux/in6.h, which the syscall
+// package does not define.
+const ipv6Freebind = 0x4e
+
+// Address families as named by ipFamily.
+const (
+	familyIPv4 = "IPv4"
+	familyIPv6 = "IPv6"
+)
+
+// destFamily returns the address family a dial to addr on network will
+// use, or "" when it is not known before resolution.
+func destFamily(network, addr string) string {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return familyIPv4
+	case strings.HasSuffix(network, "6"):
+		return familyIPv6
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ipFamily(ip)
+	}
+	return ""
+}
+
+var (
+	familyMu    sync.Mutex
+	familyViews = make(map[*ipPool]map[string]*ipPool)
+)
+
+// familyPool returns the members of p in family, or p itself for an empty
+// family. Views are cached per pool, keyed like coverage, and a
+// single-family pool is its own view so selection and coverage on
+// IPv4-only pools are unaffected.
+func familyPool(p *ipPool, family string) *ipPool {
+	if family == "" || p.empty() {
+		return p
+	}
+	familyMu.Lock()
+	defer familyMu.Unlock()
+	views, ok := familyViews[p]
+	if !ok {
+		views = make(map[string]*ipPool)
+		familyViews[p] = views
+	}
+	view, ok := views[family]
+	if !ok {
+		view = p.family(family)
+		views[family] = view
+	}
+	return view
+}
+
+// resetFamilyViews drops cached views, e.g. after the pool is replaced.
+func resetFamilyViews() {
+	familyMu.Lock()
+	clear(familyViews)
+	familyMu.Unlock()
+}
+
+// hasFamily reports whether p contains an address of family.
+func hasFamily(p *ipPool, family string) bool {
+	return !familyPool(p, family).empty()
+}
+
+// normalizeIP returns ip in its 4-byte form when it is IPv4, so pool
+// entries and hints compare and print consistently.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// extraListeners are the -listener listeners besides the main one.
+var extraListeners []*listenerPool
+
+// listenerPool is the source pool and selection mode of an extra -listener.
+type listenerPool struct {
+	addr string
+	pool *ipPool
+	mode string
+}
+
+// parseListener parses a -listener value, ADDR=POOL[@MODE]. POOL is an IP,
+// CIDR, start-end range, or a file of those, as for -exclude, and MODE a
+// -selection value (default random).
+func parseListener(spec string) (*listenerPool, error) {
+	addr, rest, ok := strings.Cut(spec, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid -listener %q (want ADDR=POOL[@SELECTION], e.g. :1081=10.2.0.0/16@coverage)", spec)
+	}
+	if !strings.HasPrefix(addr, unixPrefix) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid -listener address %q: %w", addr, err)
+		}
+	}
+	poolSpec, mode, hasMode := strings.Cut(rest, "@")
+	if !hasMode {
+		mode = selectRandom
+	}
+	switch mode {
+	case selectRandom, selectCoverage, selectRoundRobin, selectSequential, selectHash:
+	default:
+		return nil, fmt.Errorf("invalid -listener selection %q (want random, coverage, roundrobin, sequential, or hash)", mode)
+	}
+	ivs, err := parseExclusions([]string{poolSpec})
+	if err != nil {
+		return nil, fmt.Errorf("invalid -listener pool: %w", err)
+	}
+	pool, dropped := dropUnusable(newIPPool(ivs))
+	if dropped != "" {
+		sugar.Warnw("Dropped unusable IPs from listener pool", "listen_addr", addr, "dropped", dropped)
+	}
+	if pool.empty() {
+		return nil, fmt.Errorf("-listener %s: %w", addr, errEmptyPool)
+	}
+	return &listenerPool{addr: addr, pool: pool, mode: mode}, nil
+}
+
+// withListenerPool records the pool of the listener a client connected to.
+func withListenerPool(ctx context.Context, lp *listenerPool) context.Context {
+	return context.WithValue(ctx, ctxListenerPool, lp)
+}
+
+func listenerPoolFrom(ctx context.Context) *listenerPool {
+	lp, _ := ctx.Value(ctxListenerPool).(*listenerPool)
+	return lp
+}
+
+// listenerSelector selects from the listener's own pool and mode for
+// clients of an extra -listener, and defers to next for everyone else.
+// Affinity options and -pin-file apply to the main listener only.
+type listenerSelector struct {
+	next SourceSelector
+}
+
+func (l listenerSelector) Select(ctx context.Context, network, destAddr string) (net.IP, error) {
+	lp := listenerPoolFrom(ctx)
+	if lp == nil {
+		return l.next.Select(ctx, network, destAddr)
+	}
+	if lp.mode == selectHash {
+		host, _, err := net.SplitHostPort(destAddr)
+		if err != nil {
+			host = destAddr
+		}
+		if ip := pickHashed(familyPool(lp.pool, destFamily(network, destAddr)), host); ip != nil {
+			return cloneIP(ip), nil
+		}
+		return poolSelectFrom(lp.pool, network, destAddr, selectRandom)
+	}
+	return poolSelectFrom(lp.pool, network, destAddr, lp.mode)
+}
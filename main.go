@@ -3,185 +3,712 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/armon/go-socks5"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-var ipList []net.IP
-var localRand *rand.Rand
+// activePool holds the primary source pool. Pools are immutable, so a
+// refresh swaps in a new one atomically while dials keep using the pool
+// they loaded.
+var activePool atomic.Pointer[ipPool]
+
+// currentPool returns the active primary pool.
+func currentPool() *ipPool {
+	return activePool.Load()
+}
+
+// udpList is the source pool for UDP. When it is empty, UDP draws from
+// the primary pool like TCP does.
+var udpList *ipPool
+
+// fallbackList is drawn from only when no primary IP is healthy.
+var fallbackList *ipPool
+
+// localRand drives source IP selection. It is shared by concurrent dials,
+// so every implementation must be safe for concurrent use.
+var localRand intSource
 var sugar *zap.SugaredLogger
 
-func ipToUint32(ip net.IP) uint32 {
-	return binary.BigEndian.Uint32(ip.To4())
+// logLevel gates every zap message, including the SOCKS server's handshake
+// failures which are logged at info level.
+var logLevel = zap.NewAtomicLevelAt(zap.InfoLevel)
+
+// connLevel additionally gates messages logged per connection or per dial,
+// so -quiet can raise it without hiding reloads, recoveries or shutdown
+// progress.
+var connLevel = zap.NewAtomicLevelAt(zap.DebugLevel)
+
+// connCore is a core that also drops entries below connLevel.
+type connCore struct {
+	zapcore.Core
+}
+
+func (c connCore) Enabled(l zapcore.Level) bool {
+	return connLevel.Enabled(l) && c.Core.Enabled(l)
 }
 
-func uint32ToIP(n uint32) net.IP {
-	ip := make(net.IP, 4)
-	binary.BigEndian.PutUint32(ip, n)
-	return ip
+func (c connCore) With(fields []zapcore.Field) zapcore.Core {
+	return connCore{c.Core.With(fields)}
+}
+
+func (c connCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !connLevel.Enabled(e.Level) {
+		return ce
+	}
+	return c.Core.Check(e, ce)
 }
 
-func randomIP() net.IP {
-	if len(ipList) == 0 {
-		sugar.Errorw("randomIP called with empty ipList")
-		return net.IPv4zero
+// connLogger returns sugar gated by connLevel, for per-connection messages
+// that carry no client tag.
+func connLogger() *zap.SugaredLogger {
+	return sugar.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return connCore{c}
+	}))
+}
+
+// Behaviors for -on-empty-pool.
+const (
+	emptyPoolFatal    = "fatal"
+	emptyPoolKeepLast = "keep-last"
+	emptyPoolReject   = "reject"
+)
+
+var onEmptyPool = emptyPoolFatal
+
+// pinnedIP, when set via -force-ip, is used as the source for every dial
+// instead of a random pool IP.
+var pinnedIP net.IP
+
+// fwmark, when non-zero, is set as SO_MARK on every upstream socket so
+// policy routing can steer spoofed traffic.
+var fwmark int
+
+// dialTimeout bounds each upstream connection attempt.
+const dialTimeout = 10 * time.Second
+
+// dscp, when non-negative, marks upstream sockets with this DSCP value.
+// Accepted client connections keep their default ToS.
+var dscp = -1
+
+// Dial retry settings. Each retry picks a new source IP.
+var (
+	dialRetries     = 0
+	retryBackoff    = 100 * time.Millisecond
+	retryBackoffMax = 2 * time.Second
+)
+
+// forceNetwork, when set, replaces the network of TCP dials (tcp, tcp4 or
+// tcp6), e.g. to keep hostnames with both A and AAAA records on IPv4 to
+// match the spoof pool. Empty passes the network through.
+var forceNetwork string
+
+// dialTime covers everything customDialer does before returning a
+// connection: selection, failed attempts and backoff, not just the final
+// connect.
+var dialTime = newHistogram("scoreproxy_dial_seconds", "Time from entering the dialer until a connection is established, including retries and backoff.", latencyBuckets)
+
+// errEmptyPool is returned when a pool source produced no usable IPs.
+var errEmptyPool = errors.New("IP pool is empty")
+
+// backoffDelay returns the wait before the given retry attempt (1-based):
+// exponential in the attempt number, capped at retryBackoffMax, with jitter
+// drawn from the upper half of the interval.
+func backoffDelay(attempt int) time.Duration {
+	d := retryBackoff
+	for i := 1; i < attempt && d < retryBackoffMax; i++ {
+		d *= 2
+	}
+	if d > retryBackoffMax {
+		d = retryBackoffMax
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// freebindOption returns the option controlSocket sets so a socket of
+// network can bind a source IP the host does not own. ok is false when
+// there is none and binds rely on the nonlocal bind sysctl.
+func freebindOption(network string) (level, opt int, name string, ok bool) {
+	if strings.HasSuffix(network, "6") {
+		return syscall.IPPROTO_IPV6, ipv6Freebind, "IPV6_FREEBIND", !ipv6FreebindMissing
+	}
+	return syscall.IPPROTO_IP, syscall.IP_FREEBIND, "IP_FREEBIND", true
+}
+
+// freebindOptions names the freebind options upstream sockets get, for the
+// effective configuration. TCP dials through -userspace open no kernel
+// socket, but UDP and DNS still do.
+func freebindOptions() []string {
+	names := []string{}
+	for _, network := range []string{"tcp4", "tcp6"} {
+		if _, _, name, ok := freebindOption(network); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// controlSocket sets socket options on each upstream socket before it is
+// bound and connected.
+func controlSocket(network, address string, c syscall.RawConn) error {
+	var opErr error
+	var opName string
+	err := c.Control(func(fd uintptr) {
+		if level, opt, name, ok := freebindOption(network); ok {
+			opName = name
+			opErr = syscall.SetsockoptInt(int(fd), level, opt, 1)
+			if opErr != nil {
+				return
+			}
+		}
+		if fwmark > 0 {
+			opName = "SO_MARK"
+			opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, fwmark)
+			if opErr != nil {
+				return
+			}
+		}
+		if dscp >= 0 {
+			// DSCP occupies the upper six bits of the ToS / traffic class byte.
+			if strings.HasSuffix(network, "6") {
+				opName = "IPV6_TCLASS"
+				opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+			} else {
+				opName = "IP_TOS"
+				opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+			}
+		}
+	})
+	if err != nil {
+		// Error from c.Control itself
+		sugar.Errorw("Dialer Control error", "network", network, "address", address, "error", err)
+		return fmt.Errorf("rawconn control error: %w", err)
+	}
+	if opErr != nil {
+		// Error from syscall.SetsockoptInt
+		sugar.Errorw("Setsockopt failed", "option", opName, "network", network, "address", address, "error", opErr)
+		return fmt.Errorf("setsockoptint %s: %w", opName, opErr)
 	}
-	return ipList[localRand.Intn(len(ipList))]
+	return nil
 }
 
+// customDialer is the SOCKS server's Dial hook. A source IP is picked per dial
+// (per retry attempt) and never changes for the resulting connection; see
+// sourceConn.
 func customDialer(ctx context.Context, network, addr string) (net.Conn, error) {
-	localIP := randomIP()
-	if localIP == nil || localIP.IsUnspecified() {
-		err := fmt.Errorf("failed to get a valid random IP for dialing")
-		sugar.Errorw("CustomDialer: No valid local IP", "error", err)
+	entered := time.Now()
+	if forceNetwork != "" && strings.HasPrefix(network, "tcp") {
+		network = forceNetwork
+	}
+	trace := newDialTrace(ctx, network, addr)
+	ctx = withDialTrace(ctx, trace)
+	conn, err := dialWithRetries(ctx, network, addr, entered)
+	trace.finish(err)
+	return conn, err
+}
+
+// dialWithRetries runs up to dialRetries+1 dial attempts, each from a
+// source IP the earlier attempts did not use, with backoff between them.
+func dialWithRetries(ctx context.Context, network, addr string, entered time.Time) (net.Conn, error) {
+	var lastErr error
+	var tried []net.IP
+	for attempt := 0; attempt <= dialRetries; attempt++ {
+		if attempt > 0 {
+			wait := backoffDelay(attempt)
+			connLog(ctx).Debugw("Backing off before dial retry",
+				"remote_addr", addr,
+				"attempt", attempt,
+				"backoff", wait,
+			)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("custom dialer: %w", ctx.Err())
+			}
+		}
+		conn, err := dialFromRandomIP(ctx, network, addr, entered, attempt, &tried)
+		if err == nil {
+			dialTime.Observe(time.Since(entered).Seconds())
+			return conn, nil
+		}
+		if errors.Is(err, errEmptyPool) {
+			// Retrying cannot help until the pool is refilled.
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dialFromRandomIP makes one dial attempt from a freshly picked source IP,
+// avoiding the IPs in tried and adding its own. entered is when
+// customDialer was called and attempt is this attempt's index; both are
+// only used for logging.
+func dialFromRandomIP(ctx context.Context, network, addr string, entered time.Time, attempt int, tried *[]net.IP) (net.Conn, error) {
+	log := connLog(ctx)
+	trace := dialTraceFrom(ctx)
+	hinted := sourceHint(ctx) != nil
+	localIP, err := selectUntried(ctx, network, addr, *tried)
+	trace.attempt(localIP, hinted)
+	if localIP != nil {
+		*tried = append(*tried, localIP)
+	}
+	if err != nil || localIP == nil || localIP.IsUnspecified() {
+		// Never fall back to dialing from 0.0.0.0; the SOCKS client gets a failure reply instead.
+		if err == nil {
+			err = errNoAvailableIP
+		}
+		err = fmt.Errorf("failed to get a valid source IP for dialing: %w", err)
+		log.Errorw("CustomDialer: No valid local IP", "error", err)
+		trace.attemptFailed(err)
+		return nil, err
+	}
+	if (strings.HasSuffix(network, "4") && localIP.To4() == nil) || (strings.HasSuffix(network, "6") && localIP.To4() != nil) {
+		err := fmt.Errorf("cannot dial %s from source IP %s of the other address family", network, localIP)
+		log.Errorw("CustomDialer: Source IP family does not match network", "error", err)
+		trace.attemptFailed(err)
 		return nil, err
 	}
 	localAddr := &net.TCPAddr{
 		IP: localIP,
 	}
 
-	sugar.Debugw("Dialing with custom local IP",
-		"network", network,
-		"remote_addr", addr,
-		"local_ip", localIP.String(),
-	)
+	if logLevel.Enabled(zap.DebugLevel) {
+		log.Debugw("Dialing with custom local IP",
+			"network", network,
+			"remote_addr", addr,
+			"local_ip", localIP.String(),
+		)
+	}
 
 	dialer := &net.Dialer{
 		LocalAddr: localAddr,
-		Timeout:   10 * time.Second,
-		Control: func(network, address string, c syscall.RawConn) error {
-			var opErr error
-			err := c.Control(func(fd uintptr) {
-				opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
-			})
-			if err != nil {
-				// Error from c.Control itself
-				sugar.Errorw("Dialer Control error", "network", network, "address", address, "error", err)
-				return fmt.Errorf("rawconn control error: %w", err)
-			}
-			if opErr != nil {
-				// Error from syscall.SetsockoptInt
-				sugar.Errorw("SetsockoptInt IP_FREEBIND failed", "fd", uintptr(0), "error", opErr) // fd is not accessible here, log as 0 or remove
-				return fmt.Errorf("setsockoptint IP_FREEBIND: %w", opErr)
-			}
-			return nil
-		},
+		Timeout:   dialTimeout,
+		Control:   controlSocket,
+	}
+	dialAddr := addr
+	if upstreamProxy != nil {
+		dialAddr = upstreamProxy.Host
+	}
+	dialStart := time.Now()
+	var conn net.Conn
+	if userspaceNet != nil {
+		conn, err = userspaceNet.dial(ctx, localIP, dialAddr)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, dialAddr)
+	}
+	if err != nil && freebindFallback && errors.Is(err, syscall.EADDRNOTAVAIL) {
+		conn, err = dialUnspoofed(ctx, network, dialAddr, localIP, err)
+		if err == nil {
+			localIP = conn.LocalAddr().(*net.TCPAddr).IP
+		}
 	}
-	conn, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
-		sugar.Errorw("Custom dial failed",
+		log.Errorw("Custom dial failed",
 			"network", network,
 			"remote_addr", addr,
 			"local_ip", localIP.String(),
 			"error", err,
 		)
+		if ctx.Err() == nil {
+			markSourceFailed(localIP)
+			recordDial(localIP, true)
+			recordCircuit(localIP, true)
+		}
+		recentConns.add(connRecord{
+			SourceIP:  localIP.String(),
+			Dest:      addr,
+			Start:     dialStart,
+			Reason:    err.Error(),
+			ClientTag: clientTag(ctx),
+		})
+		trace.attemptFailed(err)
 		return nil, fmt.Errorf("custom dialer: %w", err)
 	}
-	sugar.Infow("Successfully established connection",
+	recordDial(localIP, false)
+	recordCircuit(localIP, false)
+	if userspaceNet == nil {
+		setNoDelay(conn, "upstream")
+	}
+	if upstreamProxy != nil {
+		if err := upstreamConnect(conn, addr); err != nil {
+			conn.Close()
+			log.Errorw("Upstream proxy connect failed", "remote_addr", addr, "local_ip", localIP.String(), "error", err)
+			trace.attemptFailed(err)
+			return nil, fmt.Errorf("custom dialer: %w", err)
+		}
+	}
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok && len(sendProxyRules) > 0 && wantsProxyHeader(remote) {
+		if err := writeProxyHeader(conn, conn.LocalAddr().(*net.TCPAddr), remote); err != nil {
+			conn.Close()
+			log.Errorw("Failed to send PROXY protocol header", "remote_addr", addr, "local_ip", localIP.String(), "error", err)
+			trace.attemptFailed(err)
+			return nil, fmt.Errorf("custom dialer: failed to send PROXY header: %w", err)
+		}
+	}
+	sc, err := newSourceConn(conn, localIP, addr, clientTag(ctx))
+	if err != nil {
+		conn.Close()
+		log.Errorw("Source IP invariant violated", "local_ip", localIP.String(), "error", err)
+		trace.attemptFailed(err)
+		return nil, fmt.Errorf("custom dialer: %w", err)
+	}
+	log.Infow("Successfully established connection",
 		"network", network,
 		"remote_addr", addr,
 		"local_addr", conn.LocalAddr().String(),
 		"remote_conn_addr", conn.RemoteAddr().String(),
+		"source_ip_scope", "per-dial",
+		"attempt", attempt,
+		"dial_wait", time.Since(entered),
 	)
-	return conn, nil
+	return sc, nil
 }
 
-func validateIPRange(startStr, endStr string) ([]net.IP, error) {
-	startIP := net.ParseIP(startStr).To4()
-	endIP := net.ParseIP(endStr).To4()
-	if startIP == nil || endIP == nil {
-		err := fmt.Errorf("invalid IPv4 addresses: start=%s, end=%s", startStr, endStr)
-		// No sugar.Errorw here, as this error is returned and handled by the caller
-		return nil, err
+// freebindFallback lets a dial whose spoofed bind fails with EADDRNOTAVAIL
+// go out from an OS-chosen source address instead of failing.
+var freebindFallback bool
+
+var freebindFallbacks = newCounter("scoreproxy_freebind_fallbacks_total", "Dials that bypassed spoofing because binding the source IP failed.")
+
+// dialUnspoofed retries a dial without a local bind after binding spoofIP
+// failed with bindErr. Some container runtimes accept IP_FREEBIND but still
+// refuse the bind at connect time.
+func dialUnspoofed(ctx context.Context, network, addr string, spoofIP net.IP, bindErr error) (net.Conn, error) {
+	freebindFallbacks.Inc()
+	connLog(ctx).Warnw("SPOOFING BYPASSED: binding the source IP failed, dialing from the host's own address",
+		"network", network,
+		"remote_addr", addr,
+		"spoof_ip", spoofIP.String(),
+		"bind_error", bindErr,
+	)
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+		Control: controlSocket,
 	}
+	return dialer.DialContext(ctx, network, addr)
+}
 
-	startVal := ipToUint32(startIP)
-	endVal := ipToUint32(endIP)
-	if startVal > endVal {
-		err := fmt.Errorf("start IP (%s) must be <= end IP (%s)", startStr, endStr)
-		return nil, err
+// parseIPRange parses the bounds of an IPv4 or IPv6 range into an
+// interval. Both bounds must be the same family, in order.
+func parseIPRange(startStr, endStr string) (ipInterval, error) {
+	startIP := net.ParseIP(startStr)
+	if startIP == nil {
+		return ipInterval{}, fmt.Errorf("invalid start IP address %q", startStr)
 	}
+	endIP := net.ParseIP(endStr)
+	if endIP == nil {
+		return ipInterval{}, fmt.Errorf("invalid end IP address %q", endStr)
+	}
+	startFamily, endFamily := ipFamily(startIP), ipFamily(endIP)
+	if startFamily != endFamily {
+		return ipInterval{}, fmt.Errorf("start is %s but end is %s: %s - %s", startFamily, endFamily, startStr, endStr)
+	}
+	start, end := addrKey(startIP), addrKey(endIP)
+	if end.Less(start) {
+		return ipInterval{}, fmt.Errorf("start IP (%s) must be <= end IP (%s)", startStr, endStr)
+	}
+	return intervalOf(start, end), nil
+}
 
-	var ips []net.IP
-	// Pre-allocate slice capacity if the range isn't excessively large
-	// This is a minor optimization, be cautious with huge ranges.
-	// If endVal - startVal + 1 overflows or is too big, this could be an issue.
-	// For typical CCDC ranges, it should be fine.
-	estimatedSize := endVal - startVal + 1
-	if estimatedSize > 0 && estimatedSize < 10000000 { // Cap preallocation
-		ips = make([]net.IP, 0, estimatedSize)
+// ipFamily names the address family of ip. IPv4-mapped IPv6 addresses
+// count as IPv4.
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return familyIPv4
 	}
+	return familyIPv6
+}
 
-	for i := startVal; i <= endVal; i++ {
-		// Check for potential overflow if startVal is very small and endVal is very large
-		// such that i could wrap around. For IPv4 uint32, this check is relevant if i could become < startVal.
-		// However, the loop condition i <= endVal should prevent issues unless endVal is near max uint32.
-		ips = append(ips, uint32ToIP(i))
-		if i == 0xffffffff && i < endVal { // Max uint32, but loop wants to continue
-			break // Avoid overflow in i++
+// cidrBounds returns the first and last addresses of an IPv4 or IPv6 CIDR
+// block, 4 bytes long for IPv4.
+func cidrBounds(cidr string) (net.IP, net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CIDR '%s': %w", cidr, err)
+	}
+	first := normalizeIP(ipNet.IP)
+	mask := ipNet.Mask[len(ipNet.Mask)-len(first):]
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^mask[i]
+	}
+	return first, last, nil
+}
+
+// cidrInterval returns the addresses of a CIDR block as an interval.
+func cidrInterval(cidr string) (ipInterval, error) {
+	first, last, err := cidrBounds(cidr)
+	if err != nil {
+		return ipInterval{}, err
+	}
+	return intervalOf(addrKey(first), addrKey(last)), nil
+}
+
+// loadProgressLines is how often loadIPsFromFile logs progress.
+const loadProgressLines = 1000000
+
+// percentOf returns n as a percentage of total, or 0 if total is unknown.
+func percentOf(n, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// truncate shortens s to at most n bytes for logging.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// ipSourceTimeout bounds fetching an IP list from a URL.
+const ipSourceTimeout = 30 * time.Second
+
+// isURL reports whether an IP file path is an HTTP(S) URL.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// openIPSource opens a local IP file or fetches one from an HTTP(S) URL,
+// returning its size when known (0 otherwise) for progress logging.
+func openIPSource(path string) (io.ReadCloser, int64, error) {
+	if !isURL(path) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		var size int64
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
 		}
+		return file, size, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ipSourceTimeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		cancel()
+		return nil, 0, err
 	}
-	if len(ips) == 0 {
-		// This case should be covered by startIP <= endIP,
-		// but as a safeguard if logic changes.
-		return nil, fmt.Errorf("no IPs generated for range %s - %s", startStr, endStr)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, 0, fmt.Errorf("unexpected HTTP status %s", resp.Status)
 	}
-	return ips, nil
+	return cancelOnClose{resp.Body, cancel}, max(resp.ContentLength, 0), nil
+}
+
+// cancelOnClose releases a request's context when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
 }
 
-func loadIPsFromFile(filePath string) ([]net.IP, error) {
-	file, err := os.Open(filePath)
+// defaultTag is the bucket for IPs listed without a tag.
+const defaultTag = "default"
+
+// loadIPsFromFile reads an IP file in the grammar described in ipfile.go
+// and returns its entries as intervals.
+// If tag is non-empty only IPs in that bucket are returned; untagged IPs
+// belong to defaultTag. If proto is non-empty, entries restricted to the
+// other protocol are skipped.
+func loadIPsFromFile(filePath, tag, proto string) ([]ipEntry, error) {
+	file, size, err := openIPSource(filePath)
 	if err != nil {
 		// Wrap error for context
 		return nil, fmt.Errorf("failed to open IP file '%s': %w", filePath, err)
 	}
 	defer file.Close()
 
-	var ips []net.IP
-	scanner := bufio.NewScanner(file)
+	var entries []ipEntry
+	// bufio.Reader rather than bufio.Scanner: Scanner fails with "token too
+	// long" on lines over 64KB, e.g. when a file isn't newline-delimited.
+	reader := bufio.NewReaderSize(file, 64*1024)
 	lineNumber := 0
-	for scanner.Scan() {
-		lineNumber++
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") { // Skip empty lines and comments
+	var bytesRead int64
+	for done := false; !done; {
+		raw, readErr := reader.ReadString('\n')
+		if readErr == io.EOF {
+			done = true
+		} else if readErr != nil {
+			// Wrap error for context
+			return nil, fmt.Errorf("error reading IP file '%s': %w", filePath, readErr)
+		}
+		if raw == "" {
 			continue
 		}
-		if ip := net.ParseIP(line).To4(); ip != nil {
-			ips = append(ips, ip)
-		} else {
-			sugar.Warnw("Ignoring invalid IP address in file",
+		lineNumber++
+		bytesRead += int64(len(raw))
+		if lineNumber%loadProgressLines == 0 {
+			sugar.Infow("Loading IP file",
+				"file", filePath,
+				"lines", lineNumber,
+				"entries", len(entries),
+				"percent", percentOf(bytesRead, size),
+			)
+		}
+
+		line := strings.TrimSpace(raw)
+		entry, ok, err := parseIPLine(line)
+		if err != nil {
+			sugar.Warnw("Ignoring invalid line in IP file",
 				"file", filePath,
 				"line_number", lineNumber,
-				"ip_string", line,
+				"line_length", len(line),
+				"line", truncate(line, 64),
+				"error", err,
 			)
+			continue
+		}
+		if ok && entry.matches(tag, proto) {
+			entries = append(entries, entry)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		// Wrap error for context
-		return nil, fmt.Errorf("error scanning IP file '%s': %w", filePath, err)
+
+	if len(entries) == 0 {
+		if tag != "" {
+			return nil, fmt.Errorf("no valid IPs tagged '%s' found in file '%s': %w", tag, filePath, errEmptyPool)
+		}
+		return nil, fmt.Errorf("no valid IPs found in file '%s': %w", filePath, errEmptyPool)
+	}
+	return entries, nil
+}
+
+// poolContains reports whether ip is in the active pool.
+func poolContains(ip net.IP) bool {
+	return currentPool().contains(ip)
+}
+
+// anyPoolContains reports whether ip is in the active pool or an extra
+// listener's pool.
+func anyPoolContains(ip net.IP) bool {
+	if poolContains(ip) {
+		return true
+	}
+	for _, lp := range extraListeners {
+		if lp.pool.contains(ip) {
+			return true
+		}
 	}
+	return false
+}
 
-	if len(ips) == 0 {
-		return nil, fmt.Errorf("no valid IPs found in file '%s'", filePath)
+// setPool installs ips as the active pool, applying the -on-empty-pool
+// policy when ips is empty.
+func setPool(ips *ipPool) error {
+	ips, dropped := dropUnusable(ips)
+	if !ips.empty() {
+		if dropped != "" {
+			sugar.Warnw("Dropped unusable IPs from the pool", "dropped", dropped, "pool_size", ips.count())
+		}
+		activePool.Store(ips)
+		resetCoverage()
+		resetFamilyViews()
+		if dadProber != nil {
+			go dadProber.probePools()
+		}
+		return nil
+	}
+	if dropped != "" {
+		sugar.Warnw("IP pool has no usable unicast address", "dropped", dropped)
+	}
+	switch onEmptyPool {
+	case emptyPoolKeepLast:
+		if currentPool().empty() {
+			return fmt.Errorf("%w and there is no previous pool to keep", errEmptyPool)
+		}
+		sugar.Warnw("New IP pool is empty, keeping previous pool", "pool_size", currentPool().count())
+		return nil
+	case emptyPoolReject:
+		sugar.Warnw("IP pool is empty, new connections will be rejected")
+		activePool.Store(nil)
+		return nil
+	default:
+		if dropped != "" {
+			return fmt.Errorf("%w: no usable unicast address (dropped %s)", errEmptyPool, dropped)
+		}
+		return errEmptyPool
 	}
-	return ips, nil
+}
+
+// watchSIGHUP calls reload each time the process receives SIGHUP.
+func watchSIGHUP(reload func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			sugar.Infow("Received SIGHUP, reloading")
+			reload()
+		}
+	}()
+}
+
+// teardowns undo host changes that would outlive the process, such as
+// installed routes and the WireGuard device. They run once, on return from
+// main or before a fatal exit through fatalf.
+var (
+	teardowns    []func()
+	teardownOnce sync.Once
+)
+
+func runTeardowns() {
+	teardownOnce.Do(func() {
+		for i := len(teardowns) - 1; i >= 0; i-- {
+			teardowns[i]()
+		}
+	})
+}
+
+// fatalf is sugar.Fatalf for exits after teardowns are registered, which
+// os.Exit would otherwise skip along with every deferred call.
+func fatalf(template string, args ...any) {
+	runTeardowns()
+	sugar.WithOptions(zap.AddCallerSkip(1)).Fatalf(template, args...)
 }
 
 func main() {
 	// Initialize Zap logger
 	// Using NewDevelopment for more verbose output during development.
 	// Replace with zap.NewProductionConfig().Build() for production.
-	logger, err := zap.NewProduction() // Or zap.NewProduction()
+	zapConfig := zap.NewProductionConfig()
+	zapConfig.Level = logLevel
+	logger, err := zapConfig.Build()
 	if err != nil {
 		// Fallback to standard log if zap fails to initialize
 		// log.Fatalf("Failed to initialize zap logger: %v", err)
@@ -190,57 +717,750 @@ func main() {
 	}
 	defer logger.Sync() // Flushes buffer, if any
 	sugar = logger.Sugar()
+	command := parseCommand()
 
-	startFlag := flag.String("start", "", "Start IP of the range (e.g., 10.1.0.0)")
+	configFlag := flag.String("config", "", "YAML or TOML file of flag-name: value settings; command-line flags override it")
+	startFlag := flag.String("start", "", "Start IP of the range (e.g., 10.1.0.0), or a CIDR block (e.g., 10.1.0.0/16) without -end")
 	endFlag := flag.String("end", "", "End IP of the range (e.g., 10.100.255.255)")
-	fileFlag := flag.String("file", "", "File containing a list of IP addresses (one per line)")
-	portFlag := flag.Int("port", 1080, "Port on which the SOCKS5 proxy will listen")
+	var cidrs stringList
+	flag.Var(&cidrs, "cidr", "CIDR block to add to the pool (e.g. 10.1.0.0/16); repeat or comma-separate for several")
+	var ranges stringList
+	flag.Var(&ranges, "range", "IP range to add to the pool as start-end (e.g. 10.1.0.1-10.1.0.254); repeat or comma-separate for several")
+	var excludes stringList
+	flag.Var(&excludes, "exclude", "IP, CIDR, start-end range, or file of those to remove from the pool; repeat or comma-separate for several")
+	var ipFiles stringList
+	flag.Var(&ipFiles, "file", "File or http(s) URL listing IPs, CIDR blocks, or start-end ranges, one per line; repeat or comma-separate to merge several")
+	watchFlag := flag.Bool("watch", true, "Reload the pool when a local -file changes")
+	refreshFlag := flag.Duration("refresh", 0, "Rebuild the pool this often, re-reading -file paths and URLs (e.g. 5m); 0 disables")
+	portFlag := flag.Int("port", 1080, "Port on which the SOCKS5 proxy will listen on all interfaces, IPv4 and IPv6 (ignored with -listen)")
+	var listenerSpecs stringList
+	flag.Var(&listenerSpecs, "listener", "Extra SOCKS5 listener with its own pool, as ADDR=POOL[@SELECTION] (e.g. :1081=10.2.0.0/16@coverage); POOL is an IP, CIDR, start-end range, or file of those; repeatable")
+	var listenFlag stringList
+	flag.Var(&listenFlag, "listen", "host:port or unix:PATH for the SOCKS5 proxy to listen on (e.g. 127.0.0.1:1080, [::]:1080, or unix:/run/scoreproxy.sock); repeat or comma-separate to listen on several; overrides -port")
+	flag.DurationVar(&bindWait, "bind-wait", 2*time.Minute, "How long a SOCKS BIND waits for the incoming connection")
+	var proxyProtocolFromFlag stringList
+	flag.Var(&proxyProtocolFromFlag, "proxy-protocol-from", "Load balancer IPs or CIDRs whose connections start with a PROXY protocol v1/v2 header naming the real client; comma-separate or repeat")
+	upstreamFlag := flag.String("upstream", "", "Chain outbound connections through this proxy, as socks5://[user:pass@]host:port or http://[user:pass@]host:port; the connection to it comes from the pool IP")
+	var sendProxyFlag stringList
+	flag.Var(&sendProxyFlag, "send-proxy", "Destinations (IP or CIDR, optionally :PORT) that get a PROXY protocol header naming the spoofed source IP; comma-separate or repeat")
+	flag.IntVar(&sendProxyVersion, "send-proxy-version", 1, "PROXY protocol version sent to -send-proxy destinations: 1 or 2")
+	sshListenFlag := flag.String("ssh-listen", "", "Also serve SSH port forwarding (ssh -D or -L) on this host:port or unix:PATH, dialing forwarded connections from the pool")
+	sshHostKeyFlag := flag.String("ssh-host-key", "", "Private key file the -ssh-listen server identifies itself with (reloaded on SIGHUP)")
+	sshAuthorizedKeysFlag := flag.String("ssh-authorized-keys", "", "authorized_keys file of the public keys -ssh-listen accepts (reloaded on SIGHUP)")
+	canaryFlag := flag.String("canary", "", "Destination (HOST or HOST:PORT) the startup preflight checks is routable from the pool")
+	strictFlag := flag.Bool("strict", false, "Refuse to start if the startup preflight reports any warning")
+	installRoutesFlag := flag.Bool("install-routes", false, "Add AnyIP local routes for the pool's ranges on startup and remove them on shutdown, instead of the manual 'ip route add local ... dev lo' (needs CAP_NET_ADMIN)")
+	arpResponderFlag := flag.String("arp-responder", "", "Answer ARP and NDP for pool IPs on this interface with its MAC, so the segment delivers their return traffic without static neighbor entries (needs CAP_NET_RAW)")
+	dadFlag := flag.String("dad", "", "ARP-probe each IPv4 pool IP on this interface before its first use and skip addresses another host answers for")
+	dadTimeoutFlag := flag.Duration("dad-timeout", 500*time.Millisecond, "How long a -dad probe waits for another host to answer")
+	userspaceFlag := flag.String("userspace", "", "Originate connections from a userspace TCP/IP stack on this Ethernet interface, which answers ARP for pool IPs itself (IPv4 only; needs CAP_NET_RAW)")
+	userspaceMACFlag := flag.String("userspace-mac", "", "MAC address of the -userspace stack (default: the interface's with the locally administered bit flipped)")
+	userspaceGatewayFlag := flag.String("userspace-gateway", "", "Next hop of the -userspace stack for off-link destinations (default: the interface's default route)")
+	wgConfigFlag := flag.String("wg-config", "", "WireGuard config (wg setconf format plus Address); connections from Address pool IPs to the peers' AllowedIPs egress through an in-process tunnel")
+	wgDevFlag := flag.String("wg-dev", "scoreproxy0", "Name of the -wg-config TUN device")
+	wgTableFlag := flag.Int("wg-table", 51820, "Routing table used for -wg-config traffic")
+	reverseFlag := flag.String("reverse", "", "Dial out to a relay (tcp://host:port or tls://host:port) and serve SOCKS over that tunnel, for proxies with no inbound port")
+	reverseCAFlag := flag.String("reverse-ca", "", "PEM CA bundle to verify a tls:// -reverse relay with (default: system roots)")
+	reverseTokenFlag := flag.String("reverse-token", "", "Shared secret a -reverse proxy presents to the relay; required by both")
+	relayTunnelFlag := flag.String("relay-tunnel", ":7000", "relay: host:port where -reverse proxies connect (TLS with -tls-cert)")
+	relaySOCKSFlag := flag.String("relay-socks", "127.0.0.1:1080", "relay: host:port or unix:PATH where SOCKS clients connect")
+	transparentFlag := flag.String("transparent", "", "Also accept iptables-intercepted connections on this host:port and forward them to their original destination from pool IPs")
+	transparentModeFlag := flag.String("transparent-mode", transparentRedirect, "How -transparent connections were intercepted: redirect (REDIRECT, SO_ORIGINAL_DST) or tproxy (TPROXY, IP_TRANSPARENT)")
+	httpListenFlag := flag.String("http-listen", "", "Also serve an HTTP proxy (CONNECT and http:// requests) on this host:port or unix:PATH, sharing the SOCKS auth, rules and pool")
+	socketModeFlag := flag.String("socket-mode", "0660", "Permissions of a unix: -listen socket, in octal")
+	flag.StringVar(&socketOwner, "socket-owner", "", "Owner of a unix: -listen socket, as USER[:GROUP] names or IDs (default: the proxy's user)")
+	flag.StringVar(&onEmptyPool, "on-empty-pool", emptyPoolFatal, "Behavior when the IP pool is empty: fatal, keep-last, or reject")
+	flag.IntVar(&dialRetries, "retries", 0, "Number of times to retry a failed dial, each from a source IP not yet tried for it")
+	flag.DurationVar(&retryBackoff, "retry-backoff", 100*time.Millisecond, "Initial backoff between dial retries (doubles per retry, with jitter)")
+	flag.DurationVar(&retryBackoffMax, "retry-backoff-max", 2*time.Second, "Maximum backoff between dial retries")
+	flag.StringVar(&distribution, "distribution", distUniform, "Shape of random selection: uniform, or zipf (a few hot IPs and a long tail; see -zipf-skew)")
+	flag.Float64Var(&zipfSkew, "zipf-skew", zipfSkew, "Zipf exponent for -distribution zipf, greater than 1; larger values concentrate more traffic on the hottest IPs")
+	flag.DurationVar(&rotateEvery, "rotate-every", 0, "Hold one source IP for all dials for this long, then rotate (e.g. 30s); 0 picks a new IP per dial")
+	flag.DurationVar(&stickyDestTTL, "sticky-dest", 0, "Reuse the same source IP for every dial to a destination IP:port until it has been idle this long (e.g. 10m); 0 disables")
+	flag.DurationVar(&stickyClientTTL, "sticky-client", 0, "Reuse the same source IP for every dial of a SOCKS client until it has been idle this long (e.g. 30m); 0 disables")
+	flag.StringVar(&stickyClientKey, "sticky-client-key", stickyByAddr, "How -sticky-client identifies clients: addr (client IP) or user (SOCKS username, else client IP)")
+	pinFileFlag := flag.String("pin-file", "", "File of \"DEST -> SRC\" rules pinning destination IPs or CIDRs to source IPs (reloaded on SIGHUP)")
+	forceIPFlag := flag.String("force-ip", "", "Pin every dial to this source IP (for debugging routing issues)")
+	forceOffPoolFlag := flag.Bool("force-ip-off-pool", false, "Allow -force-ip to name an IP that is not in the pool")
+	tagFlag := flag.String("tag", "", "Only use IPs from -file with this tag (\"10.1.2.3 web\"); untagged IPs are tagged \""+defaultTag+"\"")
+	flag.IntVar(&selectionBudget, "select-budget", 64, "Maximum random picks per pool when looking for an available source IP")
+	flag.StringVar(&onBudgetExhausted, "on-budget-exhausted", budgetUseAny, "When no available IP is found within -select-budget: any (use any primary IP) or fail")
+	udpFileFlag := flag.String("udp-file", "", "File of source IPs for UDP only; TCP keeps using the main pool")
+	udpTagFlag := flag.String("udp-tag", "", "Use IPs with this tag as the UDP-only pool, read from -udp-file or else -file")
+	flag.BoolVar(&noDelay, "nodelay", true, "Set TCP_NODELAY on upstream and client connections; -nodelay=false re-enables Nagle batching")
+	flag.StringVar(&resolveMode, "resolve", resolveSystem, "Who resolves client hostnames: system (proxy, DNS from the host's address), pool (proxy, DNS from a pool IP), or client (hostnames rejected)")
+	flag.IntVar(&resetThreshold, "reset-threshold", 0, "Pause a source IP after this many upstream resets on established connections within -reset-window (0 disables)")
+	flag.DurationVar(&resetWindow, "reset-window", time.Minute, "Window in which upstream resets count towards -reset-threshold")
+	flag.DurationVar(&resetCooldown, "reset-cooldown", 5*time.Minute, "How long a source IP stays paused once -reset-threshold is reached")
+	flag.StringVar(&selectionMode, "selection", selectRandom, "Source IP selection: random; coverage (use every pool IP once, in random order, before any repeats); roundrobin (cycle through the pool in order); sequential (one pass in order, then random); or hash (one fixed IP per destination host)")
+	flag.StringVar(&selectionMode, "strategy", selectRandom, "Alias for -selection")
+	clientTagsFlag := flag.String("client-tags", "", "Comma-separated client tags allowed in logs and metrics; clients pick one with the username option tag=NAME (needs -username-hint)")
+	clientTagMapFlag := flag.String("client-tag-map", "", "Comma-separated CIDR=tag pairs labeling clients by source address (e.g. 10.0.0.5/32=scorebot)")
+	flag.StringVar(&forceNetwork, "force-network", "", "Override the network for upstream dials: tcp, tcp4, or tcp6 (empty passes through)")
+	fixSysctlFlag := flag.Bool("fix-sysctl", false, "If the startup bind check fails, set net.ipv4/ipv6.ip_nonlocal_bind=1 instead of refusing to start (needs root)")
+	flag.BoolVar(&freebindFallback, "freebind-fallback", false, "If binding a spoofed source IP fails with EADDRNOTAVAIL, dial from the host's own address instead of failing (logged loudly and counted)")
+	recordFlag := flag.String("record", "", "Write a JSON-lines trace of source IP decisions for every dial to this file")
+	shuffleFlag := flag.Bool("shuffle", false, "Shuffle the IP pool once at load (reproducible with -seed) so file order does not carry over")
+	selfTestFlag := flag.Bool("selftest", false, "Dial a local test server from pool IPs, check the source IP it sees, and exit (non-zero on failure)")
+	selfTestIPsFlag := flag.Int("selftest-ips", 5, "Number of random pool IPs to check with -selftest or the selftest command (0 for every pool IP)")
+	selfTestTargetFlag := flag.String("target", "", "HOST:PORT the selftest command dials from each tested pool IP, instead of the local spoofing check")
+	fallbackFileFlag := flag.String("fallback-file", "", "File of fallback source IPs, used only when no primary IP is healthy")
+	flag.Float64Var(&quarantineRate, "quarantine-rate", 0, "Quarantine a source IP once this fraction of its dials within -quarantine-window fail, e.g. 0.5 (0 disables)")
+	flag.IntVar(&quarantineMinDials, "quarantine-min-dials", 5, "Dials a source IP must make within -quarantine-window before -quarantine-rate applies")
+	flag.DurationVar(&quarantineWindow, "quarantine-window", 5*time.Minute, "Window in which dials count towards -quarantine-rate")
+	flag.DurationVar(&quarantineTime, "quarantine-time", 2*time.Minute, "How long a quarantined source IP is left out of selection")
+	flag.IntVar(&circuitFailures, "circuit-failures", 0, "Open a source IP's circuit breaker after this many consecutive failed dials (0 disables)")
+	flag.DurationVar(&circuitOpenTime, "circuit-open", 30*time.Second, "How long an open circuit keeps a source IP out of selection before a probe dial")
+	flag.DurationVar(&sourceCooldown, "cooldown", 0, "How long to skip a source IP after a failed dial (0 disables)")
+	allowPortsFlag := flag.String("allow-ports", "", "Only allow CONNECT and UDP datagrams to these ports (e.g. 22,80,443,8000-9000); empty allows all")
+	denyPortsFlag := flag.String("deny-ports", "", "Refuse CONNECT and UDP datagrams to these ports (e.g. 25,6000-6100)")
+	tlsCertFlag := flag.String("tls-cert", "", "PEM certificate to serve SOCKS over TLS on TCP listeners (reloaded on SIGHUP); needs -tls-key")
+	tlsKeyFlag := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	tlsClientCAFlag := flag.String("tls-client-ca", "", "PEM CA bundle; with -tls-cert, clients must present a certificate signed by it")
+	authFileFlag := flag.String("authfile", "", "File of username:password lines enabling SOCKS5 auth (reloaded on SIGHUP)")
+	flag.IntVar(&listenBacklog, "backlog", 0, "Listen backlog for the SOCKS listener (0 uses the kernel default, capped by somaxconn)")
+	flag.IntVar(&maxHandshakes, "max-handshakes", 256, "Maximum SOCKS handshakes processed concurrently")
+	flag.DurationVar(&handshakeWaitMax, "handshake-wait", 5*time.Second, "How long a new connection waits for a handshake slot before being closed")
+	metricsAddrFlag := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9090); empty disables")
+	flag.IntVar(&fwmark, "fwmark", 0, "Set this firewall mark (SO_MARK) on upstream sockets for policy routing (0 disables)")
+	flag.BoolVar(&halfClose, "half-close", true, "Propagate TCP half-close between client and upstream; -half-close=false closes both directions when either side finishes")
+	flag.IntVar(&dscp, "dscp", -1, "DSCP value (0-63) to mark upstream traffic with; client connections are unaffected (-1 disables)")
+	mgmtIPFlag := flag.String("mgmt-ip", "", "Comma-separated management IPs to keep out of the pool, in addition to the proxy's own interface addresses")
+	noAutoExcludeFlag := flag.Bool("no-auto-exclude", false, "Do not remove the proxy's own interface and management IPs from the pool")
+	warnSpecialFlag := flag.Bool("warn-special", false, "Warn about pool IPs that are network/broadcast, loopback, multicast, or otherwise non-unicast")
+	strictSpecialFlag := flag.Bool("strict-special", false, "Like -warn-special, but drop those IPs from the pool")
+	specialPrefixFlag := flag.Int("special-prefix", 24, "Subnet prefix length used by -warn-special to spot network/broadcast addresses")
+	adminAddrFlag := flag.String("admin-addr", "", "Serve the admin API on this address (e.g. 127.0.0.1:9091); empty disables")
+	recentBufferFlag := flag.Int("recent-buffer", 256, "Number of recent connection records kept for the admin API")
+	pprofAddrFlag := flag.String("pprof-addr", "", "Serve net/http/pprof on this address (e.g. 127.0.0.1:6060); empty disables")
+	seedFlag := flag.Int64("seed", 0, "Seed for source IP selection and -sample, for reproducible runs (0 uses the current time)")
+	flag.IntVar(&sampleSize, "sample", 0, "Randomly sample at most this many IPs from -start/-end ranges (0 uses every address)")
+	cryptoRandFlag := flag.Bool("crypto-rand", false, "Use crypto/rand for unpredictable (but slower) source IP selection")
+	flag.IntVar(&listenerRestarts, "listener-restarts", 3, "How many times to re-bind the SOCKS listener after it fails unexpectedly")
+	flag.BoolVar(&usernameHints, "username-hint", false, "Let clients request a source IP via the SOCKS5 username (user+src=10.1.2.3)")
+	flag.BoolVar(&hintOffPool, "username-hint-off-pool", false, "Allow -username-hint source IPs that are not in the pool")
+	printConfigFlag := flag.Bool("print-config", false, "Print the effective configuration as JSON to stdout at startup")
+	levelFlag := zap.InfoLevel
+	flag.Var(&levelFlag, "log-level", "Log level: debug, info, warn, or error (default info)")
+	quietFlag := flag.Bool("quiet", false, "Suppress per-connection info/debug logs once the proxy has started")
+	flag.Usage = usage
 	flag.Parse()
+	switch {
+	case command == cmdCheck && flag.NArg() != 1:
+		sugar.Fatal("check needs exactly one HOST:PORT to dial")
+	case command != cmdCheck && flag.NArg() > 0:
+		sugar.Fatalf("Unexpected arguments: %s", strings.Join(flag.Args(), " "))
+	case command != cmdSelfTest && *selfTestTargetFlag != "":
+		sugar.Fatal("-target is only used by the selftest command")
+	}
+	if err := applyEnv(); err != nil {
+		sugar.Fatal(err)
+	}
+	if *configFlag != "" {
+		if err := applyConfigFile(*configFlag); err != nil {
+			sugar.Fatal(err)
+		}
+	}
+	logLevel.SetLevel(levelFlag)
+
+	switch onEmptyPool {
+	case emptyPoolFatal, emptyPoolKeepLast, emptyPoolReject:
+	default:
+		sugar.Fatalf("Invalid -on-empty-pool value %q (want fatal, keep-last, or reject)", onEmptyPool)
+	}
+	if dscp < -1 || dscp > 63 {
+		sugar.Fatalf("-dscp must be between 0 and 63 (or -1 to disable), got %d", dscp)
+	}
+	if sampleSize < 0 {
+		sugar.Fatal("-sample must not be negative")
+	}
+	if fwmark < 0 {
+		sugar.Fatalf("-fwmark must be a non-negative integer, got %d", fwmark)
+	}
+	if *recentBufferFlag < 0 {
+		sugar.Fatal("-recent-buffer must not be negative")
+	}
+	recentConns = newRecentBuffer(*recentBufferFlag)
+	if selectionBudget < 1 {
+		sugar.Fatal("-select-budget must be at least 1")
+	}
+	if onBudgetExhausted != budgetUseAny && onBudgetExhausted != budgetFail {
+		sugar.Fatalf("Invalid -on-budget-exhausted value %q (want any or fail)", onBudgetExhausted)
+	}
+	if err := setupClientTags(*clientTagsFlag, *clientTagMapFlag); err != nil {
+		sugar.Fatalf("Invalid client tags: %v", err)
+	}
+	switch forceNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		sugar.Fatalf("Invalid -force-network value %q (want tcp, tcp4, or tcp6)", forceNetwork)
+	}
+	switch selectionMode {
+	case selectRandom, selectCoverage, selectRoundRobin, selectSequential, selectHash:
+	default:
+		sugar.Fatalf("Invalid -selection value %q (want random, coverage, roundrobin, sequential, or hash)", selectionMode)
+	}
+	if resolveMode != resolveSystem && resolveMode != resolvePool && resolveMode != resolveClient {
+		sugar.Fatalf("Invalid -resolve value %q (want system, pool, or client)", resolveMode)
+	}
+	if distribution != distUniform && distribution != distZipf {
+		sugar.Fatalf("Invalid -distribution value %q (want uniform or zipf)", distribution)
+	}
+	if !(zipfSkew > 1) {
+		sugar.Fatalf("Invalid -zipf-skew %v: must be greater than 1", zipfSkew)
+	}
+	if rotateEvery < 0 {
+		sugar.Fatal("-rotate-every must not be negative")
+	}
+	if stickyDestTTL < 0 {
+		sugar.Fatal("-sticky-dest must not be negative")
+	}
+	if stickyClientTTL < 0 {
+		sugar.Fatal("-sticky-client must not be negative")
+	}
+	if stickyClientKey != stickyByAddr && stickyClientKey != stickyByUser {
+		sugar.Fatalf("Invalid -sticky-client-key value %q (want addr or user)", stickyClientKey)
+	}
+	if maxHandshakes < 1 {
+		sugar.Fatal("-max-handshakes must be at least 1")
+	}
+	if dialRetries < 0 || retryBackoff < 0 || retryBackoffMax < 0 {
+		sugar.Fatal("-retries, -retry-backoff, and -retry-backoff-max must not be negative")
+	}
 
 	// var err error // Already declared above for logger
 
-	switch {
-	case *fileFlag != "":
-		ipList, err = loadIPsFromFile(*fileFlag)
+	seed := *seedFlag
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	sugar.Infow("Random seed", "seed", seed)
+	seedRand := rand.New(rand.NewSource(seed))
+
+	if err := setProxyProtocolFrom(proxyProtocolFromFlag); err != nil {
+		sugar.Fatal(err)
+	}
+	if *upstreamFlag != "" {
+		if upstreamProxy, err = parseUpstream(*upstreamFlag); err != nil {
+			sugar.Fatal(err)
+		}
+		sugar.Infow("Chaining outbound connections through upstream proxy", "upstream", upstreamProxy.Redacted())
+	}
+	if sendProxyRules, err = parseSendProxy(sendProxyFlag); err != nil {
+		sugar.Fatal(err)
+	}
+	if sendProxyVersion != 1 && sendProxyVersion != 2 {
+		sugar.Fatalf("Invalid -send-proxy-version %d: want 1 or 2", sendProxyVersion)
+	}
+	if *transparentFlag != "" {
+		if *transparentModeFlag != transparentRedirect && *transparentModeFlag != transparentTProxy {
+			sugar.Fatalf("Invalid -transparent-mode %q: want %s or %s", *transparentModeFlag, transparentRedirect, transparentTProxy)
+		}
+		_, port, err := net.SplitHostPort(*transparentFlag)
+		if err != nil {
+			sugar.Fatalf("Invalid -transparent address %q: %v", *transparentFlag, err)
+		}
+		if transparentPort, err = strconv.Atoi(port); err != nil {
+			sugar.Fatalf("Invalid -transparent port %q", port)
+		}
+	}
+	mode, err := strconv.ParseUint(*socketModeFlag, 8, 32)
+	if err != nil || mode > 0o777 {
+		sugar.Fatalf("Invalid -socket-mode %q: want octal permissions such as 0660", *socketModeFlag)
+	}
+	socketMode = fs.FileMode(mode)
+	if socketOwner != "" {
+		if _, _, err := lookupOwner(socketOwner); err != nil {
+			sugar.Fatal(err)
+		}
+	}
+	// An empty host listens on every interface in both families.
+	listenAddrs := []string{fmt.Sprintf(":%d", *portFlag)}
+	if len(listenFlag) > 0 {
+		listenAddrs = listenFlag
+	}
+	var listenHosts []string
+	for _, addr := range listenAddrs {
+		if strings.HasPrefix(addr, unixPrefix) {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr)
 		if err != nil {
-			sugar.Fatalf("Failed loading IPs from file: %v", err) // Zap will handle err type
+			sugar.Fatalf("Invalid -listen address %q: %v", addr, err)
 		}
-		sugar.Infof("Loaded %d IPs from file: %s", len(ipList), *fileFlag)
-	case *startFlag != "" && *endFlag != "":
-		ipList, err = validateIPRange(*startFlag, *endFlag)
+		listenHosts = append(listenHosts, host)
+	}
+
+	if *tlsCertFlag != "" || *tlsKeyFlag != "" || *tlsClientCAFlag != "" {
+		if *tlsCertFlag == "" || *tlsKeyFlag == "" {
+			sugar.Fatal("-tls-cert and -tls-key must be given together")
+		}
+		t, err := newTLSFiles(*tlsCertFlag, *tlsKeyFlag, *tlsClientCAFlag)
 		if err != nil {
-			sugar.Fatalf("Invalid IP range: %v", err) // Zap will handle err type
+			sugar.Fatalf("Failed loading TLS settings: %v", err)
 		}
-		sugar.Infof("Using IP range with %d IPs: %s - %s", len(ipList), *startFlag, *endFlag)
-	default:
-		// log.Fatalf("Usage: -start and -end for IP range OR -file for list of IPs")
+		listenTLS = t
+		sugar.Infow("SOCKS over TLS enabled", "cert", *tlsCertFlag, "client_cert_required", *tlsClientCAFlag != "")
+	}
+	if *sshListenFlag != "" {
+		if *sshHostKeyFlag == "" || *sshAuthorizedKeysFlag == "" {
+			sugar.Fatal("-ssh-listen needs -ssh-host-key and -ssh-authorized-keys")
+		}
+		if listenSSH, err = newSSHFiles(*sshHostKeyFlag, *sshAuthorizedKeysFlag); err != nil {
+			sugar.Fatalf("Failed loading SSH settings: %v", err)
+		}
+	}
+	if (command == cmdRelay || *reverseFlag != "") && *reverseTokenFlag == "" {
+		sugar.Fatal("-reverse-token is required by -reverse and relay")
+	}
+	if command == cmdRelay {
+		if err := runRelay(*relayTunnelFlag, *relaySOCKSFlag, *reverseTokenFlag); err != nil {
+			sugar.Fatalf("Relay failed: %v", err)
+		}
+		return
+	}
+	var reverse *reverseTarget
+	if *reverseFlag != "" {
+		if reverse, err = parseReverse(*reverseFlag, *reverseCAFlag); err != nil {
+			sugar.Fatal(err)
+		}
+	}
+
+	sources := poolSources{
+		files:         ipFiles,
+		tag:           *tagFlag,
+		cidrs:         cidrs,
+		ranges:        ranges,
+		start:         *startFlag,
+		end:           *endFlag,
+		excludes:      excludes,
+		warnSpecial:   *warnSpecialFlag,
+		strictSpecial: *strictSpecialFlag,
+		specialPrefix: *specialPrefixFlag,
+		autoExclude:   !*noAutoExcludeFlag,
+		listenHosts:   listenHosts,
+		mgmtIPs:       *mgmtIPFlag,
+		shuffle:       *shuffleFlag,
+	}
+	if sources.empty() {
 		flag.Usage() // Print usage from flags
 		os.Exit(1)   // Ensure exit after fatal log if flag.Usage() doesn't exit
 	}
+	if quarantineRate < 0 || quarantineRate > 1 {
+		sugar.Fatalf("Invalid -quarantine-rate %v: must be between 0 and 1", quarantineRate)
+	}
+	if circuitFailures > 0 && circuitOpenTime <= 0 {
+		sugar.Fatalf("Invalid -circuit-open %v: must be positive", circuitOpenTime)
+	}
+	if *refreshFlag < 0 {
+		sugar.Fatalf("Invalid -refresh %v: must not be negative", *refreshFlag)
+	}
+	if *refreshFlag > 0 && len(ipFiles) == 0 {
+		sugar.Fatal("-refresh requires -file")
+	}
+	poolRand = seedRand
+	ips, err := buildPool(sources, seedRand)
+	if err != nil {
+		sugar.Fatalf("Failed building the IP pool: %v", err)
+	}
+	if err := setPool(ips); err != nil {
+		sugar.Fatalf("IP list is empty after processing flags. Cannot start proxy: %v", err)
+	}
+	switch {
+	case forceNetwork == "tcp4" && !hasFamily(currentPool(), familyIPv4):
+		sugar.Fatal("-force-network tcp4 needs IPv4 source IPs, but the pool has none")
+	case forceNetwork == "tcp6" && !hasFamily(currentPool(), familyIPv6):
+		sugar.Fatal("-force-network tcp6 needs IPv6 source IPs, but the pool has none")
+	}
+
+	rules := &portRuleSet{}
+	if rules.allow, err = parsePortList(*allowPortsFlag); err != nil {
+		sugar.Fatalf("Invalid -allow-ports: %v", err)
+	}
+	if rules.deny, err = parsePortList(*denyPortsFlag); err != nil {
+		sugar.Fatalf("Invalid -deny-ports: %v", err)
+	}
+
+	if *udpFileFlag != "" || *udpTagFlag != "" {
+		udpFiles := ipFiles
+		if *udpFileFlag != "" {
+			udpFiles = stringList{*udpFileFlag}
+		}
+		if len(udpFiles) == 0 {
+			sugar.Fatal("-udp-tag needs -udp-file or -file to read tagged IPs from")
+		}
+		udpEntries, err := loadIPFiles(udpFiles, *udpTagFlag, "udp")
+		if err != nil {
+			sugar.Fatalf("Failed loading UDP IPs: %v", err)
+		}
+		udpList = newIPPool(entryIntervals(udpEntries)).weighted(udpEntries)
+		sugar.Infof("Loaded %s UDP-only source IPs from file(s): %s", udpList.count(), udpFiles.String())
+		if *shuffleFlag {
+			if shuffled, ok := udpList.shuffled(seedRand); ok {
+				udpList = shuffled
+				sugar.Infow("Shuffled UDP IP pool", "pool_size", udpList.count(), "seed", seed)
+			}
+		}
+	}
+
+	if *fallbackFileFlag != "" {
+		fallbackEntries, err := loadIPsFromFile(*fallbackFileFlag, "", "")
+		if err != nil {
+			sugar.Fatalf("Failed loading fallback IPs: %v", err)
+		}
+		fallbackList = newIPPool(entryIntervals(fallbackEntries)).weighted(fallbackEntries)
+		sugar.Infof("Loaded %s fallback IPs from file: %s", fallbackList.count(), *fallbackFileFlag)
+	}
+
+	if *forceIPFlag != "" {
+		ip := net.ParseIP(*forceIPFlag)
+		if ip == nil {
+			sugar.Fatalf("Invalid -force-ip address: %s", *forceIPFlag)
+		}
+		if !*forceOffPoolFlag && !poolContains(ip) {
+			sugar.Fatalf("-force-ip %s is not in the IP pool (use -force-ip-off-pool to allow it)", ip)
+		}
+		pinnedIP = normalizeIP(ip)
+		sugar.Warnw("SOURCE IP PINNING ACTIVE: every dial will use a single source IP",
+			"pinned_ip", ip.String(),
+			"in_pool", poolContains(ip),
+		)
+	}
+
+	if *pinFileFlag != "" {
+		rules, err := newPinRules(*pinFileFlag)
+		if err != nil {
+			sugar.Fatalf("Failed loading -pin-file: %v", err)
+		}
+		destPins = rules
+		sugar.Infow("Loaded pin rules", "file", *pinFileFlag, "rules", len(rules.rules))
+	}
+
+	switch command {
+	case cmdValidate:
+		fmt.Fprintf(os.Stdout, "OK: pool of %s IPs (%s UDP-only, %s fallback)\n", currentPool().count(), udpList.count(), fallbackList.count())
+		os.Exit(0)
+	case cmdGen:
+		if err := runGen(os.Stdout, currentPool()); err != nil {
+			sugar.Fatalf("gen failed: %v", err)
+		}
+		os.Exit(0)
+	}
 
-	if len(ipList) == 0 {
-		sugar.Fatal("IP list is empty after processing flags. Cannot start proxy.")
+	probeIPs := []net.IP{pinnedIP}
+	if pinnedIP == nil {
+		probeIPs = nil
+		for _, family := range []string{familyIPv4, familyIPv6} {
+			if p := currentPool().family(family); !p.empty() {
+				probeIPs = append(probeIPs, p.at(u128{}))
+			}
+		}
+	}
+	if err := checkCapabilities(probeIPs, *fixSysctlFlag); err != nil {
+		sugar.Fatalf("Capability check failed: %v", err)
+	}
+
+	if *cryptoRandFlag {
+		localRand = cryptoSource{}
+		sugar.Infow("Using crypto/rand for source IP selection")
+		if *seedFlag != 0 {
+			sugar.Warnw("-seed only fixes -sample and -shuffle with -crypto-rand; source IP picks will not repeat across runs", "seed", seed)
+		}
+	} else {
+		localRand = newLockedRand(seed)
 	}
+	for _, spec := range listenerSpecs {
+		lp, err := parseListener(spec)
+		if err != nil {
+			sugar.Fatal(err)
+		}
+		extraListeners = append(extraListeners, lp)
+		sugar.Infow("Configured extra listener", "listen_addr", lp.addr, "pool_size", lp.pool.count(), "selection", lp.mode)
+	}
+	sourceSelector = newSourceSelector()
 
-	source := rand.NewSource(time.Now().UnixNano())
-	localRand = rand.New(source)
+	if command == cmdCheck {
+		if err := runCheck(flag.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stdout, "FAIL: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *recordFlag != "" {
+		if *cryptoRandFlag {
+			sugar.Warnw("Recording with -crypto-rand; the trace cannot be replayed")
+		}
+		header := traceHeader{Seed: seed, PoolSize: currentPool().len(), Selection: selectionMode}
+		for _, iv := range currentPool().intervals() {
+			header.Pool = append(header.Pool, iv.String())
+		}
+		if sourceCooldown > 0 {
+			header.Cooldown = sourceCooldown.String()
+		}
+		err := startRecording(*recordFlag, header)
+		if err != nil {
+			sugar.Fatalf("Failed to start -record: %v", err)
+		}
+		sugar.Infow("Recording decision traces", "file", *recordFlag, "seed", seed)
+	}
+
+	if *selfTestFlag || command == cmdSelfTest {
+		if *selfTestIPsFlag == 0 && pinnedIP == nil && currentPool().len() > genLimit {
+			sugar.Fatalf("Pool has %s IPs, too many to test every one; set -selftest-ips", currentPool().count())
+		}
+		var ok bool
+		if *selfTestTargetFlag != "" {
+			ok = runEgressTest(*selfTestTargetFlag, *selfTestIPsFlag)
+		} else {
+			ok = runSelfTest(*selfTestIPsFlag)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	warnings := runPreflight(preflightOptions{
+		probeIPs:      probeIPs,
+		canary:        *canaryFlag,
+		specialPrefix: *specialPrefixFlag,
+		localRoutes:   *installRoutesFlag || *userspaceFlag != "" || *wgConfigFlag != "",
+		userspace:     *userspaceFlag != "",
+	})
+	if *strictFlag && warnings > 0 {
+		sugar.Fatalf("Refusing to start with %d preflight warnings (-strict)", warnings)
+	}
 
 	conf := &socks5.Config{
-		Dial:   customDialer,
-		Logger: zap.NewStdLog(logger),
+		Dial:  customDialer,
+		Rules: ruleChain{handshakeRule{}, rules},
+	}
+	switch resolveMode {
+	case resolvePool:
+		conf.Resolver = newPoolResolver()
+		sugar.Infow("Resolving client hostnames with DNS sent from pool IPs")
+	case resolveClient:
+		sugar.Infow("Rejecting client hostnames; clients must resolve destinations themselves")
+	default:
+		sugar.Infow("Resolving client hostnames with the system resolver; DNS leaves from the host's own address")
 	}
 
-	stdZapLog := zap.NewStdLog(logger) // Create a standard logger from zap
-	conf.Logger = stdZapLog            // Assign it to the SOCKS5 config
+	var creds *reloadableCredentials
+	if *authFileFlag != "" {
+		creds, err = newReloadableCredentials(*authFileFlag)
+		if err != nil {
+			sugar.Fatalf("Failed loading credentials: %v", err)
+		}
+		conf.Credentials = creds
+		sugar.Infof("SOCKS5 username/password auth enabled from file: %s", *authFileFlag)
+	}
+	if usernameHints {
+		// Hints ride in the username, so the account check must ignore them.
+		// Without -authfile clients may still skip auth entirely.
+		hinted := hintCredentials{}
+		if creds != nil {
+			hinted.next = creds
+		}
+		conf.AuthMethods = []socks5.Authenticator{&socks5.UserPassAuthenticator{Credentials: hinted}}
+		if creds == nil {
+			conf.AuthMethods = append(conf.AuthMethods, &socks5.NoAuthAuthenticator{})
+		}
+		conf.Rules = append(conf.Rules.(ruleChain), hintRule{})
+		sugar.Infow("SOCKS5 username source IP hints enabled", "allow_off_pool", hintOffPool)
+	}
 
-	server, err := socks5.New(conf)
-	if err != nil {
-		sugar.Fatalf("Error creating SOCKS5 server: %v", err)
+	if *refreshFlag > 0 {
+		refreshPool(sources, *refreshFlag)
+	}
+	if *watchFlag {
+		if err := watchPoolFiles(sources); err != nil {
+			sugar.Warnw("Failed to watch IP files, changes need SIGHUP or -refresh", "error", err)
+		}
 	}
 
-	listenAddr := fmt.Sprintf("0.0.0.0:%d", *portFlag)
-	sugar.Infof("Starting SOCKS5 server on %s", listenAddr)
-	if err := server.ListenAndServe("tcp", listenAddr); err != nil {
-		sugar.Fatalf("Error starting SOCKS5 server: %v", err)
+	watchSIGHUP(func() {
+		if err := rebuildPool(sources, "SIGHUP"); err != nil {
+			sugar.Errorw("Failed to reload IP pool, keeping the active pool", "error", err)
+		}
+		if destPins != nil {
+			if err := destPins.Reload(); err != nil {
+				sugar.Errorw("Failed to reload pin rules, keeping previous set", "error", err)
+			}
+		}
+		if creds != nil {
+			if err := creds.Reload(); err != nil {
+				sugar.Errorw("Failed to reload credentials, keeping previous set", "error", err)
+			}
+		}
+		if listenTLS != nil {
+			if err := listenTLS.Reload(); err != nil {
+				sugar.Errorw("Failed to reload TLS settings, keeping previous set", "error", err)
+			}
+		}
+		if listenSSH != nil {
+			if err := listenSSH.Reload(); err != nil {
+				sugar.Errorw("Failed to reload SSH settings, keeping previous set", "error", err)
+			}
+		}
+	})
+
+	server := newSOCKSServer(conf)
+
+	selection := selectionMode
+	if *cryptoRandFlag {
+		selection = "crypto-" + selection
+	}
+	if pinnedIP != nil {
+		selection = "pinned"
+	}
+	derived := map[string]any{
+		"pool_size":     currentPool().len(),
+		"udp_pool_size": udpList.len(),
+		"fallback_size": fallbackList.len(),
+		"selection":     selection,
+		"listen_addr":   strings.Join(listenAddrs, ","),
+		"auth":          creds != nil,
+		"freebind":      freebindOptions(),
+		"dial_timeout":  dialTimeout.String(),
+		"seed_value":    seed,
+	}
+	if upstreamProxy != nil {
+		derived["upstream"] = upstreamProxy.Redacted()
+	}
+	if *reverseTokenFlag != "" {
+		derived["reverse-token"] = "xxxxx"
+	}
+	cfg := effectiveConfig(derived)
+	sugar.Infow("Effective configuration", "config", cfg)
+	if *printConfigFlag {
+		if err := printConfig(cfg); err != nil {
+			sugar.Errorw("Failed to print config", "error", err)
+		}
+	}
+
+	defer runTeardowns()
+	if *installRoutesFlag {
+		routes, err := installAnyIPRoutes(poolPrefixes())
+		if err != nil {
+			sugar.Fatalf("Failed to install local routes: %v", err)
+		}
+		teardowns = append(teardowns, routes.Close)
+	}
+	if *arpResponderFlag != "" {
+		if *userspaceFlag != "" {
+			fatalf("-arp-responder cannot be combined with -userspace, which answers ARP itself")
+		}
+		if err := startNeighborResponder(*arpResponderFlag); err != nil {
+			fatalf("Failed to start neighbor responder: %v", err)
+		}
+	}
+	if *userspaceFlag != "" {
+		var mac net.HardwareAddr
+		if *userspaceMACFlag != "" {
+			if mac, err = net.ParseMAC(*userspaceMACFlag); err != nil {
+				fatalf("Invalid -userspace-mac: %v", err)
+			}
+		}
+		var gateway net.IP
+		if *userspaceGatewayFlag != "" {
+			if gateway = net.ParseIP(*userspaceGatewayFlag).To4(); gateway == nil {
+				fatalf("Invalid -userspace-gateway %q (want an IPv4 address)", *userspaceGatewayFlag)
+			}
+		}
+		if userspaceNet, err = startUserspace(*userspaceFlag, mac, gateway); err != nil {
+			fatalf("Failed to start userspace stack: %v", err)
+		}
+	}
+	if *dadFlag != "" {
+		if *dadTimeoutFlag <= 0 {
+			fatalf("-dad-timeout must be positive")
+		}
+		if dadProber, err = startARPProber(*dadFlag, *dadTimeoutFlag); err != nil {
+			fatalf("Failed to start duplicate address detection: %v", err)
+		}
+		// Until its probe finishes an IP is unavailable, and a dial with no
+		// available IP falls back to any pool IP, so probe before serving.
+		dadProber.probePools()
+	}
+	if *wgConfigFlag != "" {
+		wg, err := startWireGuard(*wgConfigFlag, *wgDevFlag, *wgTableFlag)
+		if err != nil {
+			fatalf("Failed to start WireGuard: %v", err)
+		}
+		teardowns = append(teardowns, wg.Close)
+	}
+	if *metricsAddrFlag != "" {
+		serveMetrics(*metricsAddrFlag)
+	}
+	if *adminAddrFlag != "" {
+		serveAdmin(*adminAddrFlag)
+	}
+	if *pprofAddrFlag != "" {
+		servePprof(*pprofAddrFlag)
+	}
+	sugar.Infof("Starting SOCKS5 server on %s", listenAddrs[0])
+	if *quietFlag {
+		sugar.Infow("Quiet mode enabled, per-connection messages below warning will not be logged from here on")
+		connLevel.SetLevel(zap.WarnLevel)
+	}
+	shutdown := make(chan struct{})
+	stopSignals := make(chan os.Signal, 1)
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-stopSignals
+		sugar.Warnw("Received signal, shutting down", "signal", sig.String())
+		close(shutdown)
+	}()
+	for _, addr := range listenAddrs[1:] {
+		sugar.Infof("Starting SOCKS5 server on %s", addr)
+		go func() {
+			if err := superviseListener(server, addr, shutdown); err != nil {
+				fatalf("Error starting SOCKS5 server on %s: %v", addr, err)
+			}
+		}()
+	}
+	if *transparentFlag != "" {
+		tp := *server
+		tp.transparent = *transparentModeFlag
+		sugar.Infof("Starting transparent proxy (%s) on %s", tp.transparent, *transparentFlag)
+		go func() {
+			if err := superviseListener(&tp, *transparentFlag, shutdown); err != nil {
+				fatalf("Error starting transparent proxy on %s: %v", *transparentFlag, err)
+			}
+		}()
+	}
+	if *httpListenFlag != "" {
+		sugar.Infof("Starting HTTP proxy on %s", *httpListenFlag)
+		go func() {
+			if err := serveHTTPProxy(server, *httpListenFlag); err != nil {
+				fatalf("Error starting HTTP proxy on %s: %v", *httpListenFlag, err)
+			}
+		}()
+	}
+	if listenSSH != nil {
+		sugar.Infof("Starting SSH server on %s", *sshListenFlag)
+		go func() {
+			if err := serveSSH(server, listenSSH, *sshListenFlag); err != nil {
+				fatalf("Error starting SSH server on %s: %v", *sshListenFlag, err)
+			}
+		}()
+	}
+	if reverse != nil {
+		sugar.Infof("Serving SOCKS5 over reverse tunnel to %s", reverse.addr)
+		go runReverse(server, reverse, *reverseTokenFlag, shutdown)
+	}
+	for _, lp := range extraListeners {
+		extra := *server
+		extra.pool = lp
+		sugar.Infof("Starting SOCKS5 server on %s", lp.addr)
+		go func() {
+			if err := superviseListener(&extra, lp.addr, shutdown); err != nil {
+				fatalf("Error starting SOCKS5 server on %s: %v", lp.addr, err)
+			}
+		}()
+	}
+	if err := superviseListener(server, listenAddrs[0], shutdown); err != nil {
+		fatalf("Error starting SOCKS5 server: %v", err)
 	}
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/armon/go-socks5"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	netproxy "golang.org/x/net/proxy"
+)
+
+func TestMain(m *testing.M) {
+	sugar = zap.NewNop().Sugar()
+	localRand = newLockedRand(1)
+	sourceSelector = newSourceSelector()
+	os.Exit(m.Run())
+}
+
+// observeLogs captures the proxy's log messages at debug level and above
+// for the rest of the test.
+func observeLogs(t *testing.T) *observer.ObservedLogs {
+	t.Helper()
+	core, logs := observer.New(zap.DebugLevel)
+	prev := sugar
+	sugar = zap.New(core).Sugar()
+	t.Cleanup(func() { sugar = prev })
+	return logs
+}
+
+// usePool sets the primary pool to spec, an IP, CIDR or range, for the
+// rest of the test.
+func usePool(t testing.TB, spec string) {
+	t.Helper()
+	iv, err := parseInterval(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := currentPool()
+	if err := setPool(newIPPool([]ipInterval{iv})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { activePool.Store(prev) })
+}
+
+// startProxy serves the SOCKS5 proxy on a random loopback port and returns
+// its address. The test ends only once every connection has been served,
+// so settings it changed stay in place until then.
+func startProxy(t *testing.T) string {
+	t.Helper()
+	return startServer(t, newSOCKSServer(&socks5.Config{Dial: customDialer}))
+}
+
+// startServer is startProxy for a server built by the test.
+func startServer(t *testing.T, server *socksServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				server.ServeConn(wrapClientConn(conn))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// needLoopbackPool skips the test unless sockets can bind the pool
+// 127.0.0.2-127.0.0.9, which needs all of 127.0.0.0/8 to be local as it is
+// on Linux.
+func needLoopbackPool(t *testing.T) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot bind pool IPs: %v", err)
+	}
+	l.Close()
+}
+
+// startEcho runs a line echo server on a random loopback port. The source
+// IP of each connection it accepts is sent on the returned channel.
+func startEcho(t *testing.T) (string, <-chan net.IP) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	seen := make(chan net.IP, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			seen <- conn.RemoteAddr().(*net.TCPAddr).IP
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), seen
+}
+
+// roundTrip connects to target through the proxy at proxyAddr, sends a
+// line and returns what comes back.
+func roundTrip(t *testing.T, proxyAddr, target string) string {
+	t.Helper()
+	dialer, err := netproxy.SOCKS5("tcp", proxyAddr, nil, netproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("CONNECT through proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "scorebot check\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	return line
+}
+
+func TestProxyEndToEnd(t *testing.T) {
+	usePool(t, "127.0.0.1")
+	proxyAddr := startProxy(t)
+	echoAddr, seen := startEcho(t)
+
+	if got := roundTrip(t, proxyAddr, echoAddr); got != "scorebot check\n" {
+		t.Errorf("echo returned %q", got)
+	}
+	if ip := <-seen; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("echo server saw source %s, want 127.0.0.1", ip)
+	}
+}
+
+func TestProxyEndToEndPool(t *testing.T) {
+	needLoopbackPool(t)
+	usePool(t, "127.0.0.2-127.0.0.9")
+	proxyAddr := startProxy(t)
+	echoAddr, seen := startEcho(t)
+
+	for range 10 {
+		roundTrip(t, proxyAddr, echoAddr)
+		if ip := <-seen; !poolContains(ip) {
+			t.Errorf("echo server saw source %s, outside the pool", ip)
+		}
+	}
+}
+
+func TestParseIPRange(t *testing.T) {
+	tests := []struct {
+		start, end string
+		iv         string
+		err        string
+	}{
+		{start: "10.1.2.1", end: "10.1.2.9", iv: "10.1.2.1-10.1.2.9"},
+		{start: "10.1.2.1", end: "10.1.2.1", iv: "10.1.2.1"},
+		{start: "2001:db8::1", end: "2001:db8::ff", iv: "2001:db8::1-2001:db8::ff"},
+		// IPv4-mapped addresses count as IPv4.
+		{start: "::ffff:10.1.2.1", end: "10.1.2.9", iv: "10.1.2.1-10.1.2.9"},
+
+		{start: "10.1.2.1", end: "2001:db8::1", err: "start is IPv4 but end is IPv6"},
+		{start: "2001:db8::1", end: "10.1.2.1", err: "start is IPv6 but end is IPv4"},
+		{start: "10.1.2.9", end: "10.1.2.1", err: "must be <="},
+		{start: "2001:db8::2", end: "2001:db8::1", err: "must be <="},
+		{start: "10.1.2", end: "10.1.2.9", err: "invalid start IP"},
+		{start: "10.1.2.1", end: "", err: "invalid end IP"},
+	}
+	for _, tt := range tests {
+		iv, err := parseIPRange(tt.start, tt.end)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseIPRange(%q, %q) error = %v, want one containing %q", tt.start, tt.end, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseIPRange(%q, %q) error = %v", tt.start, tt.end, err)
+			continue
+		}
+		if got := iv.String(); got != tt.iv {
+			t.Errorf("parseIPRange(%q, %q) = %s, want %s", tt.start, tt.end, got, tt.iv)
+		}
+	}
+}
+
+func TestQuietKeepsOperationalLogs(t *testing.T) {
+	logs := observeLogs(t)
+	prev := connLevel.Level()
+	t.Cleanup(func() { connLevel.SetLevel(prev) })
+	connLevel.SetLevel(zap.WarnLevel)
+
+	tagged := context.WithValue(context.Background(), ctxClientTag, "team1")
+	connLog(context.Background()).Infow("Dialing")
+	connLog(tagged).Debugw("SOCKS request")
+	connLog(tagged).Warnw("SPOOFING BYPASSED")
+	sugar.Infow("Received SIGHUP, reloading")
+
+	var got []string
+	for _, e := range logs.All() {
+		got = append(got, e.Message)
+	}
+	want := []string{"SPOOFING BYPASSED", "Received SIGHUP, reloading"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
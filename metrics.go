@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A minimal Prometheus text-format registry. Metrics register themselves at
+// package init and are served on -metrics-addr.
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   = make(map[string]metric)
+)
+
+func registerMetric(name string, m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if _, dup := metrics[name]; dup {
+		panic("duplicate metric " + name)
+	}
+	metrics[name] = m
+}
+
+// counter is a monotonically increasing count.
+type counter struct {
+	name, help string
+	v          atomic.Uint64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	registerMetric(name, c)
+	return c
+}
+
+func (c *counter) Inc()          { c.v.Add(1) }
+func (c *counter) Add(n uint64)  { c.v.Add(n) }
+func (c *counter) Value() uint64 { return c.v.Load() }
+
+func (c *counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+}
+
+// counterVec is a family of counters split by a single label. Callers must
+// keep the set of label values small and fixed.
+type counterVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	values            map[string]*atomic.Uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	c := &counterVec{name: name, help: help, label: label, values: make(map[string]*atomic.Uint64)}
+	registerMetric(name, c)
+	return c
+}
+
+func (c *counterVec) Inc(value string) {
+	c.mu.Lock()
+	v, ok := c.values[value]
+	if !ok {
+		v = new(atomic.Uint64)
+		c.values[value] = v
+	}
+	c.mu.Unlock()
+	v.Add(1)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, k, c.values[k].Load())
+	}
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	name, help string
+	bounds     []float64
+	counts     []atomic.Uint64 // len(bounds)+1, last is +Inf
+	sumBits    atomic.Uint64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	h := &histogram{
+		name:   name,
+		help:   help,
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+	registerMetric(name, h)
+	return h
+}
+
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + v
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, math.Float64frombits(h.sumBits.Load()), h.name, cumulative)
+}
+
+// latencyBuckets are histogram bounds in seconds suited to handshakes and dials.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	metricsMu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		metricsMu.Lock()
+		m := metrics[name]
+		metricsMu.Unlock()
+		m.writeTo(w)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// serveMetrics exposes /metrics on addr in the background.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			sugar.Errorw("Metrics server stopped", "addr", addr, "error", err)
+		}
+	}()
+	sugar.Infof("Serving metrics on http://%s/metrics", addr)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Frame layout offsets used by the neighbor responder.
+const (
+	ethHeaderLen  = 14
+	arpPacketLen  = 28
+	ipv6HeaderLen = 40
+	ndpNSLen      = 24 // ICMPv6 neighbor solicitation up to and including the target
+	ndpNALen      = 32 // neighbor advertisement with a target link-layer address option
+)
+
+// neighborFilter is a classic BPF program accepting ARP and ICMPv6
+// neighbor solicitations without extension headers, so the responder is not
+// woken for every frame on a busy interface.
+var neighborFilter = []unix.SockFilter{
+	{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 12},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 5, K: syscall.ETH_P_ARP},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 5, K: syscall.ETH_P_IPV6},
+	{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: ethHeaderLen + 6},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 3, K: syscall.IPPROTO_ICMPV6},
+	{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: ethHeaderLen + ipv6HeaderLen},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: uint32(header.ICMPv6NeighborSolicit)},
+	{Code: unix.BPF_RET | unix.BPF_K, K: 0xffff},
+	{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+}
+
+// neighborResponder answers ARP and NDP neighbor solicitations for pool
+// IPs on one interface with the interface's own MAC address, so the segment
+// delivers the pool's return traffic to the host without static neighbor
+// entries. The kernel still needs the AnyIP routes to accept it.
+type neighborResponder struct {
+	ifi *net.Interface
+	fd  int
+}
+
+// startNeighborResponder starts answering for pool IPs on iface.
+func startNeighborResponder(iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("invalid -arp-responder interface: %w", err)
+	}
+	if len(ifi.HardwareAddr) != 6 {
+		return fmt.Errorf("-arp-responder interface %s is not Ethernet", iface)
+	}
+	// Open the socket unbound, so no frames queue up before the filter is
+	// attached.
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open AF_PACKET socket (needs CAP_NET_RAW): %w", err)
+	}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(neighborFilter)),
+		Filter: &neighborFilter[0],
+	}); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("failed to attach neighbor filter: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: ifi.Index}); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("failed to bind AF_PACKET socket to %s: %w", iface, err)
+	}
+	// Solicitations go to solicited-node multicast groups the kernel has
+	// not joined for pool IPs; all-multicast lets them in.
+	mreq := unix.PacketMreq{Ifindex: int32(ifi.Index), Type: unix.PACKET_MR_ALLMULTI}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("failed to receive multicast on %s: %w", iface, err)
+	}
+
+	r := &neighborResponder{ifi: ifi, fd: fd}
+	go r.run()
+	sugar.Infow("Answering ARP and NDP for pool IPs", "interface", iface, "mac", ifi.HardwareAddr.String())
+	return nil
+}
+
+func (r *neighborResponder) run() {
+	buf := make([]byte, 1514)
+	for {
+		n, from, err := syscall.Recvfrom(r.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			fatalf("Neighbor responder failed to read frames: %v", err)
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		frame := buf[:n]
+		var reply []byte
+		switch binary.BigEndian.Uint16(frame[12:14]) {
+		case syscall.ETH_P_ARP:
+			reply = r.arpReply(frame)
+		case syscall.ETH_P_IPV6:
+			reply = r.ndpReply(frame)
+		}
+		if reply == nil {
+			continue
+		}
+		if _, err := syscall.Write(r.fd, reply); err != nil {
+			sugar.Debugw("Neighbor responder failed to send reply", "error", err)
+		}
+	}
+}
+
+// arpReply returns the reply to an ARP request for a pool IP in frame, or
+// nil when there is nothing to answer.
+func (r *neighborResponder) arpReply(frame []byte) []byte {
+	if len(frame) < ethHeaderLen+arpPacketLen {
+		return nil
+	}
+	arp := frame[ethHeaderLen:]
+	// Ethernet/IPv4 requests only.
+	if binary.BigEndian.Uint16(arp[0:2]) != 1 || binary.BigEndian.Uint16(arp[2:4]) != syscall.ETH_P_IP ||
+		arp[4] != 6 || arp[5] != 4 || binary.BigEndian.Uint16(arp[6:8]) != 1 {
+		return nil
+	}
+	senderMAC, senderIP, targetIP := arp[8:14], arp[14:18], arp[24:28]
+	// A gratuitous ARP announces the sender's own address; it asks nothing.
+	if net.IP(senderIP).Equal(net.IP(targetIP)) || !anyPoolContains(net.IP(targetIP)) {
+		return nil
+	}
+	reply := make([]byte, ethHeaderLen+arpPacketLen)
+	copy(reply[0:6], senderMAC)
+	copy(reply[6:12], r.ifi.HardwareAddr)
+	binary.BigEndian.PutUint16(reply[12:14], syscall.ETH_P_ARP)
+	a := reply[ethHeaderLen:]
+	copy(a[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(a[6:8], 2)
+	copy(a[8:14], r.ifi.HardwareAddr)
+	copy(a[14:18], targetIP)
+	copy(a[18:24], senderMAC)
+	copy(a[24:28], senderIP)
+	sugar.Debugw("Answered ARP", "ip", net.IP(targetIP).String(), "requester", net.IP(senderIP).String())
+	return reply
+}
+
+// ndpReply returns the neighbor advertisement answering a neighbor
+// solicitation for a pool IP in frame, or nil when there is nothing to
+// answer.
+func (r *neighborResponder) ndpReply(frame []byte) []byte {
+	if len(frame) < ethHeaderLen+ipv6HeaderLen+ndpNSLen {
+		return nil
+	}
+	ip := frame[ethHeaderLen:]
+	icmp := ip[ipv6HeaderLen:]
+	// RFC 4861 7.1.1: only accept solicitations that never left the link.
+	if ip[7] != 255 || icmp[0] != byte(header.ICMPv6NeighborSolicit) || icmp[1] != 0 {
+		return nil
+	}
+	target := net.IP(icmp[8:24])
+	if !anyPoolContains(target) {
+		return nil
+	}
+	src := net.IP(ip[8:24])
+
+	reply := make([]byte, ethHeaderLen+ipv6HeaderLen+ndpNALen)
+	dstIP := src
+	flags := byte(0x60) // solicited, override
+	if src.IsUnspecified() {
+		// Duplicate address detection: tell all nodes the address is taken.
+		dstIP = net.IPv6linklocalallnodes
+		flags = 0x20
+		copy(reply[0:6], []byte{0x33, 0x33, 0, 0, 0, 1})
+	} else {
+		copy(reply[0:6], frame[6:12])
+	}
+	copy(reply[6:12], r.ifi.HardwareAddr)
+	binary.BigEndian.PutUint16(reply[12:14], syscall.ETH_P_IPV6)
+
+	h := reply[ethHeaderLen:]
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:6], ndpNALen)
+	h[6] = syscall.IPPROTO_ICMPV6
+	h[7] = 255
+	copy(h[8:24], target)
+	copy(h[24:40], dstIP)
+
+	na := h[ipv6HeaderLen:]
+	na[0] = byte(header.ICMPv6NeighborAdvert)
+	na[4] = flags
+	copy(na[8:24], target)
+	na[24] = 2 // target link-layer address option
+	na[25] = 1 // in units of 8 bytes
+	copy(na[26:32], r.ifi.HardwareAddr)
+	xsum := header.PseudoHeaderChecksum(header.ICMPv6ProtocolNumber,
+		tcpip.AddrFrom16Slice(target), tcpip.AddrFrom16Slice(dstIP.To16()), ndpNALen)
+	binary.BigEndian.PutUint16(na[2:4], ^checksum.Checksum(na, xsum))
+	sugar.Debugw("Answered NDP", "ip", target.String(), "requester", src.String())
+	return reply
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// pinRule sends dials to dest from src.
+type pinRule struct {
+	dest netip.Prefix
+	src  net.IP
+}
+
+// loadPinRules parses a file of "DEST -> SRC" lines, where DEST is an IP
+// or CIDR and SRC an IP. Blank lines and '#' comments are ignored.
+func loadPinRules(filePath string) ([]pinRule, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pin file '%s': %w", filePath, err)
+	}
+	defer file.Close()
+
+	var rules []pinRule
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rule, err := parsePinRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("pin file '%s' line %d: %w", filePath, lineNumber, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning pin file '%s': %w", filePath, err)
+	}
+	return rules, nil
+}
+
+func parsePinRule(line string) (pinRule, error) {
+	destSpec, srcSpec, ok := strings.Cut(line, "->")
+	if !ok {
+		return pinRule{}, fmt.Errorf("expected DEST -> SRC, got %q", line)
+	}
+	destSpec, srcSpec = strings.TrimSpace(destSpec), strings.TrimSpace(srcSpec)
+	var dest netip.Prefix
+	var err error
+	if strings.Contains(destSpec, "/") {
+		dest, err = netip.ParsePrefix(destSpec)
+	} else {
+		var addr netip.Addr
+		if addr, err = netip.ParseAddr(destSpec); err == nil {
+			dest = netip.PrefixFrom(addr, addr.BitLen())
+		}
+	}
+	if err != nil {
+		return pinRule{}, fmt.Errorf("invalid destination %q: %w", destSpec, err)
+	}
+	src := net.ParseIP(srcSpec)
+	if src == nil {
+		return pinRule{}, fmt.Errorf("invalid source IP %q", srcSpec)
+	}
+	src = normalizeIP(src)
+	if dest.Addr().Unmap().Is4() != (src.To4() != nil) {
+		return pinRule{}, fmt.Errorf("destination %s and source %s are different address families", destSpec, src)
+	}
+	return pinRule{dest: dest.Masked(), src: src}, nil
+}
+
+// destPins holds the -pin-file rules, or nil without one.
+var destPins *pinRules
+
+// pinRules is the reloadable rule set of -pin-file. A dial to a
+// destination matching a rule uses that rule's source IP, the first match
+// winning.
+type pinRules struct {
+	mu    sync.RWMutex
+	path  string
+	rules []pinRule
+}
+
+func newPinRules(path string) (*pinRules, error) {
+	rules, err := loadPinRules(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &pinRules{path: path, rules: rules}
+	p.warnOffPool()
+	return p, nil
+}
+
+// match returns the source IP pinned for destAddr, or nil.
+func (p *pinRules) match(destAddr string) net.IP {
+	host, _, err := net.SplitHostPort(destAddr)
+	if err != nil {
+		host = destAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rule := range p.rules {
+		if rule.dest.Contains(addr) {
+			return rule.src
+		}
+	}
+	return nil
+}
+
+// Reload re-reads the pin file. On failure the previous rules stay in
+// effect.
+func (p *pinRules) Reload() error {
+	rules, err := loadPinRules(p.path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+	p.warnOffPool()
+	sugar.Infow("Reloaded pin rules", "file", p.path, "rules", len(rules))
+	return nil
+}
+
+// warnOffPool warns about rules whose source IP is outside the pool. They
+// are still honored, like -force-ip-off-pool.
+func (p *pinRules) warnOffPool() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rule := range p.rules {
+		if !poolContains(rule.src) {
+			sugar.Warnw("Pin rule source IP is not in the IP pool", "dest", rule.dest.String(), "local_ip", rule.src.String())
+		}
+	}
+}
+
+// pinSelector uses a pinned source IP for destinations with a rule and
+// defers to next otherwise.
+type pinSelector struct {
+	rules *pinRules
+	next  SourceSelector
+}
+
+func (p pinSelector) Select(ctx context.Context, network, destAddr string) (net.IP, error) {
+	if ip := p.rules.match(destAddr); ip != nil {
+		return cloneIP(ip), nil
+	}
+	return p.next.Select(ctx, network, destAddr)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+)
+
+// ipPool is a set of source addresses stored as sorted, disjoint intervals,
+// so a /8 or an IPv6 /64 costs a few words instead of one slice per address.
+// Addresses are numbered from 0 in interval order (IPv4 before IPv6); a
+// random pick draws an offset into the total size and finds its interval
+// with a binary search. A pool is immutable once built, and a nil *ipPool is
+// an empty pool.
+type ipPool struct {
+	ranges  []poolRange
+	size    u128
+	perm    *affinePerm
+	weights *poolWeights
+}
+
+// poolRange is one interval of an ipPool.
+type poolRange struct {
+	ipInterval
+	offset u128 // pool offset of lo
+}
+
+// ipInterval is an inclusive range of addresses of one family. IPv4
+// addresses are held in their IPv4-mapped form.
+type ipInterval struct {
+	lo, hi u128
+	v4     bool
+}
+
+// intervalOf returns the interval from lo to hi, which must be the same
+// family with lo <= hi.
+func intervalOf(lo, hi netip.Addr) ipInterval {
+	return ipInterval{lo: u128From(lo), hi: u128From(hi), v4: lo.Unmap().Is4()}
+}
+
+// singleIP returns the interval holding just ip.
+func singleIP(ip net.IP) ipInterval {
+	addr := addrKey(ip)
+	return intervalOf(addr, addr)
+}
+
+// span is the interval's size minus one, which cannot overflow.
+func (iv ipInterval) span() u128 {
+	return iv.hi.sub(iv.lo)
+}
+
+// before orders intervals by family, IPv4 first, then by start address.
+func (iv ipInterval) before(other ipInterval) bool {
+	if iv.v4 != other.v4 {
+		return iv.v4
+	}
+	return iv.lo.less(other.lo)
+}
+
+// endsBefore reports whether all of iv sorts before all of other.
+func (iv ipInterval) endsBefore(other ipInterval) bool {
+	if iv.v4 != other.v4 {
+		return iv.v4
+	}
+	return iv.hi.less(other.lo)
+}
+
+// ip converts an address of the interval's family to a net.IP, 4 bytes
+// long for IPv4.
+func (iv ipInterval) ip(addr u128) net.IP {
+	if iv.v4 {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(addr.lo))
+		return ip
+	}
+	return addr.ip()
+}
+
+// String formats the interval as a single address or as "lo-hi".
+func (iv ipInterval) String() string {
+	if iv.lo == iv.hi {
+		return iv.ip(iv.lo).String()
+	}
+	return iv.ip(iv.lo).String() + "-" + iv.ip(iv.hi).String()
+}
+
+// prefixes splits the interval into the fewest CIDR prefixes covering it
+// exactly.
+func (iv ipInterval) prefixes() []netip.Prefix {
+	bitLen := 128
+	if iv.v4 {
+		bitLen = 32
+	}
+	var out []netip.Prefix
+	for lo := iv.lo; ; {
+		// Grow the block while lo stays aligned to it and it fits.
+		k := min(lo.trailingZeros(), bitLen)
+		for k > 0 && iv.hi.sub(lo).less(lowMask(k)) {
+			k--
+		}
+		addr := netip.AddrFrom16([16]byte(lo.ip()))
+		if iv.v4 {
+			addr = addr.Unmap()
+		}
+		out = append(out, netip.PrefixFrom(addr, bitLen-k))
+		end := lo.add(lowMask(k))
+		if end == iv.hi {
+			return out
+		}
+		lo = end.add(u128{0, 1})
+	}
+}
+
+// newIPPool builds a pool from intervals in any order, merging overlapping
+// and adjacent ones so each address is counted once.
+func newIPPool(ivs []ipInterval) *ipPool {
+	sorted := append([]ipInterval(nil), ivs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].before(sorted[j]) })
+	merged := sorted[:0]
+	for _, iv := range sorted {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.v4 == iv.v4 && (!last.hi.less(iv.lo) || last.hi.add(u128{0, 1}) == iv.lo) {
+				if last.hi.less(iv.hi) {
+					last.hi = iv.hi
+				}
+				continue
+			}
+		}
+		merged = append(merged, iv)
+	}
+	return poolOf(merged)
+}
+
+// poolOf assigns offsets to intervals that are already sorted and
+// disjoint.
+func poolOf(ivs []ipInterval) *ipPool {
+	p := &ipPool{ranges: make([]poolRange, len(ivs))}
+	for i, iv := range ivs {
+		p.ranges[i] = poolRange{ipInterval: iv, offset: p.size}
+		p.size = p.size.add(iv.span()).add(u128{0, 1})
+	}
+	return p
+}
+
+// intervals returns the pool's merged intervals.
+func (p *ipPool) intervals() []ipInterval {
+	if p == nil {
+		return nil
+	}
+	ivs := make([]ipInterval, len(p.ranges))
+	for i, r := range p.ranges {
+		ivs[i] = r.ipInterval
+	}
+	return ivs
+}
+
+// len returns the number of addresses in the pool, saturating at the
+// largest uint64 for IPv6 pools beyond that.
+func (p *ipPool) len() uint64 {
+	if p == nil {
+		return 0
+	}
+	if p.size.hi > 0 {
+		return math.MaxUint64
+	}
+	return p.size.lo
+}
+
+// total returns the number of addresses in the pool.
+func (p *ipPool) total() u128 {
+	if p == nil {
+		return u128{}
+	}
+	return p.size
+}
+
+// empty reports whether the pool has no addresses.
+func (p *ipPool) empty() bool {
+	return p == nil || len(p.ranges) == 0
+}
+
+// at returns the address at offset off, which must be below the pool size.
+// A shuffled pool permutes offsets first.
+func (p *ipPool) at(off u128) net.IP {
+	if p.perm != nil {
+		off = u128{0, p.perm.apply(off.lo)}
+	}
+	i := sort.Search(len(p.ranges), func(i int) bool { return off.less(p.ranges[i].offset) }) - 1
+	r := p.ranges[i]
+	return r.ip(r.lo.add(off.sub(r.offset)))
+}
+
+// random returns a random address from a non-empty pool, uniformly
+// unless the pool is weighted.
+func (p *ipPool) random(r intSource) net.IP {
+	if p.weights != nil {
+		return p.randomWeighted(r)
+	}
+	if p.size.hi == 0 && p.size.lo <= math.MaxInt {
+		return p.at(u128{0, uint64(r.Intn(int(p.size.lo)))})
+	}
+	return p.at(randBelowOrEqual(p.size.sub(u128{0, 1}), r))
+}
+
+// contains reports whether ip is in the pool.
+func (p *ipPool) contains(ip net.IP) bool {
+	if p == nil {
+		return false
+	}
+	target := singleIP(ip)
+	i := sort.Search(len(p.ranges), func(i int) bool { return target.before(p.ranges[i].ipInterval) }) - 1
+	return i >= 0 && p.ranges[i].v4 == target.v4 && !p.ranges[i].hi.less(target.lo)
+}
+
+// family returns the pool's addresses of family. A single-family pool is
+// returned as is.
+func (p *ipPool) family(family string) *ipPool {
+	if p == nil {
+		return nil
+	}
+	v4 := family == familyIPv4
+	var ivs []ipInterval
+	for _, r := range p.ranges {
+		if r.v4 == v4 {
+			ivs = append(ivs, r.ipInterval)
+		}
+	}
+	if len(ivs) == len(p.ranges) {
+		return p
+	}
+	if p.weights != nil {
+		return poolOf(ivs).weighted(p.weights.entries)
+	}
+	return poolOf(ivs)
+}
+
+// without returns the pool minus every address in ex. Shuffling and
+// weights are not carried over, since they depend on the pool's offsets.
+func (p *ipPool) without(ex []ipInterval) *ipPool {
+	if p == nil || len(ex) == 0 {
+		return p
+	}
+	// Merged exclusions are disjoint and sorted like the pool's ranges, so
+	// one pass over both suffices.
+	merged := newIPPool(ex).intervals()
+	var out []ipInterval
+	j := 0
+	for _, r := range p.ranges {
+		for j < len(merged) && merged[j].endsBefore(r.ipInterval) {
+			j++
+		}
+		cur, done := r.lo, false
+		for _, e := range merged[j:] {
+			if e.v4 != r.v4 || r.hi.less(e.lo) {
+				break
+			}
+			if cur.less(e.lo) {
+				out = append(out, ipInterval{lo: cur, hi: e.lo.sub(u128{0, 1}), v4: r.v4})
+			}
+			if !e.hi.less(r.hi) {
+				done = true
+				break
+			}
+			cur = e.hi.add(u128{0, 1})
+		}
+		if !done {
+			out = append(out, ipInterval{lo: cur, hi: r.hi, v4: r.v4})
+		}
+	}
+	return poolOf(out)
+}
+
+// intersect returns the addresses of p that are also in ivs.
+func (p *ipPool) intersect(ivs []ipInterval) *ipPool {
+	return p.without(p.without(ivs).intervals())
+}
+
+// affinePerm maps offsets below n through i -> (a*i + b) mod n, a bijection
+// when a and n are coprime. It shuffles a pool without listing it.
+type affinePerm struct {
+	a, b, n uint64
+}
+
+func (f *affinePerm) apply(i uint64) uint64 {
+	hi, lo := bits.Mul64(f.a, i)
+	v := bits.Rem64(hi, lo, f.n)
+	v, carry := bits.Add64(v, f.b, 0)
+	if carry != 0 || v >= f.n {
+		v -= f.n
+	}
+	return v
+}
+
+// shuffled returns a copy of the pool whose offsets are permuted by a
+// random affine map, so sequential iteration spreads across the pool
+// instead of walking it in address order. It reports false, returning p,
+// for pools too large to permute.
+func (p *ipPool) shuffled(r intSource) (*ipPool, bool) {
+	if p.empty() || p.size.hi > 0 {
+		return p, false
+	}
+	n := p.size.lo
+	perm := &affinePerm{n: n}
+	if n > 1 {
+		for {
+			perm.a = 1 + randBelowOrEqual(u128{0, n - 2}, r).lo
+			if gcd(perm.a, n) == 1 {
+				break
+			}
+		}
+		perm.b = randBelowOrEqual(u128{0, n - 1}, r).lo
+	}
+	out := *p
+	out.perm = perm
+	return &out, true
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// u128 is an address or offset as a 128-bit unsigned integer.
+type u128 struct {
+	hi, lo uint64
+}
+
+func u128From(addr netip.Addr) u128 {
+	b := addr.As16()
+	return u128{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}
+}
+
+func (u u128) ip() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], u.hi)
+	binary.BigEndian.PutUint64(ip[8:], u.lo)
+	return ip
+}
+
+func (u u128) add(v u128) u128 {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	hi, _ := bits.Add64(u.hi, v.hi, carry)
+	return u128{hi, lo}
+}
+
+func (u u128) sub(v u128) u128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	hi, _ := bits.Sub64(u.hi, v.hi, borrow)
+	return u128{hi, lo}
+}
+
+func (u u128) less(v u128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u u128) trailingZeros() int {
+	if u.lo == 0 {
+		return 64 + bits.TrailingZeros64(u.hi)
+	}
+	return bits.TrailingZeros64(u.lo)
+}
+
+// lowMask returns a u128 with the low k bits set.
+func lowMask(k int) u128 {
+	if k >= 64 {
+		return u128{1<<(k-64) - 1, math.MaxUint64}
+	}
+	return u128{0, 1<<k - 1}
+}
+
+// randUint64 builds 64 random bits from r.
+func randUint64(r intSource) uint64 {
+	return uint64(r.Intn(1<<16))<<48 | uint64(r.Intn(1<<24))<<24 | uint64(r.Intn(1<<24))
+}
+
+// randBelowOrEqual returns a uniform random value in [0, max] by rejection
+// sampling over max's bit length.
+func randBelowOrEqual(max u128, r intSource) u128 {
+	if max.hi == 0 && max.lo < math.MaxInt {
+		return u128{0, uint64(r.Intn(int(max.lo) + 1))}
+	}
+	var hiMask, loMask uint64
+	if max.hi > 0 {
+		hiMask, loMask = 1<<bits.Len64(max.hi)-1, math.MaxUint64
+	} else {
+		loMask = 1<<bits.Len64(max.lo) - 1
+	}
+	for {
+		v := u128{randUint64(r) & hiMask, randUint64(r) & loMask}
+		if !max.less(v) {
+			return v
+		}
+	}
+}
+
+// countString formats an address count for logs, as a power of two when
+// it does not fit in 64 bits.
+func countString(n u128) string {
+	if n.hi == 0 {
+		return strconv.FormatUint(n.lo, 10)
+	}
+	return "~2^" + strconv.Itoa(63+bits.Len64(n.hi))
+}
+
+// count returns the number of addresses in the pool, formatted for logs.
+func (p *ipPool) count() string {
+	return countString(p.total())
+}
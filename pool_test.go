@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// permSizes mixes primes, powers of two and composites, whose many
+// non-coprime multipliers the permutation has to skip.
+var permSizes = []uint64{1, 2, 3, 4, 7, 12, 13, 16, 64, 97, 100, 256, 360, 1021, 1024, 4096, 65521}
+
+func TestAffinePermVisitsEveryIndex(t *testing.T) {
+	for _, n := range permSizes {
+		for seed := int64(1); seed <= 5; seed++ {
+			pool := poolOf([]ipInterval{{lo: u128{0, 0x0a000000}, hi: u128{0, 0x0a000000 + n - 1}, v4: true}})
+			shuffled, ok := pool.shuffled(newLockedRand(seed))
+			if !ok {
+				t.Fatalf("n=%d: pool not shuffled", n)
+			}
+			perm := shuffled.perm
+			if n > 1 && gcd(perm.a, n) != 1 {
+				t.Errorf("n=%d seed=%d: multiplier %d shares a factor with n", n, seed, perm.a)
+			}
+			seen := make([]bool, n)
+			for i := range n {
+				v := perm.apply(i)
+				if v >= n {
+					t.Fatalf("n=%d seed=%d: apply(%d) = %d, out of range", n, seed, i, v)
+				}
+				if seen[v] {
+					t.Fatalf("n=%d seed=%d: index %d visited twice", n, seed, v)
+				}
+				seen[v] = true
+			}
+		}
+	}
+}
+
+func TestAffinePermLargeValues(t *testing.T) {
+	// Near 2^64 the multiplication and the addition both overflow.
+	for _, f := range []affinePerm{
+		{a: 1<<63 + 1, b: 1<<63 - 1, n: 1<<64 - 59},
+		{a: 1<<64 - 1, b: 1<<64 - 60, n: 1<<64 - 59},
+	} {
+		for _, i := range []uint64{0, 1, 2, 1 << 32, f.n - 2, f.n - 1} {
+			if v := f.apply(i); v >= f.n {
+				t.Errorf("%+v: apply(%d) = %d, out of range", f, i, v)
+			}
+		}
+	}
+}
+
+func TestShuffledPoolCoversEveryAddress(t *testing.T) {
+	var ivs []ipInterval
+	for _, spec := range []string{"10.1.0.0/28", "10.1.1.7", "10.1.2.1-10.1.2.9", "2001:db8::/125"} {
+		iv, err := parseInterval(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ivs = append(ivs, iv)
+	}
+	pool := newIPPool(ivs)
+	shuffled, ok := pool.shuffled(newLockedRand(42))
+	if !ok {
+		t.Fatal("pool not shuffled")
+	}
+	n := pool.len()
+	seen := make(map[netip.Addr]bool)
+	inOrder := true
+	for i := range n {
+		ip := shuffled.at(u128{0, i})
+		if !pool.contains(ip) {
+			t.Fatalf("offset %d gives %s, outside the pool", i, ip)
+		}
+		if seen[addrKey(ip)] {
+			t.Fatalf("%s handed out twice", ip)
+		}
+		seen[addrKey(ip)] = true
+		if !ip.Equal(pool.at(u128{0, i})) {
+			inOrder = false
+		}
+	}
+	if uint64(len(seen)) != n {
+		t.Errorf("shuffled pool gave %d addresses, want %d", len(seen), n)
+	}
+	if inOrder {
+		t.Error("shuffled pool walks the addresses in order")
+	}
+}
+
+func TestSamePoolComparesWeights(t *testing.T) {
+	pool := func(lines ...string) *ipPool {
+		var entries []ipEntry
+		for _, line := range lines {
+			e, _, err := parseIPLine(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, e)
+		}
+		return poolOf(entryIntervals(entries)).weighted(entries)
+	}
+	base := pool("10.1.2.0/29", "10.1.2.3,5")
+	tests := []struct {
+		name  string
+		other *ipPool
+		same  bool
+	}{
+		{"identical", pool("10.1.2.0/29", "10.1.2.3,5"), true},
+		{"weight changed", pool("10.1.2.0/29", "10.1.2.3,6"), false},
+		{"weight moved", pool("10.1.2.0/29", "10.1.2.4,5"), false},
+		{"weight dropped", pool("10.1.2.0/29"), false},
+		{"weight added", pool("10.1.2.0/29", "10.1.2.3,5", "10.1.2.6,2"), false},
+		{"addresses changed", pool("10.1.2.0/28", "10.1.2.3,5"), false},
+	}
+	for _, tt := range tests {
+		if got := samePool(base, tt.other); got != tt.same {
+			t.Errorf("%s: samePool = %v, want %v", tt.name, got, tt.same)
+		}
+	}
+	if !samePool(nil, poolOf(nil)) || samePool(nil, base) {
+		t.Error("a nil pool should match only an empty one")
+	}
+}
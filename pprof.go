@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof exposes the net/http/pprof handlers on addr in the background.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			sugar.Errorw("pprof server stopped", "addr", addr, "error", err)
+		}
+	}()
+	sugar.Warnw("PPROF ENDPOINT ENABLED: process internals and command line are exposed without auth",
+		"url", "http://"+addr+"/debug/pprof/",
+	)
+}
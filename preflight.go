@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Preflight check outcomes.
+const (
+	preflightOK      = "ok"
+	preflightWarn    = "warn"
+	preflightSkipped = "skipped"
+)
+
+// preflightCheck is one line of the startup preflight report.
+type preflightCheck struct {
+	name, status, detail string
+}
+
+// preflightOptions says which checks apply to this run.
+type preflightOptions struct {
+	probeIPs      []net.IP // one pool IP per family, as for checkCapabilities
+	canary        string   // -canary, or "" to skip the route check
+	specialPrefix int      // -special-prefix
+	localRoutes   bool     // something other than the host setup makes pool IPs local
+	userspace     bool     // -userspace: connections bypass kernel routing
+}
+
+// runPreflight checks the kernel, the pool, and routing before the proxy
+// serves, and logs one structured line per check followed by a summary.
+// It returns the number of warnings.
+func runPreflight(opts preflightOptions) int {
+	checks := []preflightCheck{
+		preflightKernel(),
+		preflightPool(opts.specialPrefix),
+		preflightLocalRoutes(opts),
+		preflightCanary(opts),
+	}
+	warnings := 0
+	for _, c := range checks {
+		log := sugar.Infow
+		if c.status == preflightWarn {
+			log = sugar.Warnw
+			warnings++
+		}
+		log("Preflight check", "check", c.name, "status", c.status, "detail", c.detail)
+	}
+	sugar.Infow("Preflight report", "checks", len(checks), "warnings", warnings)
+	return warnings
+}
+
+// preflightKernel reports the kernel release and whether freebind is
+// supported natively for every pool family.
+func preflightKernel() preflightCheck {
+	c := preflightCheck{name: "kernel", status: preflightOK}
+	var uts unix.Utsname
+	release := "unknown"
+	if err := unix.Uname(&uts); err == nil {
+		release = unix.ByteSliceToString(uts.Release[:])
+	}
+	c.detail = "Linux " + release
+	if ipv6FreebindMissing {
+		c.status = preflightWarn
+		c.detail += "; no IPV6_FREEBIND (needs 4.15), IPv6 relies on net.ipv6.ip_nonlocal_bind"
+	}
+	return c
+}
+
+// preflightPool flags pool IPs that are poor sources: zero and broadcast
+// addresses of their subnets, loopback, link-local and the like.
+func preflightPool(prefixLen int) preflightCheck {
+	c := preflightCheck{name: "pool", status: preflightOK}
+	pool := currentPool()
+	var found []string
+	for _, hit := range findSpecial(pool, prefixLen) {
+		found = append(found, fmt.Sprintf("%s %s (e.g. %s)", hit.ips.count(), hit.block.reason, hit.ips.at(u128{})))
+	}
+	if len(found) == 0 {
+		c.detail = fmt.Sprintf("%s IPs, all ordinary unicast", pool.count())
+		return c
+	}
+	c.status = preflightWarn
+	c.detail = fmt.Sprintf("%s IPs, including %s; drop them with -strict-special or -exclude", pool.count(), strings.Join(found, ", "))
+	return c
+}
+
+// preflightLocalRoutes checks that the kernel treats the probe IPs as
+// local, so their return traffic is delivered to the proxy rather than
+// dropped or forwarded. A plain bind, without freebind, only succeeds for
+// local addresses.
+func preflightLocalRoutes(opts preflightOptions) preflightCheck {
+	c := preflightCheck{name: "local_routes", status: preflightOK}
+	if opts.localRoutes {
+		c.status, c.detail = preflightSkipped, "pool IPs are made local at startup"
+		return c
+	}
+	if len(opts.probeIPs) == 0 {
+		c.status, c.detail = preflightSkipped, "no pool IP to check"
+		return c
+	}
+	var missing, unknown []string
+	for _, ip := range opts.probeIPs {
+		if v, _ := readSysctl(nonlocalBindSysctl(ip)); v == "1" {
+			// Every bind succeeds, so this check cannot tell.
+			unknown = append(unknown, ip.String())
+			continue
+		}
+		if err := probeBind(ip, false); err != nil {
+			missing = append(missing, ip.String())
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		c.status = preflightWarn
+		c.detail = fmt.Sprintf("no local route for %s; add the AnyIP routes from Host Setup or use -install-routes", strings.Join(missing, ", "))
+	case len(unknown) > 0:
+		c.status = preflightSkipped
+		c.detail = fmt.Sprintf("nonlocal binds are on, cannot check %s", strings.Join(unknown, ", "))
+	default:
+		c.detail = "pool IPs are local"
+	}
+	return c
+}
+
+// preflightCanary checks that the kernel has a route from each probe IP
+// to the -canary destination. Connecting a UDP socket only looks the
+// route up; nothing is sent.
+func preflightCanary(opts preflightOptions) preflightCheck {
+	c := preflightCheck{name: "canary", status: preflightOK}
+	switch {
+	case opts.canary == "":
+		c.status, c.detail = preflightSkipped, "no -canary set"
+		return c
+	case opts.userspace:
+		c.status, c.detail = preflightSkipped, "-userspace does not route through the kernel"
+		return c
+	}
+	addr, err := net.ResolveUDPAddr("udp", canaryAddr(opts.canary))
+	if err != nil {
+		c.status, c.detail = preflightWarn, fmt.Sprintf("cannot resolve -canary: %v", err)
+		return c
+	}
+	var failed []string
+	checked := 0
+	for _, ip := range opts.probeIPs {
+		if (ip.To4() == nil) != (addr.IP.To4() == nil) {
+			continue
+		}
+		checked++
+		if err := routeFrom(ip, addr); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", ip, err))
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		c.status = preflightWarn
+		c.detail = fmt.Sprintf("no route to %s from %s", addr.IP, strings.Join(failed, "; "))
+	case checked == 0:
+		c.status = preflightWarn
+		c.detail = fmt.Sprintf("the pool has no IP of %s's family", addr.IP)
+	default:
+		c.detail = fmt.Sprintf("%s is routable from the pool", addr.IP)
+	}
+	return c
+}
+
+// canaryAddr adds a port to a bare -canary host; the port is only needed
+// for the route lookup.
+func canaryAddr(canary string) string {
+	if _, _, err := net.SplitHostPort(canary); err == nil {
+		return canary
+	}
+	return net.JoinHostPort(strings.Trim(canary, "[]"), "53")
+}
+
+// routeFrom asks the kernel for a route from ip to addr by connecting a
+// freebind UDP socket.
+func routeFrom(ip net.IP, addr *net.UDPAddr) error {
+	d := net.Dialer{LocalAddr: &net.UDPAddr{IP: ip}, Control: controlSocket}
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := d.Dial(network, addr.String())
+	if err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			return errno
+		}
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolFrom lists the load balancers whose connections start with
+// a PROXY protocol header, from -proxy-protocol-from.
+var proxyProtocolFrom []*net.IPNet
+
+// proxyHeaderTimeout bounds how long a load balancer may take to send the
+// PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Sig starts a PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener expects a PROXY protocol header on connections from
+// proxyProtocolFrom and passes others through unchanged.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || !fromLoadBalancer(tcpConn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: tcpConn, r: bufio.NewReader(tcpConn)}, nil
+}
+
+// setProxyProtocolFrom parses the -proxy-protocol-from IPs and CIDRs.
+func setProxyProtocolFrom(specs []string) error {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return fmt.Errorf("invalid -proxy-protocol-from address %q", spec)
+			}
+			bits := 8 * len(normalizeIP(ip))
+			spec = fmt.Sprintf("%s/%d", spec, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return fmt.Errorf("invalid -proxy-protocol-from entry %q: %w", spec, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	proxyProtocolFrom = nets
+	return nil
+}
+
+func fromLoadBalancer(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range proxyProtocolFrom {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a load balancer connection whose PROXY header is read on
+// first use. RemoteAddr then reports the client the header names. It
+// deliberately embeds net.Conn rather than *net.TCPConn, so io.Copy cannot
+// bypass the buffered reader through TCPConn.WriteTo.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("invalid PROXY protocol header from %v: %w", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client named by the PROXY header, or the load
+// balancer's address when the header names none or is invalid.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) CloseWrite() error {
+	return c.Conn.(*net.TCPConn).CloseWrite()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the
+// source address it carries, or nil for a v1 UNKNOWN or v2 LOCAL header.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(peek, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, errors.New("no PROXY protocol signature")
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6|UNKNOWN SRC DST SPORT DPORT\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including the CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("v1 header is not terminated by CRLF")
+	}
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", text)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address in %q", text)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary v2 header, skipping any TLVs.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xf == 0 { // LOCAL, e.g. a load balancer health check
+		return nil, nil
+	}
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// sendProxyRule selects destinations that get a PROXY protocol header
+// from -send-proxy: a prefix and optionally a port (0 for any).
+type sendProxyRule struct {
+	dest netip.Prefix
+	port int
+}
+
+// Outbound PROXY protocol settings, from -send-proxy and
+// -send-proxy-version.
+var (
+	sendProxyRules   []sendProxyRule
+	sendProxyVersion = 1
+)
+
+// parseSendProxy parses -send-proxy entries, each an IP or CIDR with an
+// optional :PORT (e.g. 10.2.0.0/16, 10.3.1.5:443, [2001:db8::/32]:443).
+func parseSendProxy(specs []string) ([]sendProxyRule, error) {
+	var rules []sendProxyRule
+	for _, spec := range specs {
+		host, port := spec, 0
+		if h, p, err := net.SplitHostPort(spec); err == nil {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 1 || n > 65535 {
+				return nil, fmt.Errorf("invalid -send-proxy port in %q", spec)
+			}
+			host, port = h, n
+		}
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(host, "/") {
+			prefix, err = netip.ParsePrefix(host)
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(host); err == nil {
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid -send-proxy destination %q: %w", spec, err)
+		}
+		rules = append(rules, sendProxyRule{dest: prefix.Masked(), port: port})
+	}
+	return rules, nil
+}
+
+// wantsProxyHeader reports whether a connection to remote gets a PROXY
+// header.
+func wantsProxyHeader(remote *net.TCPAddr) bool {
+	addr, ok := netip.AddrFromSlice(remote.IP)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, rule := range sendProxyRules {
+		if rule.dest.Contains(addr) && (rule.port == 0 || rule.port == remote.Port) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProxyHeader sends a PROXY protocol header naming the connection's
+// own (spoofed) source as the client, in -send-proxy-version.
+func writeProxyHeader(w io.Writer, src, dst *net.TCPAddr) error {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	v4 := srcIP != nil && dstIP != nil
+	if !v4 {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	var hdr []byte
+	if sendProxyVersion == 2 {
+		hdr = append(hdr, proxyV2Sig...)
+		hdr = append(hdr, 0x21) // version 2, PROXY
+		if v4 {
+			hdr = append(hdr, 0x11)
+		} else {
+			hdr = append(hdr, 0x21)
+		}
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(2*len(srcIP)+4))
+		hdr = append(append(hdr, srcIP...), dstIP...)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(src.Port))
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(dst.Port))
+	} else {
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		hdr = fmt.Appendf(hdr, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, src.Port, dst.Port)
+	}
+	_, err := w.Write(hdr)
+	return err
+}
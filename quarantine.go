@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Adaptive quarantine settings. Every dial from a source IP within
+// quarantineWindow is counted; once an IP has made at least
+// quarantineMinDials of them and the failed fraction reaches
+// quarantineRate, it is left out of selection for quarantineTime. Unlike
+// -cooldown, a single unlucky failure does not sideline an otherwise
+// healthy IP. A zero rate disables quarantine.
+var (
+	quarantineRate     float64
+	quarantineMinDials = 5
+	quarantineWindow   = 5 * time.Minute
+	quarantineTime     = 2 * time.Minute
+)
+
+var quarantineTrips = newCounter("scoreproxy_quarantines_total", "Times a source IP was quarantined for a high dial failure rate.")
+
+// dialOutcome is one counted dial.
+type dialOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// dialHealth tracks the recent dials of one source IP.
+type dialHealth struct {
+	dials []dialOutcome // within the current window, oldest first
+	until time.Time     // end of the current quarantine
+}
+
+var (
+	quarantineMu    sync.Mutex
+	dialStats       = make(map[netip.Addr]*dialHealth)
+	quarantineSwept time.Time
+)
+
+// recordDial counts a dial from ip, quarantining ip once its failure rate
+// crosses the threshold. History is kept only while an IP's window holds a
+// failure or it is quarantined: a success from an IP without one is not
+// recorded, and IPs whose failures have all left the window are swept, so
+// the table stays as small as the set of failing IPs.
+func recordDial(ip net.IP, failed bool) {
+	if quarantineRate <= 0 {
+		return
+	}
+	now := time.Now()
+	key := addrKey(ip)
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	if now.Sub(quarantineSwept) > quarantineWindow {
+		for k, h := range dialStats {
+			if h.idle(now) {
+				delete(dialStats, k)
+			}
+		}
+		quarantineSwept = now
+	}
+	h := dialStats[key]
+	if h != nil && !failed && h.idle(now) {
+		delete(dialStats, key)
+		h = nil
+	}
+	if h == nil {
+		if !failed {
+			return
+		}
+		h = &dialHealth{}
+		dialStats[key] = h
+	}
+	h.prune(now)
+	h.dials = append(h.dials, dialOutcome{at: now, failed: failed})
+	if !failed || now.Before(h.until) || len(h.dials) < quarantineMinDials {
+		return
+	}
+	failures := h.failures()
+	rate := float64(failures) / float64(len(h.dials))
+	if rate < quarantineRate {
+		return
+	}
+	h.until = now.Add(quarantineTime)
+	quarantineTrips.Inc()
+	sugar.Warnw("Quarantining source IP after repeated dial failures",
+		"local_ip", ip.String(),
+		"failures", failures,
+		"dials", len(h.dials),
+		"window", quarantineWindow,
+		"quarantine", quarantineTime,
+	)
+}
+
+// quarantined reports whether ip is quarantined, re-admitting it with a
+// clean history once its quarantine has passed.
+func quarantined(ip net.IP) bool {
+	if quarantineRate <= 0 {
+		return false
+	}
+	key := addrKey(ip)
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	h, ok := dialStats[key]
+	if !ok || h.until.IsZero() {
+		return false
+	}
+	if time.Now().Before(h.until) {
+		return true
+	}
+	// The failures that caused the quarantine would otherwise send the IP
+	// straight back on its next failure.
+	delete(dialStats, key)
+	sugar.Infow("Quarantine over, source IP back in selection", "local_ip", ip.String())
+	return false
+}
+
+// prune drops dials that have left the window.
+func (h *dialHealth) prune(now time.Time) {
+	cutoff := now.Add(-quarantineWindow)
+	i := 0
+	for i < len(h.dials) && h.dials[i].at.Before(cutoff) {
+		i++
+	}
+	h.dials = h.dials[i:]
+}
+
+// idle prunes h and reports whether it no longer holds a failure or a
+// running quarantine.
+func (h *dialHealth) idle(now time.Time) bool {
+	h.prune(now)
+	return !now.Before(h.until) && h.failures() == 0
+}
+
+func (h *dialHealth) failures() int {
+	n := 0
+	for _, d := range h.dials {
+		if d.failed {
+			n++
+		}
+	}
+	return n
+}
+
+// quarantineStatus is one source IP's dial health as shown by the admin
+// API.
+type quarantineStatus struct {
+	SourceIP         string     `json:"source_ip"`
+	RecentDials      int        `json:"recent_dials"`
+	RecentFailures   int        `json:"recent_failures"`
+	Quarantined      bool       `json:"quarantined"`
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+}
+
+// quarantineSnapshot returns the state of every source IP with recent
+// failed dials or an active quarantine, sorted by IP.
+func quarantineSnapshot() []quarantineStatus {
+	now := time.Now()
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	out := make([]quarantineStatus, 0, len(dialStats))
+	for key, h := range dialStats {
+		h.prune(now)
+		active := now.Before(h.until)
+		failures := h.failures()
+		if !active && failures == 0 {
+			continue
+		}
+		s := quarantineStatus{SourceIP: key.String(), RecentDials: len(h.dials), RecentFailures: failures, Quarantined: active}
+		if active {
+			until := h.until
+			s.QuarantinedUntil = &until
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return netip.MustParseAddr(out[i].SourceIP).Less(netip.MustParseAddr(out[j].SourceIP))
+	})
+	return out
+}
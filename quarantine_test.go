@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// useQuarantine enables quarantine with the given rate and window for the
+// rest of the test, starting from an empty history.
+func useQuarantine(t *testing.T, rate float64, window time.Duration) {
+	t.Helper()
+	prevRate, prevMin, prevWindow := quarantineRate, quarantineMinDials, quarantineWindow
+	reset := func() {
+		quarantineMu.Lock()
+		dialStats = make(map[netip.Addr]*dialHealth)
+		quarantineSwept = time.Time{}
+		quarantineMu.Unlock()
+	}
+	t.Cleanup(func() {
+		quarantineRate, quarantineMinDials, quarantineWindow = prevRate, prevMin, prevWindow
+		reset()
+	})
+	reset()
+	quarantineRate, quarantineMinDials, quarantineWindow = rate, 4, window
+}
+
+func trackedIPs() int {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	return len(dialStats)
+}
+
+func TestRecordDialSuccessesNotTracked(t *testing.T) {
+	useQuarantine(t, 0.5, time.Minute)
+	for i := range 1000 {
+		recordDial(net.IPv4(10, 60, byte(i>>8), byte(i)), false)
+	}
+	if n := trackedIPs(); n != 0 {
+		t.Errorf("tracking %d IPs after only successful dials, want 0", n)
+	}
+	ip := net.IPv4(10, 60, 0, 1)
+	if allocs := testing.AllocsPerRun(100, func() { recordDial(ip, false) }); allocs != 0 {
+		t.Errorf("successful dial allocated %v times, want 0", allocs)
+	}
+}
+
+func TestRecordDialQuarantines(t *testing.T) {
+	useQuarantine(t, 0.5, time.Minute)
+	ip := net.IPv4(10, 60, 0, 1)
+	recordDial(ip, true)
+	recordDial(ip, false)
+	recordDial(ip, true)
+	if quarantined(ip) {
+		t.Fatal("quarantined before -quarantine-min-dials")
+	}
+	recordDial(ip, true)
+	if !quarantined(ip) {
+		t.Error("3 failures in 4 dials did not quarantine at a rate of 0.5")
+	}
+}
+
+func TestRecordDialSweepsRecoveredIPs(t *testing.T) {
+	useQuarantine(t, 0.5, 20*time.Millisecond)
+	for i := range 100 {
+		recordDial(net.IPv4(10, 60, 0, byte(i)), true)
+	}
+	if n := trackedIPs(); n != 100 {
+		t.Fatalf("tracking %d IPs after 100 failures, want 100", n)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// A success from a recovered IP drops its history, and any dial once
+	// the window has passed sweeps the rest.
+	recordDial(net.IPv4(10, 60, 0, 1), false)
+	if n := trackedIPs(); n != 0 {
+		t.Errorf("tracking %d IPs whose failures left the window, want 0", n)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+)
+
+// intSource yields uniform random integers in [0, n). Source IP selection
+// draws from an intSource so the randomness backend is swappable.
+type intSource interface {
+	Intn(n int) int
+}
+
+var (
+	_ intSource = (*rand.Rand)(nil)
+	_ intSource = cryptoSource{}
+	_ intSource = (*lockedRand)(nil)
+)
+
+// lockedRand is a seeded math/rand source that is safe for concurrent
+// dials; *rand.Rand on its own is not.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+// cryptoSource draws from crypto/rand so source IP choice is unpredictable.
+// It is considerably slower than math/rand.
+type cryptoSource struct{}
+
+func (cryptoSource) Intn(n int) int {
+	if n <= 0 {
+		panic("cryptoSource.Intn: invalid argument")
+	}
+	// Rejection sampling avoids modulo bias.
+	bound := uint64(n)
+	limit := ^uint64(0) - (^uint64(0) % bound)
+	var buf [8]byte
+	for {
+		if _, err := crand.Read(buf[:]); err != nil {
+			panic("crypto/rand read failed: " + err.Error())
+		}
+		v := binary.LittleEndian.Uint64(buf[:])
+		if v < limit {
+			return int(v % bound)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+// randSources are the selector's randomness backends, as chosen by
+// -crypto-rand.
+var randSources = []struct {
+	name string
+	src  intSource
+}{
+	{"math", newLockedRand(1)},
+	{"crypto", cryptoSource{}},
+}
+
+// BenchmarkIntn compares one draw from each randomness source.
+func BenchmarkIntn(b *testing.B) {
+	for _, s := range randSources {
+		b.Run(s.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				s.src.Intn(1000)
+			}
+		})
+	}
+}
+
+// BenchmarkIntnParallel compares the sources under concurrent dials, where
+// lockedRand's mutex is contended.
+func BenchmarkIntnParallel(b *testing.B) {
+	for _, s := range randSources {
+		b.Run(s.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.src.Intn(1000)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSelectRandSource measures a whole random pick from a 1k pool
+// with each source.
+func BenchmarkSelectRandSource(b *testing.B) {
+	for _, s := range randSources {
+		b.Run(s.name, func(b *testing.B) {
+			usePool(b, "10.30.0.0-10.30.3.231")
+			useSelection(b, selectRandom, distUniform)
+			prev := localRand
+			b.Cleanup(func() { localRand = prev })
+			localRand = s.src
+			b.ReportAllocs()
+			for range b.N {
+				randomIP("tcp", "192.0.2.1:80")
+			}
+		})
+	}
+}
+
+func TestCryptoSourceRange(t *testing.T) {
+	for _, n := range []int{1, 2, 7, 1000} {
+		for range 200 {
+			if v := (cryptoSource{}).Intn(n); v < 0 || v >= n {
+				t.Fatalf("Intn(%d) = %d, out of range", n, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// connRecord describes one dial attempt and, if it succeeded, the life of
+// the resulting connection.
+type connRecord struct {
+	SourceIP      string     `json:"source_ip"`
+	Dest          string     `json:"dest"`
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end,omitempty"`
+	BytesSent     uint64     `json:"bytes_sent"`
+	BytesReceived uint64     `json:"bytes_received"`
+	Reason        string     `json:"reason"`
+	ClientTag     string     `json:"client_tag,omitempty"`
+}
+
+// recentBuffer is a fixed-size ring of the most recent connection records.
+type recentBuffer struct {
+	mu      sync.Mutex
+	records []connRecord
+	next    int
+	full    bool
+}
+
+func newRecentBuffer(size int) *recentBuffer {
+	return &recentBuffer{records: make([]connRecord, size)}
+}
+
+func (b *recentBuffer) add(rec connRecord) {
+	if b == nil || len(b.records) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records[b.next] = rec
+	b.next = (b.next + 1) % len(b.records)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// snapshot returns the buffered records, newest first.
+func (b *recentBuffer) snapshot() []connRecord {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.next
+	if b.full {
+		n = len(b.records)
+	}
+	out := make([]connRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, b.records[(b.next-i+len(b.records))%len(b.records)])
+	}
+	return out
+}
+
+// recentConns holds the last -recent-buffer connection records.
+var recentConns *recentBuffer
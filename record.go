@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Decision traces record, for every customDialer call, which source IPs
+// were picked, how many attempts it took and how it ended. -record writes
+// them as JSON lines; the tests feed traces kept in testdata back through
+// the selector with the recorded seed and fail on any pick that comes out
+// differently.
+//
+// Picks are numbered globally, so a replay follows the order in which the
+// selector actually ran. Replays are exact for runs whose picks did not
+// race each other, e.g. a single client making one request at a time.
+
+// traceHeader is the first line of a trace.
+type traceHeader struct {
+	Seed      int64    `json:"seed"`
+	Pool      []string `json:"pool"`
+	PoolSize  uint64   `json:"pool_size"`
+	Selection string   `json:"selection"`
+	Cooldown  string   `json:"cooldown,omitempty"`
+}
+
+// dialTrace is one customDialer call.
+type dialTrace struct {
+	Start     time.Time     `json:"start"`
+	Network   string        `json:"network"`
+	Dest      string        `json:"dest"`
+	ClientTag string        `json:"client_tag,omitempty"`
+	Attempts  []attemptInfo `json:"attempts"`
+	Outcome   string        `json:"outcome"`
+}
+
+// attemptInfo is one dial attempt within a dialTrace.
+type attemptInfo struct {
+	Pick     uint64 `json:"pick"`
+	SourceIP string `json:"source_ip"`
+	Hinted   bool   `json:"hinted,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	recordMu  sync.Mutex
+	recordEnc *json.Encoder
+	pickSeq   atomic.Uint64
+)
+
+// startRecording creates path and writes the trace header. Traces are
+// appended as dials finish.
+func startRecording(path string, header traceHeader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create trace file: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	if err := enc.Encode(header); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write trace header: %w", err)
+	}
+	recordMu.Lock()
+	recordEnc = enc
+	recordMu.Unlock()
+	return nil
+}
+
+// newDialTrace returns a trace for one dial, or nil when not recording.
+func newDialTrace(ctx context.Context, network, addr string) *dialTrace {
+	recordMu.Lock()
+	recording := recordEnc != nil
+	recordMu.Unlock()
+	if !recording {
+		return nil
+	}
+	return &dialTrace{Start: time.Now(), Network: network, Dest: addr, ClientTag: clientTag(ctx)}
+}
+
+// attempt notes that ip was picked for the next dial attempt. It is
+// called right after selection so pick numbers follow selection order. A
+// nil trace ignores the call.
+func (t *dialTrace) attempt(ip net.IP, hinted bool) {
+	if t == nil {
+		return
+	}
+	a := attemptInfo{Pick: pickSeq.Add(1), Hinted: hinted}
+	if ip != nil {
+		a.SourceIP = ip.String()
+	}
+	t.Attempts = append(t.Attempts, a)
+}
+
+// attemptFailed records err against the latest attempt. A nil trace
+// ignores the call.
+func (t *dialTrace) attemptFailed(err error) {
+	if t == nil || len(t.Attempts) == 0 {
+		return
+	}
+	t.Attempts[len(t.Attempts)-1].Error = err.Error()
+}
+
+// finish writes the trace with its outcome. A nil trace ignores the call.
+func (t *dialTrace) finish(err error) {
+	if t == nil {
+		return
+	}
+	t.Outcome = "ok"
+	if err != nil {
+		t.Outcome = err.Error()
+	}
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	if err := recordEnc.Encode(t); err != nil {
+		sugar.Warnw("Failed writing decision trace", "error", err)
+	}
+}
+
+func withDialTrace(ctx context.Context, t *dialTrace) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxDialTrace, t)
+}
+
+func dialTraceFrom(ctx context.Context) *dialTrace {
+	t, _ := ctx.Value(ctxDialTrace).(*dialTrace)
+	return t
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// loadTrace reads a trace written by -record.
+func loadTrace(path string) (traceHeader, []dialTrace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return traceHeader{}, nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var header traceHeader
+	if err := dec.Decode(&header); err != nil {
+		return traceHeader{}, nil, fmt.Errorf("failed to read trace header: %w", err)
+	}
+	var traces []dialTrace
+	for dec.More() {
+		var t dialTrace
+		if err := dec.Decode(&t); err != nil {
+			return traceHeader{}, nil, fmt.Errorf("failed to read trace %d: %w", len(traces)+1, err)
+		}
+		traces = append(traces, t)
+	}
+	return header, traces, nil
+}
+
+// replaySetup points the selector at the trace's pool, selection and
+// cooldown, seeded as the recorded run was, and restores the previous
+// state when the test ends.
+func replaySetup(t *testing.T, header traceHeader) {
+	t.Helper()
+	var ivs []ipInterval
+	for _, spec := range header.Pool {
+		iv, err := parseInterval(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ivs = append(ivs, iv)
+	}
+	cooldown := time.Duration(0)
+	if header.Cooldown != "" {
+		var err error
+		if cooldown, err = time.ParseDuration(header.Cooldown); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prevPool, prevMode, prevCooldown, prevRand, prevSelector := currentPool(), selectionMode, sourceCooldown, localRand, sourceSelector
+	t.Cleanup(func() {
+		activePool.Store(prevPool)
+		resetCoverage()
+		selectionMode, sourceCooldown, localRand, sourceSelector = prevMode, prevCooldown, prevRand, prevSelector
+		cooldownMu.Lock()
+		cooldownUntil = make(map[netip.Addr]time.Time)
+		cooldownMu.Unlock()
+	})
+	if err := setPool(newIPPool(ivs)); err != nil {
+		t.Fatal(err)
+	}
+	selectionMode, sourceCooldown = header.Selection, cooldown
+	localRand = newLockedRand(header.Seed)
+	sourceSelector = newSourceSelector()
+}
+
+// replayTrace re-runs the selector over every recorded pick in order,
+// mirroring recorded failures into the cooldown state, and reports each
+// pick that comes out differently.
+func replayTrace(t *testing.T, traces []dialTrace) {
+	t.Helper()
+	type pick struct {
+		attemptInfo
+		network string
+		dest    string
+	}
+	var picks []pick
+	for _, tr := range traces {
+		for _, a := range tr.Attempts {
+			picks = append(picks, pick{a, tr.Network, tr.Dest})
+		}
+	}
+	sort.Slice(picks, func(i, j int) bool { return picks[i].Pick < picks[j].Pick })
+
+	checked := 0
+	for _, p := range picks {
+		if p.Hinted {
+			continue
+		}
+		checked++
+		got := randomIP(p.network, p.dest)
+		gotStr := ""
+		if got != nil {
+			gotStr = got.String()
+		}
+		if gotStr != p.SourceIP {
+			t.Errorf("pick %d to %s: selected %q, trace recorded %q", p.Pick, p.dest, gotStr, p.SourceIP)
+		}
+		if p.Error != "" && got != nil {
+			markSourceFailed(got)
+		}
+	}
+	if checked == 0 {
+		t.Error("trace has no picks to replay")
+	}
+}
+
+func TestReplayTraces(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.trace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no traces in testdata")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			header, traces, err := loadTrace(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replaySetup(t, header)
+			replayTrace(t, traces)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Behaviors for -resolve, which decides who resolves hostnames sent by
+// SOCKS5 clients and so which source IP the DNS lookup leaves from.
+const (
+	resolveSystem = "system" // the proxy resolves with the host's resolver and address
+	resolvePool   = "pool"   // the proxy resolves, sending DNS from a pool IP
+	resolveClient = "client" // hostnames are rejected; clients send IP literals
+)
+
+var resolveMode = resolveSystem
+
+// poolResolver is a socks5.NameResolver whose DNS traffic egresses from a
+// pool IP, like the connection that follows it.
+type poolResolver struct {
+	r *net.Resolver
+}
+
+func newPoolResolver() poolResolver {
+	return poolResolver{r: &net.Resolver{PreferGo: true, Dial: dialDNS}}
+}
+
+func (p poolResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	// Only ask for address families the pool can dial from.
+	network := "ip"
+	pool := currentPool()
+	switch has4, has6 := hasFamily(pool, familyIPv4), hasFamily(pool, familyIPv6); {
+	case !has6:
+		network = "ip4"
+	case !has4:
+		network = "ip6"
+	}
+	ips, err := p.r.LookupIP(ctx, network, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+// dialDNS dials a DNS server from a source IP picked the same way as for
+// proxied connections.
+func dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	localIP := randomIP(network, address)
+	if localIP == nil {
+		return nil, fmt.Errorf("dns dial: %w", errNoAvailableIP)
+	}
+	var localAddr net.Addr = &net.UDPAddr{IP: localIP}
+	if strings.HasPrefix(network, "tcp") {
+		localAddr = &net.TCPAddr{IP: localIP}
+	}
+	dialer := &net.Dialer{
+		LocalAddr: localAddr,
+		Timeout:   dialTimeout,
+		Control:   controlSocket,
+	}
+	if logLevel.Enabled(zap.DebugLevel) {
+		connLog(ctx).Debugw("Resolving from pool IP",
+			"network", network,
+			"dns_server", address,
+			"local_ip", localIP.String(),
+		)
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("dns dial from %s: %w", localIP, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"go.uber.org/zap"
+)
+
+// tunnelHello starts a reverse tunnel, followed by the -reverse-token and a
+// newline.
+const tunnelHello = "SCOREPROXY-TUNNEL "
+
+// Reverse tunnel reconnect backoff bounds.
+const (
+	reverseBackoffMin = time.Second
+	reverseBackoffMax = time.Minute
+)
+
+// reverseTarget is a parsed -reverse relay: its address and, for tls://,
+// the client TLS configuration.
+type reverseTarget struct {
+	addr string
+	tls  *tls.Config
+}
+
+// parseReverse parses -reverse, a tcp:// or tls:// relay URL. A tls://
+// relay is verified against caFile, or the system roots when it is empty.
+func parseReverse(raw, caFile string) (*reverseTarget, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -reverse %q: %w", raw, err)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("invalid -reverse %q: missing port", raw)
+	}
+	t := &reverseTarget{addr: u.Host}
+	switch u.Scheme {
+	case "tcp":
+		if caFile != "" {
+			return nil, errors.New("-reverse-ca needs a tls:// relay")
+		}
+	case "tls":
+		t.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read -reverse-ca '%s': %w", caFile, err)
+			}
+			t.tls.RootCAs = x509.NewCertPool()
+			if !t.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no PEM certificates found in -reverse-ca '%s'", caFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid -reverse scheme %q (want tcp or tls)", u.Scheme)
+	}
+	return t, nil
+}
+
+// yamuxConfig returns the tunnel session settings, logging through zap.
+func yamuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = nil
+	cfg.Logger = zap.NewStdLog(sugar.Desugar().Named("yamux"))
+	return cfg
+}
+
+// runReverse keeps a tunnel to the relay open until shutdown is closed,
+// serving SOCKS on every stream the relay opens over it. Lost or failed
+// tunnels are re-dialed with backoff.
+func runReverse(server *socksServer, target *reverseTarget, token string, shutdown <-chan struct{}) {
+	backoff := reverseBackoffMin
+	for {
+		sess, err := dialReverse(target, token)
+		if err == nil {
+			backoff = reverseBackoffMin
+			sugar.Infow("Reverse tunnel established", "relay_addr", target.addr)
+			stop := make(chan struct{})
+			go func() {
+				select {
+				case <-shutdown:
+					sess.Close()
+				case <-stop:
+				}
+			}()
+			err = serve(server, sess)
+			close(stop)
+			sess.Close()
+		}
+		select {
+		case <-shutdown:
+			return
+		default:
+		}
+		sugar.Warnw("Reverse tunnel down, reconnecting", "relay_addr", target.addr, "error", err, "retry_in", backoff)
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, reverseBackoffMax)
+	}
+}
+
+// dialReverse connects to the relay and opens the tunnel session. The
+// relay opens the streams, so this end is the yamux server.
+func dialReverse(target *reverseTarget, token string) (*yamux.Session, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if target.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", target.addr, target.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", target.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial relay: %w", err)
+	}
+	if _, err := io.WriteString(conn, tunnelHello+token+"\n"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send tunnel hello: %w", err)
+	}
+	sess, err := yamux.Server(conn, yamuxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// runRelay is the relay subcommand: it accepts a tunnel from a -reverse
+// proxy on tunnelAddr and forwards each client of the SOCKS listener on
+// socksAddr over it as a new stream. A newer tunnel replaces an older one.
+// -tls-cert secures the tunnel listener only.
+func runRelay(tunnelAddr, socksAddr, token string) error {
+	var current atomic.Pointer[yamux.Session]
+
+	tl, err := listen("tcp", tunnelAddr, "")
+	if err != nil {
+		return err
+	}
+	network, address := splitListenAddr(socksAddr)
+	sl, err := listenPlain(network, address, "")
+	if err != nil {
+		tl.Close()
+		return err
+	}
+	sugar.Infow("Relay started", "tunnel_addr", tunnelAddr, "socks_addr", socksAddr)
+
+	go func() {
+		for {
+			conn, err := tl.Accept()
+			if err != nil {
+				fatalf("Tunnel listener failed: %v", err)
+			}
+			go func() {
+				if err := readTunnelHello(conn, token); err != nil {
+					sugar.Warnw("Rejecting tunnel", "proxy_addr", conn.RemoteAddr().String(), "error", err)
+					conn.Close()
+					return
+				}
+				sess, err := yamux.Client(conn, yamuxConfig())
+				if err != nil {
+					conn.Close()
+					return
+				}
+				if old := current.Swap(sess); old != nil {
+					old.Close()
+					sugar.Warnw("Replaced existing tunnel", "proxy_addr", conn.RemoteAddr().String())
+				} else {
+					sugar.Infow("Tunnel connected", "proxy_addr", conn.RemoteAddr().String())
+				}
+				<-sess.CloseChan()
+				if current.CompareAndSwap(sess, nil) {
+					sugar.Warnw("Tunnel disconnected", "proxy_addr", conn.RemoteAddr().String())
+				}
+			}()
+		}
+	}()
+
+	for {
+		client, err := sl.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer client.Close()
+			sess := current.Load()
+			if sess == nil {
+				sugar.Warnw("No tunnel connected, closing client", "client_addr", client.RemoteAddr().String())
+				return
+			}
+			stream, err := sess.Open()
+			if err != nil {
+				sugar.Warnw("Failed to open tunnel stream", "client_addr", client.RemoteAddr().String(), "error", err)
+				return
+			}
+			defer stream.Close()
+			done := make(chan struct{})
+			go func() {
+				io.Copy(stream, client)
+				stream.Close()
+				close(done)
+			}()
+			io.Copy(client, stream)
+			client.Close()
+			<-done
+		}()
+	}
+}
+
+// readTunnelHello checks the hello line a proxy starts its tunnel with.
+// It reads a byte at a time so no session data is buffered away.
+func readTunnelHello(conn net.Conn, token string) error {
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var line []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\n")) {
+		if len(line) > 1024 {
+			return errors.New("tunnel hello too long")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return fmt.Errorf("failed to read tunnel hello: %w", err)
+		}
+		line = append(line, b[0])
+	}
+	got, ok := bytes.CutPrefix(bytes.TrimSuffix(line, []byte("\n")), []byte(tunnelHello))
+	if !ok {
+		return errors.New("not a scoreproxy tunnel")
+	}
+	if subtle.ConstantTimeCompare(got, []byte(token)) != 1 {
+		return errors.New("wrong -reverse-token")
+	}
+	return nil
+}
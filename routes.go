@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// anyIPRoutes are the AnyIP local routes -install-routes added, which are
+// removed again on Close. Routes that already existed are left alone.
+type anyIPRoutes struct {
+	fd    int
+	lo    int // loopback interface index
+	seq   uint32
+	added []netip.Prefix
+}
+
+// installAnyIPRoutes adds the equivalent of
+//
+//	ip route add local PREFIX dev lo
+//
+// for each of prefixes over rtnetlink, so the kernel accepts traffic to
+// every address in them.
+func installAnyIPRoutes(prefixes []netip.Prefix) (*anyIPRoutes, error) {
+	lo, err := loopbackIndex()
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+	r := &anyIPRoutes{fd: fd, lo: lo}
+	existing := 0
+	for _, p := range prefixes {
+		err := r.request(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, p)
+		switch {
+		case errors.Is(err, unix.EEXIST):
+			existing++
+		case err != nil:
+			r.Close()
+			return nil, fmt.Errorf("failed to add local route for %s (needs CAP_NET_ADMIN): %w", p, err)
+		default:
+			r.added = append(r.added, p)
+		}
+	}
+	sugar.Infow("Installed AnyIP local routes", "added", len(r.added), "already_present", existing)
+	return r, nil
+}
+
+// poolPrefixes returns the CIDR prefixes covering the active pool and the
+// extra listeners' pools.
+func poolPrefixes() []netip.Prefix {
+	ivs := currentPool().intervals()
+	for _, lp := range extraListeners {
+		ivs = append(ivs, lp.pool.intervals()...)
+	}
+	var prefixes []netip.Prefix
+	for _, iv := range newIPPool(ivs).intervals() {
+		prefixes = append(prefixes, iv.prefixes()...)
+	}
+	return prefixes
+}
+
+// Close removes the routes installed by installAnyIPRoutes.
+func (r *anyIPRoutes) Close() {
+	for _, p := range r.added {
+		if err := r.request(unix.RTM_DELROUTE, 0, p); err != nil {
+			sugar.Warnw("Failed to remove local route", "prefix", p.String(), "error", err)
+		}
+	}
+	if len(r.added) > 0 {
+		sugar.Infow("Removed AnyIP local routes", "count", len(r.added))
+	}
+	r.added = nil
+	unix.Close(r.fd)
+}
+
+// request sends one route message for a local route to p via lo in the
+// local table and waits for the kernel's acknowledgement.
+func (r *anyIPRoutes) request(msgType uint16, flags uint16, p netip.Prefix) error {
+	family := byte(unix.AF_INET6)
+	if p.Addr().Is4() {
+		family = unix.AF_INET
+	}
+	dst := p.Addr().AsSlice()
+
+	msg := make([]byte, unix.SizeofNlMsghdr, 64)
+	msg = append(msg, rtMsgBytes(unix.RtMsg{
+		Family:   family,
+		Dst_len:  uint8(p.Bits()),
+		Table:    unix.RT_TABLE_LOCAL,
+		Protocol: unix.RTPROT_STATIC,
+		Scope:    unix.RT_SCOPE_HOST,
+		Type:     unix.RTN_LOCAL,
+	})...)
+	msg = appendRtAttr(msg, unix.RTA_DST, dst)
+	msg = appendRtAttr(msg, unix.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(r.lo)))
+	r.seq++
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], r.seq)
+
+	if err := unix.Sendto(r.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := unix.Recvfrom(r.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != r.seq || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("short netlink acknowledgement")
+			}
+			if errno := -int32(binary.NativeEndian.Uint32(m.Data[:4])); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
+
+// rtMsgBytes encodes a route message header in host byte order.
+func rtMsgBytes(m unix.RtMsg) []byte {
+	return binary.NativeEndian.AppendUint32([]byte{m.Family, m.Dst_len, m.Src_len, m.Tos, m.Table, m.Protocol, m.Scope, m.Type}, m.Flags)
+}
+
+// appendRtAttr appends a route attribute, padded to the netlink alignment.
+func appendRtAttr(msg []byte, typ uint16, data []byte) []byte {
+	l := unix.SizeofRtAttr + len(data)
+	msg = binary.NativeEndian.AppendUint16(msg, uint16(l))
+	msg = binary.NativeEndian.AppendUint16(msg, typ)
+	msg = append(msg, data...)
+	for len(msg)%unix.NLMSG_ALIGNTO != 0 {
+		msg = append(msg, 0)
+	}
+	return msg
+}
+
+// loopbackIndex returns the index of the loopback interface.
+func loopbackIndex() (int, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			return ifi.Index, nil
+		}
+	}
+	return 0, errors.New("no loopback interface found")
+}
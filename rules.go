@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+// ruleChain is a socks5.RuleSet that runs each rule in order and refuses
+// the request as soon as one of them does.
+type ruleChain []socks5.RuleSet
+
+func (c ruleChain) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	for _, rule := range c {
+		var ok bool
+		if ctx, ok = rule.Allow(ctx, req); !ok {
+			return ctx, false
+		}
+	}
+	return ctx, true
+}
+
+// datagramRule is a rule that also filters the datagrams of UDP
+// associations, which never pass through a socks5.Request of their own.
+type datagramRule interface {
+	allowDatagram(port int) bool
+}
+
+// allowDatagram refuses a datagram to port as soon as one of the chain's
+// datagram rules does.
+func (c ruleChain) allowDatagram(port int) bool {
+	for _, rule := range c {
+		if dr, ok := rule.(datagramRule); ok && !dr.allowDatagram(port) {
+			return false
+		}
+	}
+	return true
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	lo, hi int
+}
+
+// parsePortList parses a list such as "22,80,443,8000-9000".
+func parsePortList(s string) ([]portRange, error) {
+	var ranges []portRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		loStr, hiStr, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(strings.TrimSpace(loStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", part, err)
+		}
+		hi := lo
+		if isRange {
+			hi, err = strconv.Atoi(strings.TrimSpace(hiStr))
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %w", part, err)
+			}
+		}
+		if lo < 1 || hi > 65535 || lo > hi {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ranges = append(ranges, portRange{lo: lo, hi: hi})
+	}
+	return ranges, nil
+}
+
+func portInRanges(port int, ranges []portRange) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// portRuleSet is a socks5.RuleSet that filters CONNECT requests and UDP
+// datagrams by destination port. Empty lists allow everything.
+type portRuleSet struct {
+	allow []portRange
+	deny  []portRange
+}
+
+// refusal returns why port is refused, or "" if it is allowed.
+func (p *portRuleSet) refusal(port int) string {
+	switch {
+	case len(p.allow) > 0 && !portInRanges(port, p.allow):
+		return "port not in allow list"
+	case portInRanges(port, p.deny):
+		return "denied port"
+	}
+	return ""
+}
+
+func (p *portRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		return ctx, true
+	}
+	if reason := p.refusal(req.DestAddr.Port); reason != "" {
+		sugar.Warnw("Rejected CONNECT to "+reason,
+			"dest_addr", req.DestAddr.String(),
+			"dest_port", req.DestAddr.Port,
+		)
+		return ctx, false
+	}
+	return ctx, true
+}
+
+func (p *portRuleSet) allowDatagram(port int) bool {
+	return p.refusal(port) == ""
+}
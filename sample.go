@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// sampleSize caps how many IPs a range contributes to the pool; 0 keeps
+// every address.
+var sampleSize int
+
+// sampleInterval returns iv as pool intervals. When the range holds more
+// than sampleSize addresses, a random sample of sampleSize distinct IPs is
+// drawn from rng instead, without materializing the whole range.
+func sampleInterval(iv ipInterval, rng *rand.Rand) []ipInterval {
+	span := iv.span()
+	if sampleSize <= 0 || span.less(u128{0, uint64(sampleSize)}) {
+		return []ipInterval{iv}
+	}
+
+	var offsets []u128
+	if span.hi == 0 && span.lo < math.MaxInt64 {
+		for _, off := range sampleOffsets(span.lo+1, sampleSize, rng) {
+			offsets = append(offsets, u128{0, off})
+		}
+	} else {
+		// Too large for Floyd's algorithm, and so large that collisions
+		// are rare: draw until there are enough distinct offsets.
+		chosen := make(map[u128]struct{}, sampleSize)
+		for len(chosen) < sampleSize {
+			chosen[randBelowOrEqual(span, rng)] = struct{}{}
+		}
+		for off := range chosen {
+			offsets = append(offsets, off)
+		}
+	}
+	ivs := make([]ipInterval, len(offsets))
+	for i, off := range offsets {
+		addr := iv.lo.add(off)
+		ivs[i] = ipInterval{lo: addr, hi: addr, v4: iv.v4}
+	}
+	sugar.Infow("Sampled IP range",
+		"range", iv.String(),
+		"range_size", countString(span.add(u128{0, 1})),
+		"sample_size", len(ivs),
+	)
+	return ivs
+}
+
+// sampleOffsets returns n distinct offsets in [0, total) in ascending order
+// using Floyd's algorithm, which needs memory proportional to n only.
+func sampleOffsets(total uint64, n int, rng *rand.Rand) []uint64 {
+	chosen := make(map[uint64]struct{}, n)
+	for j := total - uint64(n); j < total; j++ {
+		t := uint64(rng.Int63n(int64(j + 1)))
+		if _, dup := chosen[t]; dup {
+			t = j
+		}
+		chosen[t] = struct{}{}
+	}
+	offsets := make([]uint64, 0, n)
+	for off := range chosen {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
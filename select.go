@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Modes for -selection.
+const (
+	selectRandom     = "random"
+	selectCoverage   = "coverage"
+	selectRoundRobin = "roundrobin"
+	selectSequential = "sequential"
+	selectHash       = "hash"
+)
+
+// selectionMode is how IPs are picked from the primary pool. In coverage
+// mode every IP is handed out once, in random order, before any repeats;
+// after a full cycle selection continues at random. Round-robin cycles
+// through the pool in order forever, and sequential walks it in order once
+// and then continues at random. The order is address order, or the
+// -shuffle order when the pool is shuffled. Hash mode maps each destination
+// host to the same pool IP every time.
+var selectionMode = selectRandom
+
+// Behaviors for -on-budget-exhausted.
+const (
+	budgetUseAny = "any"
+	budgetFail   = "fail"
+)
+
+// selectionBudget bounds how many random picks selection makes looking for
+// an available IP in a pool before giving up on that pool.
+var selectionBudget = 64
+
+// onBudgetExhausted decides what happens when no available IP was found in
+// either pool within the budget: use any primary IP regardless, or fail
+// the dial.
+var onBudgetExhausted = budgetUseAny
+
+// errNoAvailableIP is returned when every pick within the selection budget
+// hit an unavailable IP and -on-budget-exhausted is fail.
+var errNoAvailableIP = errors.New("no available source IP within selection budget")
+
+// randomIP returns a source IP from sourceSelector for the next dial to
+// destAddr on network, or nil if there is none. The result is always a fresh copy:
+// pool entries are shared by concurrent dials and must never be handed out
+// where a caller could mutate them.
+func randomIP(network, destAddr string) net.IP {
+	ip, err := sourceSelector.Select(context.Background(), network, destAddr)
+	if err != nil {
+		return nil
+	}
+	return ip
+}
+
+// poolFor returns the source pool for dials on network. UDP uses the UDP
+// pool when one is configured; everything else uses the shared pool.
+func poolFor(network string) *ipPool {
+	if strings.HasPrefix(network, "udp") && !udpList.empty() {
+		return udpList
+	}
+	return currentPool()
+}
+
+// cloneIP returns a copy of ip, or nil for a nil ip.
+func cloneIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	return out
+}
+
+// selectSourceIP chooses a source IP from primary, falling back to
+// fallback, for the built-in pool selectors. mode is a -selection value;
+// every mode but random prefers the primary IP it would hand out next and
+// otherwise picks at random. Selection always terminates: each pool gets
+// at most selectionBudget picks, after which onBudgetExhausted applies.
+func selectSourceIP(primary, fallback *ipPool, mode string) net.IP {
+	var next net.IP
+	switch mode {
+	case selectCoverage:
+		next = pickCovering(primary)
+	case selectRoundRobin:
+		next = pickInOrder(primary, true)
+	case selectSequential:
+		next = pickInOrder(primary, false)
+	}
+	if next != nil {
+		return next
+	}
+	if ip := pickAvailable(primary); ip != nil {
+		return ip
+	}
+	if ip := pickAvailable(fallback); ip != nil {
+		sugar.Warnw("No healthy primary source IPs, using FALLBACK pool IP",
+			"local_ip", ip.String(),
+			"primary_size", primary.len(),
+			"fallback_size", fallback.len(),
+		)
+		return ip
+	}
+	if primary.empty() {
+		sugar.Errorw("selectSourceIP called with empty pool", "on_empty_pool", onEmptyPool)
+		return nil
+	}
+	if onBudgetExhausted == budgetFail {
+		sugar.Warnw("Selection budget exhausted, failing dial", "budget", selectionBudget)
+		return nil
+	}
+	// Everything is unavailable; a possibly-bad IP beats failing the dial.
+	connLogger().Debugw("Selection budget exhausted, using any primary IP", "budget", selectionBudget)
+	return randomFrom(primary, localRand)
+}
+
+// pickAvailable makes up to selectionBudget random picks from p and
+// returns the first available one, or nil.
+func pickAvailable(p *ipPool) net.IP {
+	if p.empty() {
+		return nil
+	}
+	for i := 0; i < selectionBudget; i++ {
+		ip := randomFrom(p, localRand)
+		if ipAvailable(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// coverageTracker hands out a pool's indices in random order without
+// repeats. It runs Fisher-Yates lazily, recording only the swapped
+// positions, so memory grows with the number of picks rather than with
+// the pool size.
+type coverageTracker struct {
+	mu      sync.Mutex
+	size    int
+	next    int
+	swapped map[int]int
+}
+
+var (
+	coverageMu sync.Mutex
+	coverage   = make(map[*ipPool]*coverageTracker)
+	rotations  = make(map[*ipPool]*atomic.Uint64)
+)
+
+// coverageFor returns the tracker for p, keyed by pool so the TCP and UDP
+// pools are covered independently. Only the first MaxInt offsets of a
+// larger IPv6 pool are tracked; covering even those would take forever.
+func coverageFor(p *ipPool) *coverageTracker {
+	coverageMu.Lock()
+	defer coverageMu.Unlock()
+	t, ok := coverage[p]
+	if !ok {
+		t = &coverageTracker{size: int(min(p.len(), math.MaxInt)), swapped: make(map[int]int)}
+		coverage[p] = t
+	}
+	return t
+}
+
+// resetCoverage forgets which IPs have been used, e.g. after the pool is
+// replaced, restarting coverage and in-order selection.
+func resetCoverage() {
+	coverageMu.Lock()
+	clear(coverage)
+	clear(rotations)
+	coverageMu.Unlock()
+}
+
+// take returns the next unused index, or false once every index has been
+// handed out.
+func (t *coverageTracker) take() (int, bool) {
+	if t.next >= t.size {
+		return 0, false
+	}
+	j := t.next + localRand.Intn(t.size-t.next)
+	pick := t.at(j)
+	t.swapped[j] = t.at(t.next)
+	delete(t.swapped, t.next)
+	t.next++
+	if t.next == t.size {
+		sugar.Infow("Every pool IP has been used once, continuing with random selection", "pool_size", t.size)
+	}
+	return pick, true
+}
+
+func (t *coverageTracker) at(i int) int {
+	if v, ok := t.swapped[i]; ok {
+		return v
+	}
+	return i
+}
+
+// pickCovering returns an available IP from p that has not been handed
+// out yet, or nil once the pool is covered or the budget runs out. IPs
+// that are unavailable when their turn comes count as used.
+func pickCovering(p *ipPool) net.IP {
+	if p.empty() {
+		return nil
+	}
+	t := coverageFor(p)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := 0; i < selectionBudget; i++ {
+		idx, ok := t.take()
+		if !ok {
+			return nil
+		}
+		if ip := p.at(u128{0, uint64(idx)}); ipAvailable(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// rotationFor returns the next-offset counter of p for in-order selection,
+// keyed by pool like coverage.
+func rotationFor(p *ipPool) *atomic.Uint64 {
+	coverageMu.Lock()
+	defer coverageMu.Unlock()
+	r, ok := rotations[p]
+	if !ok {
+		r = new(atomic.Uint64)
+		rotations[p] = r
+	}
+	return r
+}
+
+// pickInOrder returns the next available IP of p in pool order, skipping
+// unavailable ones. With wrap set it starts over after the last IP;
+// otherwise it returns nil once every IP has had its turn.
+func pickInOrder(p *ipPool, wrap bool) net.IP {
+	if p.empty() {
+		return nil
+	}
+	r := rotationFor(p)
+	size := p.len()
+	for i := 0; i < selectionBudget; i++ {
+		n := r.Add(1) - 1
+		if n >= size {
+			if !wrap {
+				return nil
+			}
+			n %= size
+		}
+		if !wrap && n == size-1 {
+			sugar.Infow("Every pool IP has been used once, continuing with random selection", "pool_size", p.count())
+		}
+		if ip := p.at(u128{0, n}); ipAvailable(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// pickHashed returns the IP that key maps to in p, or nil if p is empty or
+// the budget runs out on unavailable IPs. Keys are hashed with FNV-1a and
+// placed with jump consistent hashing (Lamping and Veach), so the mapping
+// is the same across restarts and across proxies with the same pool, and
+// growing the pool moves only the keys that land on the new addresses. An
+// unavailable IP is skipped by rehashing the key.
+func pickHashed(p *ipPool, key string) net.IP {
+	if p.empty() {
+		return nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	for i := 0; i < selectionBudget; i++ {
+		if ip := p.at(u128{0, jumpHash(sum, p.len())}); ipAvailable(ip) {
+			return ip
+		}
+		sum = sum*2862933555777941757 + 1
+	}
+	return nil
+}
+
+// jumpHash maps key to a bucket in [0, n).
+func jumpHash(key, n uint64) uint64 {
+	var b, j uint64 = 0, 0
+	for j < n {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = uint64(float64(b+1) * (float64(1<<31) / float64((key>>33)+1)))
+	}
+	return b
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useSelection switches the selector to mode and distribution dist for
+// the rest of the test.
+func useSelection(t testing.TB, mode, dist string) {
+	t.Helper()
+	prevMode, prevDist, prevSelector := selectionMode, distribution, sourceSelector
+	t.Cleanup(func() {
+		selectionMode, distribution, sourceSelector = prevMode, prevDist, prevSelector
+		resetCoverage()
+	})
+	selectionMode, distribution = mode, dist
+	sourceSelector = newSourceSelector()
+	resetCoverage()
+}
+
+// useCooldown sets -cooldown for the rest of the test.
+func useCooldown(t testing.TB, d time.Duration) {
+	t.Helper()
+	prev := sourceCooldown
+	t.Cleanup(func() {
+		sourceCooldown = prev
+		cooldownMu.Lock()
+		cooldownUntil = make(map[netip.Addr]time.Time)
+		cooldownMu.Unlock()
+	})
+	sourceCooldown = d
+}
+
+// TestSelectConcurrent runs dials' selections in parallel with failures
+// and pool reloads. It is meant for go test -race.
+func TestSelectConcurrent(t *testing.T) {
+	modes := []struct {
+		name, mode, dist string
+	}{
+		{"random", selectRandom, distUniform},
+		{"zipf", selectRandom, distZipf},
+		{"coverage", selectCoverage, distUniform},
+		{"roundrobin", selectRoundRobin, distUniform},
+		{"hash", selectHash, distUniform},
+	}
+	for _, m := range modes {
+		t.Run(m.name, func(t *testing.T) {
+			usePool(t, "10.20.0.0/24")
+			useSelection(t, m.mode, m.dist)
+			useCooldown(t, time.Millisecond)
+			pool := currentPool()
+
+			const workers, picks = 16, 500
+			var wg sync.WaitGroup
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range picks {
+						ip, err := sourceSelector.Select(context.Background(), "tcp", "192.0.2.1:80")
+						if err != nil {
+							t.Errorf("Select: %v", err)
+							return
+						}
+						if !pool.contains(ip) {
+							t.Errorf("Select returned %s, outside the pool", ip)
+							return
+						}
+						if (w+i)%7 == 0 {
+							markSourceFailed(ip)
+						}
+					}
+				}()
+			}
+			// Reinstall the same pool meanwhile, as a reload does.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 20 {
+					if err := setPool(pool); err != nil {
+						t.Error(err)
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+			wg.Wait()
+		})
+	}
+}
+
+// TestCoverageConcurrent checks that parallel coverage picks still hand
+// out every pool IP exactly once before repeating any.
+func TestCoverageConcurrent(t *testing.T) {
+	usePool(t, "10.20.0.0/24")
+	useSelection(t, selectCoverage, distUniform)
+
+	const workers = 16
+	size := int(currentPool().len())
+	var (
+		mu   sync.Mutex
+		seen = make(map[netip.Addr]int)
+		wg   sync.WaitGroup
+	)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range size / workers {
+				ip, err := sourceSelector.Select(context.Background(), "tcp", "192.0.2.1:80")
+				if err != nil {
+					t.Errorf("Select: %v", err)
+					return
+				}
+				mu.Lock()
+				seen[addrKey(ip)]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != size {
+		t.Errorf("%d distinct IPs in %d picks, want every IP once", len(seen), size)
+	}
+	for ip, n := range seen {
+		if n != 1 {
+			t.Errorf("%s picked %d times", ip, n)
+		}
+	}
+}
+
+// BenchmarkSelect measures one source IP pick per selection mode over
+// pools of 1, 1k and 1M addresses.
+func BenchmarkSelect(b *testing.B) {
+	pools := []struct{ name, spec string }{
+		{"1", "10.30.0.1"},
+		{"1k", "10.30.0.0-10.30.3.231"},
+		{"1M", "10.32.0.0/12"},
+	}
+	modes := []string{selectRandom, selectCoverage, selectRoundRobin, selectSequential, selectHash}
+	for _, p := range pools {
+		for _, mode := range modes {
+			b.Run(p.name+"/"+mode, func(b *testing.B) {
+				usePool(b, p.spec)
+				useSelection(b, mode, distUniform)
+				b.ReportAllocs()
+				for range b.N {
+					randomIP("tcp", "192.0.2.1:80")
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSelectCooldown measures random picks from a 1k pool with
+// -cooldown set, so every pick consults the cooldown map.
+func BenchmarkSelectCooldown(b *testing.B) {
+	usePool(b, "10.30.0.0-10.30.3.231")
+	useSelection(b, selectRandom, distUniform)
+	useCooldown(b, time.Minute)
+	markSourceFailed(currentPool().at(u128{}))
+	b.ReportAllocs()
+	for range b.N {
+		randomIP("tcp", "192.0.2.1:80")
+	}
+}
+
+// TestSelectReturnsCopy mutates every returned IP and checks that neither
+// the pool nor a pinned IP changes underneath later dials.
+func TestSelectReturnsCopy(t *testing.T) {
+	usePool(t, "10.40.0.0/29")
+	pool := currentPool()
+	var want []string
+	for i := range pool.len() {
+		want = append(want, pool.at(u128{0, i}).String())
+	}
+
+	for _, mode := range []string{selectRandom, selectCoverage, selectRoundRobin, selectHash} {
+		useSelection(t, mode, distUniform)
+		for range 50 {
+			ip := randomIP("tcp", "192.0.2.1:80")
+			for i := range ip {
+				ip[i] = 0xff
+			}
+		}
+	}
+	for i := range pool.len() {
+		if got := pool.at(u128{0, i}).String(); got != want[i] {
+			t.Fatalf("pool offset %d is %s after callers mutated picks, want %s", i, got, want[i])
+		}
+	}
+
+	prev := pinnedIP
+	t.Cleanup(func() { pinnedIP = prev })
+	pinnedIP = net.IPv4(10, 40, 0, 3).To4()
+	useSelection(t, selectRandom, distUniform)
+	ip := randomIP("tcp", "192.0.2.1:80")
+	ip[3] = 99
+	if got := randomIP("tcp", "192.0.2.1:80"); !got.Equal(net.IPv4(10, 40, 0, 3)) {
+		t.Errorf("pinned IP changed to %s after a caller mutated a pick", got)
+	}
+}
+
+// countingSource counts the draws made from an intSource.
+type countingSource struct {
+	intSource
+	draws int
+}
+
+func (c *countingSource) Intn(n int) int {
+	c.draws++
+	return c.intSource.Intn(n)
+}
+
+// useBudget sets -select-budget and -on-budget-exhausted for the rest of
+// the test.
+func useBudget(t *testing.T, budget int, exhausted string) {
+	t.Helper()
+	prevBudget, prevExhausted := selectionBudget, onBudgetExhausted
+	t.Cleanup(func() { selectionBudget, onBudgetExhausted = prevBudget, prevExhausted })
+	selectionBudget, onBudgetExhausted = budget, exhausted
+}
+
+// coolDownAllBut puts every IP of the active pool except keep into
+// cooldown, and takes keep out of it.
+func coolDownAllBut(keep net.IP) {
+	cooldownMu.Lock()
+	cooldownUntil = make(map[netip.Addr]time.Time)
+	cooldownMu.Unlock()
+	pool := currentPool()
+	for i := range pool.len() {
+		if ip := pool.at(u128{0, i}); !ip.Equal(keep) {
+			markSourceFailed(ip)
+		}
+	}
+}
+
+func TestSelectionBudget(t *testing.T) {
+	usePool(t, "10.50.0.0/22")
+	useSelection(t, selectRandom, distUniform)
+	useCooldown(t, time.Minute)
+	prevRand := localRand
+	t.Cleanup(func() { localRand = prevRand })
+	pool := currentPool()
+
+	t.Run("fail", func(t *testing.T) {
+		useBudget(t, 16, budgetFail)
+		coolDownAllBut(nil)
+		src := &countingSource{intSource: newLockedRand(1)}
+		localRand = src
+		ip, err := sourceSelector.Select(context.Background(), "tcp", "192.0.2.1:80")
+		if !errors.Is(err, errNoAvailableIP) {
+			t.Errorf("Select with every IP cooling down = %v, %v; want errNoAvailableIP", ip, err)
+		}
+		if src.draws > 16 {
+			t.Errorf("selection made %d random draws, want at most the budget of 16", src.draws)
+		}
+	})
+
+	t.Run("any", func(t *testing.T) {
+		useBudget(t, 16, budgetUseAny)
+		coolDownAllBut(nil)
+		src := &countingSource{intSource: newLockedRand(1)}
+		localRand = src
+		ip, err := sourceSelector.Select(context.Background(), "tcp", "192.0.2.1:80")
+		if err != nil || !pool.contains(ip) {
+			t.Errorf("Select with every IP cooling down = %v, %v; want any pool IP", ip, err)
+		}
+		if src.draws > 17 {
+			t.Errorf("selection made %d random draws, want the budget of 16 plus one fallback pick", src.draws)
+		}
+	})
+
+	t.Run("one available", func(t *testing.T) {
+		// With 1 of 1024 IPs available a pick rarely finds it, but every
+		// dial still ends within the budget, and finds it when it does.
+		useBudget(t, 64, budgetFail)
+		keep := pool.at(u128{0, 517})
+		coolDownAllBut(keep)
+		localRand = newLockedRand(1)
+		found := 0
+		for range 200 {
+			ip, err := sourceSelector.Select(context.Background(), "tcp", "192.0.2.1:80")
+			switch {
+			case errors.Is(err, errNoAvailableIP):
+			case err != nil:
+				t.Fatalf("Select: %v", err)
+			case !ip.Equal(keep):
+				t.Fatalf("Select returned %s, which is cooling down", ip)
+			default:
+				found++
+			}
+		}
+		if found == 0 {
+			t.Error("the one available IP was never selected")
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// SourceSelector chooses the source IP for one upstream dial. network and
+// destAddr are the dial's (for DNS lookups, destAddr is the DNS server), so
+// implementations can apply affinity or policy routing and match the
+// destination's address family. The returned IP belongs to the caller.
+//
+// Every selection goes through sourceSelector; the built-in selectors below
+// implement the -selection, -force-ip and -username-hint behaviors and
+// double as examples for custom ones.
+type SourceSelector interface {
+	Select(ctx context.Context, network, destAddr string) (net.IP, error)
+}
+
+// sourceSelector is the selector used for every dial. main replaces it
+// according to the flags.
+var sourceSelector SourceSelector = randomSelector{}
+
+// retryRepicks bounds how often a retry re-picks to avoid a source IP that
+// already failed for the same dial.
+const retryRepicks = 8
+
+var errAlreadyTried = errors.New("source IP already failed for this dial")
+
+// selectUntried selects the source IP for one attempt of a dial,
+// re-picking while the selector returns one of tried, the IPs earlier
+// attempts of the dial failed from. Hinted and pinned picks are used as
+// they are, and after retryRepicks repeats the repeat is used anyway, e.g.
+// for a one-IP pool or a sticky mapping. Skipped picks are recorded in the
+// dial's trace so a replay stays in step.
+func selectUntried(ctx context.Context, network, destAddr string, tried []net.IP) (net.IP, error) {
+	trace := dialTraceFrom(ctx)
+	for i := 0; ; i++ {
+		ip, err := sourceSelector.Select(ctx, network, destAddr)
+		if err != nil || ip == nil || i == retryRepicks || sourceHint(ctx) != nil || pinnedIP != nil || !slices.ContainsFunc(tried, ip.Equal) {
+			return ip, err
+		}
+		trace.attempt(ip, false)
+		trace.attemptFailed(errAlreadyTried)
+	}
+}
+
+// randomSelector picks uniformly at random from the pool for network.
+type randomSelector struct{}
+
+func (randomSelector) Select(ctx context.Context, network, destAddr string) (net.IP, error) {
+	return poolSelect(network, destAddr, selectRandom)
+}
+
+// orderedSelector applies one of the -selection modes that track which
+// IPs were handed out: coverage, roundrobin or sequential.
+type orderedSelector struct {
+	mode string
+}
+
+func (o orderedSelector) Select(ctx context.Context, network, destAddr string) (net.IP, error) {
+	return poolSelect(network, destAddr, o.mode)
+}
+
+// hashSelector maps each destination host to a fixed pool IP by consistent
+// hashing; see pickHashed.
+type hashSelector struct{}
+
+func (hashSelector) Select(ctx context.Context, network, destAddr string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(destAddr)
+	if err != nil {
+		host = destAddr
+	}
+	if ip := pickHashed(familyPool(poolFor(network), destFamily(network, destAddr)), host); ip != nil {
+		return cloneIP(ip), nil
+	}
+	return poolSelect(network, destAddr, selectRandom)
+}
+
+// pinnedSelector always returns the same IP.
+type pinnedSelector struct {
+	ip net.IP
+}
+
+func (p pinnedSelector) Select(ctx context.Context, network, destAddr string) (net.IP, error) {
+	return cloneIP(p.ip), nil
+}
+
+// hintSelector honors a client-requested source IP carried on the context
+// and defers to next otherwise.
+type hintSelector struct {
+	next SourceSelector
+}
+
+func (h hintSelector) Select(ctx context.Context, network, destAddr string) (net.IP, error) {
+	if ip := sourceHint(ctx); ip != nil {
+		return cloneIP(ip), nil
+	}
+	return h.next.Select(ctx, network, destAddr)
+}
+
+// poolSelect runs the built-in pool selection for network and reports why
+// nothing was selected. When the destination's address family is known,
+// only pool IPs of that family are considered.
+func poolSelect(network, destAddr, mode string) (net.IP, error) {
+	return poolSelectFrom(poolFor(network), network, destAddr, mode)
+}
+
+// poolSelectFrom is poolSelect with primary as the primary pool.
+func poolSelectFrom(primary *ipPool, network, destAddr, mode string) (net.IP, error) {
+	family := destFamily(network, destAddr)
+	pool := familyPool(primary, family)
+	fallback := familyPool(fallbackList, family)
+	ip := selectSourceIP(pool, fallback, mode)
+	if ip == nil {
+		if pool.empty() && fallback.empty() {
+			if family != "" && (!primary.empty() || !fallbackList.empty()) {
+				return nil, fmt.Errorf("%w of %s addresses", errEmptyPool, family)
+			}
+			return nil, errEmptyPool
+		}
+		return nil, errNoAvailableIP
+	}
+	return cloneIP(ip), nil
+}
+
+// newSourceSelector builds the selector for the current flags.
+func newSourceSelector() SourceSelector {
+	var base SourceSelector = randomSelector{}
+	switch {
+	case pinnedIP != nil:
+		base = pinnedSelector{ip: pinnedIP}
+	case selectionMode == selectHash:
+		base = hashSelector{}
+	case selectionMode != selectRandom:
+		base = orderedSelector{mode: selectionMode}
+	}
+	if pinnedIP == nil && rotateEvery > 0 {
+		window := newStickySelector(base, rotateEvery, "rotation window", windowKey)
+		window.fixed = true
+		base = window
+	}
+	if pinnedIP == nil && stickyDestTTL > 0 {
+		base = newStickySelector(base, stickyDestTTL, "destination", destKey)
+	}
+	if pinnedIP == nil && stickyClientTTL > 0 {
+		base = newStickySelector(base, stickyClientTTL, "client", clientKey)
+	}
+	if pinnedIP == nil && destPins != nil {
+		base = pinSelector{rules: destPins, next: base}
+	}
+	if len(extraListeners) > 0 {
+		base = listenerSelector{next: base}
+	}
+	return hintSelector{next: base}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ownAddresses returns the proxy's own addresses that must not be spoofed:
+// the listen IPs (every interface address when any listens on all
+// interfaces) plus any -mgmt-ip entries. Loopback addresses are skipped
+// since spoofing them cannot hijack traffic arriving from the network.
+func ownAddresses(listenHosts []string, mgmtIPs string) ([]net.IP, error) {
+	var own []net.IP
+	allInterfaces := false
+	for _, host := range listenHosts {
+		listenIP := net.ParseIP(host)
+		if listenIP == nil || listenIP.IsUnspecified() {
+			allInterfaces = true
+			break
+		}
+		own = append(own, listenIP)
+	}
+	if allInterfaces {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+		}
+		own = own[:0]
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				own = append(own, ipNet.IP)
+			}
+		}
+	}
+	for _, s := range strings.Split(mgmtIPs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid -mgmt-ip address %q", s)
+		}
+		own = append(own, ip)
+	}
+
+	kept := own[:0]
+	for _, ip := range own {
+		if !ip.IsLoopback() {
+			kept = append(kept, ip)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// selfTestTimeout bounds how long one self-test dial waits for the local
+// server to see the connection.
+const selfTestTimeout = 5 * time.Second
+
+// egressTestWorkers is how many source IPs the selftest command dials a
+// -target from at once.
+const egressTestWorkers = 16
+
+// runSelfTest checks that spoofing actually takes effect on this box. It
+// listens on a local TCP port, dials it through customDialer from up to n
+// pool IPs (or the -force-ip address), and compares the source address the
+// server observed with the IP that was requested. Each result is printed
+// to stdout; the return value reports whether every IP passed.
+//
+// The listener is dialed at the tested IP itself, which only reaches this
+// box when the pool is routed locally (the AnyIP setup in the README), so a
+// missing route fails the test the same way it would fail real checks.
+func runSelfTest(n int) bool {
+	l, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		sugar.Errorw("Self-test failed to listen", "error", err)
+		return false
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	observed := make(chan net.Addr)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			observed <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	ips := selfTestIPs(n)
+	passed := 0
+	for _, ip := range ips {
+		err := selfTestIP(ip, port, observed)
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "FAIL %s: %v\n", ip, err)
+			sugar.Errorw("Self-test failed", "local_ip", ip.String(), "error", err)
+			continue
+		}
+		passed++
+		fmt.Fprintf(os.Stdout, "PASS %s\n", ip)
+	}
+	fmt.Fprintf(os.Stdout, "%d/%d source IPs passed\n", passed, len(ips))
+	return len(ips) > 0 && passed == len(ips)
+}
+
+// selfTestIP dials the self-test listener from ip and checks the source
+// address the listener saw.
+func selfTestIP(ip net.IP, port int, observed <-chan net.Addr) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, ctxSourceHint, ip)
+
+	conn, err := customDialer(ctx, "tcp", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	select {
+	case addr := <-observed:
+		seen := addr.(*net.TCPAddr).IP
+		if !seen.Equal(ip) {
+			return fmt.Errorf("server saw source %s, spoofing is not taking effect", seen)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("server never saw the connection: %w", ctx.Err())
+	}
+}
+
+// runEgressTest dials target from up to n pool IPs (every IP when n is 0)
+// and prints which ones got a connection, i.e. whose packets left the box
+// and whose return traffic came back. The return value reports whether
+// every IP passed.
+func runEgressTest(target string, n int) bool {
+	ips := selfTestIPs(n)
+	results := make([]error, len(ips))
+	times := make([]time.Duration, len(ips))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(egressTestWorkers, len(ips)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				start := time.Now()
+				results[i] = egressTestIP(ips[i], target)
+				times[i] = time.Since(start)
+			}
+		}()
+	}
+	for i := range ips {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	passed := 0
+	for i, ip := range ips {
+		if err := results[i]; err != nil {
+			fmt.Fprintf(os.Stdout, "FAIL %s: %v\n", ip, err)
+			continue
+		}
+		passed++
+		fmt.Fprintf(os.Stdout, "PASS %s in %v\n", ip, times[i].Round(time.Millisecond))
+	}
+	fmt.Fprintf(os.Stdout, "%d/%d source IPs reached %s\n", passed, len(ips), target)
+	return len(ips) > 0 && passed == len(ips)
+}
+
+// egressTestIP makes one dial to target from ip.
+func egressTestIP(ip net.IP, target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, ctxSourceHint, ip)
+	conn, err := customDialer(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// selfTestIPs returns the IPs to self-test: the pinned IP if set, otherwise
+// up to n distinct random IPs from the pool, or all of them when n is 0.
+func selfTestIPs(n int) []net.IP {
+	if pinnedIP != nil {
+		return []net.IP{pinnedIP}
+	}
+	pool := currentPool()
+	if n <= 0 || uint64(n) >= pool.len() {
+		ips := make([]net.IP, 0, pool.len())
+		for i := uint64(0); i < pool.len(); i++ {
+			ips = append(ips, pool.at(u128{0, i}))
+		}
+		return ips
+	}
+	picked := make(map[string]bool, n)
+	ips := make([]net.IP, 0, n)
+	for len(ips) < n {
+		ip := pool.random(localRand)
+		if !picked[ip.String()] {
+			picked[ip.String()] = true
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
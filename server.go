@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// Accept loop settings.
+var (
+	listenBacklog    int
+	maxHandshakes    = 256
+	handshakeWaitMax = 5 * time.Second
+)
+
+var (
+	connsAccepted        = newCounter("scoreproxy_connections_accepted_total", "Client connections accepted and handed to the SOCKS server.")
+	connsRejected        = newCounter("scoreproxy_connections_rejected_total", "Client connections closed because no handshake slot freed up in time.")
+	listenerRestartCount = newCounter("scoreproxy_listener_restarts_total", "Times the SOCKS listener was re-bound after failing.")
+	acceptErrors         = newCounter("scoreproxy_accept_errors_total", "Temporary errors returned by Accept and retried.")
+	handshakeTime        = newHistogram("scoreproxy_handshake_seconds", "Time from accept until the SOCKS request is ready to dial.", latencyBuckets)
+)
+
+// listen opens the SOCKS listener, applying -backlog if set. Go always
+// listens with the kernel's somaxconn; Linux lets a second listen(2) call
+// on the same socket change the backlog. A Unix socket replaces a stale
+// one at its path and gets -socket-mode and -socket-owner. Other TCP
+// listeners serve TLS with -tls-cert, except a transparent one, which gets
+// IP_TRANSPARENT for -transparent-mode tproxy. With -proxy-protocol-from,
+// TCP listeners expect a PROXY header, ahead of any TLS, from the listed
+// load balancers.
+func listen(network, addr, transparent string) (net.Listener, error) {
+	l, err := listenPlain(network, addr, transparent)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp" && listenTLS != nil && transparent == "" {
+		l = listenTLS.wrap(l)
+	}
+	return l, nil
+}
+
+// listenPlain is listen without -tls-cert, for protocols that bring their
+// own encryption or wrap TLS themselves.
+func listenPlain(network, addr, transparent string) (net.Listener, error) {
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	var lc net.ListenConfig
+	if transparent == transparentTProxy {
+		lc.Control = transparentControl
+	}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := setSocketPerms(addr); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if err := setBacklog(l); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if network == "tcp" && len(proxyProtocolFrom) > 0 && transparent == "" {
+		l = proxyProtoListener{l}
+	}
+	return l, nil
+}
+
+// setBacklog re-listens a TCP listener with -backlog, if set.
+func setBacklog(l net.Listener) error {
+	tl, ok := l.(*net.TCPListener)
+	if listenBacklog <= 0 || !ok {
+		return nil
+	}
+	raw, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), listenBacklog)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
+
+// handshake tracks one client connection until its SOCKS request is ready
+// to dial, holding a handshake slot for that duration.
+type handshake struct {
+	start   time.Time
+	once    sync.Once
+	release func()
+}
+
+func (h *handshake) finish(completed bool) {
+	h.once.Do(func() {
+		if completed {
+			handshakeTime.Observe(time.Since(h.start).Seconds())
+		}
+		h.release()
+	})
+}
+
+// handshakes maps a client's remote address to its in-progress handshake.
+var handshakes sync.Map
+
+// handshakeRule is a socks5.RuleSet that marks the end of a handshake. The
+// rule set runs after negotiation, request parsing and resolution, right
+// before the dial.
+type handshakeRule struct{}
+
+func (handshakeRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.RemoteAddr == nil {
+		return ctx, true
+	}
+	if h, ok := handshakes.Load(req.RemoteAddr.Address()); ok {
+		h.(*handshake).finish(true)
+	}
+	return ctx, true
+}
+
+// serve is a replacement for socks5.Server.Serve that bounds how many
+// handshakes are processed at once. Connections over the bound wait up to
+// handshakeWaitMax for a slot and are closed if none frees up. While the
+// proxy is draining, new connections are closed right after accept.
+//
+// Temporary accept errors (e.g. EMFILE) are logged and retried with a
+// growing delay, as net/http does; permanent errors such as a closed
+// listener are returned.
+func serve(server *socksServer, l net.Listener) error {
+	slots := make(chan struct{}, maxHandshakes)
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if !errors.Is(err, net.ErrClosed) && errors.As(err, &ne) && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				acceptErrors.Inc()
+				sugar.Warnw("Temporary accept error, retrying", "error", err, "retry_in", tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		if draining.Load() {
+			drainRejected.Inc()
+			conn.Close()
+			continue
+		}
+		go serveConn(server, conn, slots)
+	}
+}
+
+func serveConn(server *socksServer, conn net.Conn, slots chan struct{}) {
+	activeSessions.Add(1)
+	defer activeSessions.Add(-1)
+	start := time.Now()
+	timer := time.NewTimer(handshakeWaitMax)
+	select {
+	case slots <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		connsRejected.Inc()
+		sugar.Warnw("Rejecting connection, no handshake slot available",
+			"client_addr", conn.RemoteAddr().String(),
+			"max_handshakes", maxHandshakes,
+		)
+		conn.Close()
+		return
+	}
+	connsAccepted.Inc()
+
+	h := &handshake{start: start, release: func() { <-slots }}
+	defer h.finish(false)
+	// Unix socket clients have no distinct address to key on; their slot
+	// is released when the connection ends.
+	if raw, ok := rawConn(conn).(*net.TCPConn); ok {
+		key := conn.RemoteAddr().String()
+		handshakes.Store(key, h)
+		defer handshakes.Delete(key)
+		setNoDelay(raw, "client")
+	}
+	server.ServeConn(wrapClientConn(conn))
+}
+
+// listenerRestarts is how many times superviseListener re-binds after the
+// listener fails before giving up.
+var listenerRestarts = 3
+
+// superviseListener listens on addr, a -listen value, and serves until
+// shutdown is closed. If the listener dies for any other reason it is re-bound with backoff, up
+// to listenerRestarts consecutive times. The pool, stats and in-flight
+// connections are untouched by a restart.
+func superviseListener(server *socksServer, addr string, shutdown <-chan struct{}) error {
+	network, address := splitListenAddr(addr)
+	failures := 0
+	for {
+		started := time.Now()
+		l, err := listen(network, address, server.transparent)
+		if err == nil {
+			stop := make(chan struct{})
+			go func() {
+				select {
+				case <-shutdown:
+					l.Close()
+				case <-stop:
+				}
+			}()
+			err = serve(server, l)
+			close(stop)
+			l.Close()
+		}
+		select {
+		case <-shutdown:
+			return nil
+		default:
+		}
+
+		if time.Since(started) > time.Minute {
+			failures = 0
+		}
+		failures++
+		if failures > listenerRestarts {
+			return err
+		}
+		wait := time.Duration(failures) * time.Second
+		listenerRestartCount.Inc()
+		sugar.Errorw("SOCKS listener failed, restarting",
+			"addr", addr,
+			"error", err,
+			"attempt", failures,
+			"max_attempts", listenerRestarts,
+			"retry_in", wait,
+		)
+		select {
+		case <-time.After(wait):
+		case <-shutdown:
+			return nil
+		}
+	}
+}
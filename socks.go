@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/armon/go-socks5"
+	"go.uber.org/zap"
+)
+
+// SOCKS5 reply codes (RFC 1928 section 6).
+const (
+	replySucceeded uint8 = iota
+	replyServerFailure
+	replyRuleFailure
+	replyNetworkUnreachable
+	replyHostUnreachable
+	replyConnectionRefused
+	replyTTLExpired
+	replyCommandNotSupported
+	replyAddrTypeNotSupported
+)
+
+const (
+	socks5Version = uint8(5)
+	noAcceptable  = uint8(255)
+)
+
+// SOCKS5 address types.
+const (
+	atypIPv4 = uint8(1)
+	atypFQDN = uint8(3)
+	atypIPv6 = uint8(4)
+)
+
+// socksServer serves SOCKS5 connections. It follows go-socks5's
+// Server.ServeConn and reuses the library's authenticators, request parser,
+// resolver and rule set, but owns request handling so failures can be
+// reported with accurate reply codes.
+type socksServer struct {
+	authMethods []socks5.Authenticator // in order of preference
+	resolver    socks5.NameResolver
+	rules       socks5.RuleSet
+	dial        func(ctx context.Context, network, addr string) (net.Conn, error)
+	pool        *listenerPool // set for extra -listener servers
+	transparent string        // -transparent-mode, set for the -transparent server
+}
+
+// newSOCKSServer builds a socksServer from conf, applying the same defaults
+// as socks5.New.
+func newSOCKSServer(conf *socks5.Config) *socksServer {
+	s := &socksServer{
+		resolver: conf.Resolver,
+		rules:    conf.Rules,
+		dial:     conf.Dial,
+	}
+	methods := conf.AuthMethods
+	if len(methods) == 0 {
+		if conf.Credentials != nil {
+			methods = []socks5.Authenticator{&socks5.UserPassAuthenticator{Credentials: conf.Credentials}}
+		} else {
+			methods = []socks5.Authenticator{&socks5.NoAuthAuthenticator{}}
+		}
+	}
+	s.authMethods = methods
+	if s.resolver == nil {
+		s.resolver = socks5.DNSResolver{}
+	}
+	if s.rules == nil {
+		s.rules = socks5.PermitAll()
+	}
+	if s.dial == nil {
+		s.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+	return s
+}
+
+// ServeConn serves a single client connection and closes it when done.
+func (s *socksServer) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	if s.transparent != "" {
+		return s.serveTransparent(conn)
+	}
+	bufConn := bufio.NewReader(conn)
+
+	version, err := bufConn.ReadByte()
+	if err != nil {
+		connLogger().Infow("socks: failed to get version byte", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return err
+	}
+	if version == socks4Version {
+		return s.serveSOCKS4(conn, bufConn)
+	}
+	if version != socks5Version {
+		err := fmt.Errorf("unsupported SOCKS version: %d", version)
+		connLogger().Infow("socks: rejecting client", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return err
+	}
+
+	authContext, err := s.authenticate(conn, bufConn)
+	if err != nil {
+		err = fmt.Errorf("failed to authenticate: %w", err)
+		connLogger().Infow("socks: handshake failed", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return err
+	}
+
+	req, err := socks5.NewRequest(bufConn)
+	if err != nil {
+		if err.Error() == "Unrecognized address type" {
+			if err := sendReply(conn, replyAddrTypeNotSupported, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+		}
+		return fmt.Errorf("failed to read destination address: %w", err)
+	}
+	req.AuthContext = authContext
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		req.RemoteAddr = &socks5.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	ctx := s.requestContext(conn, authContext)
+	logRequest(ctx, req, conn.RemoteAddr())
+
+	if err := s.handleRequest(ctx, req, conn, bufConn, sendReply); err != nil {
+		err = fmt.Errorf("failed to handle request: %w", err)
+		connLog(ctx).Infow("socks: request failed", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return err
+	}
+	return nil
+}
+
+// requestContext returns the context a request from conn is handled with.
+func (s *socksServer) requestContext(conn net.Conn, authContext *socks5.AuthContext) context.Context {
+	var username string
+	if authContext != nil {
+		username = authContext.Payload["Username"]
+	}
+	ctx := withClientTag(context.Background(), clientTagFor(conn.RemoteAddr(), username))
+	ctx = withSOCKSClient(ctx, conn.RemoteAddr(), username)
+	if s.pool != nil {
+		ctx = withListenerPool(ctx, s.pool)
+	}
+	return ctx
+}
+
+// authPolicy returns the username/password store clients are checked
+// against, if any, and whether clients may skip authentication.
+func (s *socksServer) authPolicy() (store socks5.CredentialStore, noAuth bool) {
+	for _, a := range s.authMethods {
+		switch a := a.(type) {
+		case *socks5.UserPassAuthenticator:
+			store = a.Credentials
+		case *socks5.NoAuthAuthenticator:
+			noAuth = true
+		}
+	}
+	return store, noAuth
+}
+
+// authenticate negotiates an authentication method with the client, picking
+// the server's most preferred method that the client offers.
+func (s *socksServer) authenticate(conn io.Writer, bufConn *bufio.Reader) (*socks5.AuthContext, error) {
+	n, err := bufConn.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get auth methods: %w", err)
+	}
+	methods := make([]byte, n)
+	if _, err := io.ReadFull(bufConn, methods); err != nil {
+		return nil, fmt.Errorf("failed to get auth methods: %w", err)
+	}
+	for _, a := range s.authMethods {
+		if bytes.IndexByte(methods, a.GetCode()) >= 0 {
+			return a.Authenticate(bufConn, conn)
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, noAcceptable}); err != nil {
+		return nil, err
+	}
+	return nil, socks5.NoSupportedAuth
+}
+
+// handleRequest resolves the destination and dispatches on the command,
+// answering the client with reply.
+func (s *socksServer) handleRequest(ctx context.Context, req *socks5.Request, conn net.Conn, bufConn *bufio.Reader, reply replyFunc) error {
+	dest := req.DestAddr
+	if dest.FQDN != "" && resolveMode == resolveClient {
+		if err := reply(conn, replyAddrTypeNotSupported, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("hostname %q rejected, -resolve is %s", dest.FQDN, resolveClient)
+	}
+	if dest.FQDN != "" {
+		resolvedCtx, addr, err := s.resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			if err := reply(conn, replyHostUnreachable, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return fmt.Errorf("failed to resolve destination '%v': %w", dest.FQDN, err)
+		}
+		ctx = resolvedCtx
+		dest.IP = addr
+	}
+
+	switch req.Command {
+	case socks5.ConnectCommand:
+		return s.handleConnect(ctx, req, conn, bufConn, reply)
+	case socks5.BindCommand:
+		return s.handleBind(ctx, req, conn, bufConn, reply)
+	case socks5.AssociateCommand:
+		return s.handleAssociate(ctx, req, conn, bufConn, reply)
+	default:
+		if err := reply(conn, replyCommandNotSupported, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("unsupported command: %v", req.Command)
+	}
+}
+
+// handleConnect dials the destination and relays data until both sides
+// are done.
+func (s *socksServer) handleConnect(ctx context.Context, req *socks5.Request, conn net.Conn, bufConn *bufio.Reader, reply replyFunc) error {
+	ctx, ok := s.rules.Allow(ctx, req)
+	if !ok {
+		if err := reply(conn, replyRuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("connect to %v blocked by rules", req.DestAddr)
+	}
+
+	target, err := s.dial(ctx, "tcp", req.DestAddr.Address())
+	if err != nil {
+		resp := replyForError(err)
+		connLog(ctx).Debugw("Sending SOCKS failure reply",
+			"dest_addr", req.DestAddr.String(),
+			"reply", resp,
+			"error", err,
+		)
+		if err := reply(conn, resp, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("connect to %v failed: %w", req.DestAddr, err)
+	}
+	defer target.Close()
+
+	local := target.LocalAddr().(*net.TCPAddr)
+	bind := socks5.AddrSpec{IP: local.IP, Port: local.Port}
+	if err := reply(conn, replySucceeded, &bind); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	return relay(conn, bufConn, target)
+}
+
+// dialConnect resolves, checks and dials the destination of req the way
+// handleRequest does a CONNECT, for proxy front ends that need the
+// connection before they can answer the client.
+func (s *socksServer) dialConnect(ctx context.Context, req *socks5.Request) (net.Conn, error) {
+	dest := req.DestAddr
+	if dest.FQDN != "" {
+		if resolveMode == resolveClient {
+			return nil, fmt.Errorf("hostname %q rejected, -resolve is %s: %w", dest.FQDN, resolveClient, errBlocked)
+		}
+		resolvedCtx, addr, err := s.resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve destination '%v': %w", dest.FQDN, err)
+		}
+		ctx = resolvedCtx
+		dest.IP = addr
+	}
+	ctx, ok := s.rules.Allow(ctx, req)
+	if !ok {
+		return nil, fmt.Errorf("connect to %v: %w", dest, errBlocked)
+	}
+	if s.pool != nil {
+		ctx = withListenerPool(ctx, s.pool)
+	}
+	return s.dial(ctx, "tcp", dest.Address())
+}
+
+// relay copies data between the client and target until both sides are
+// done.
+func relay(conn io.Writer, bufConn io.Reader, target net.Conn) error {
+	errCh := make(chan error, 2)
+	go proxy(target, bufConn, errCh)
+	go proxy(conn, target, errCh)
+	for i := 0; i < 2; i++ {
+		// Without -half-close the first side to finish closes the upstream,
+		// so the other copy ending on a closed connection is expected.
+		if err := <-errCh; err != nil && !errors.Is(err, net.ErrClosed) {
+			// Returning lets the callers close target and conn.
+			return err
+		}
+	}
+	return nil
+}
+
+// logRequest logs a SOCKS request exactly as the client sent it, before any
+// resolution, at debug level.
+func logRequest(ctx context.Context, req *socks5.Request, client net.Addr) {
+	if !logLevel.Enabled(zap.DebugLevel) {
+		return
+	}
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	connLog(ctx).Debugw("SOCKS request",
+		"client_addr", client.String(),
+		"command", commandName(req.Command),
+		"atyp", atypName(req.DestAddr),
+		"dest_host", host,
+		"dest_port", req.DestAddr.Port,
+	)
+}
+
+func commandName(cmd uint8) string {
+	switch cmd {
+	case socks5.ConnectCommand:
+		return "CONNECT"
+	case socks5.BindCommand:
+		return "BIND"
+	case socks5.AssociateCommand:
+		return "UDP ASSOCIATE"
+	}
+	return fmt.Sprintf("unknown(%d)", cmd)
+}
+
+// atypName reports the address type the client used for addr.
+func atypName(addr *socks5.AddrSpec) string {
+	switch {
+	case addr.FQDN != "":
+		return "domain"
+	case addr.IP.To4() != nil:
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// replyForError maps a dial error to the most specific SOCKS5 reply code.
+func replyForError(err error) uint8 {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errEmptyPool), errors.Is(err, errNoAvailableIP):
+		return replyServerFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return replyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return replyHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return replyTTLExpired
+	}
+	// Fall back to go-socks5's message matching for errors without a
+	// usable errno.
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "refused"):
+		return replyConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return replyNetworkUnreachable
+	}
+	return replyHostUnreachable
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// proxy copies src to dst, then half-closes dst if it supports it.
+func proxy(dst io.Writer, src io.Reader, errCh chan error) {
+	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+	errCh <- err
+}
+
+// replyFunc writes a reply in the client's SOCKS version.
+type replyFunc func(w io.Writer, resp uint8, addr *socks5.AddrSpec) error
+
+// sendReply writes a SOCKS5 reply. A nil addr is sent as 0.0.0.0:0.
+func sendReply(w io.Writer, resp uint8, addr *socks5.AddrSpec) error {
+	var addrType uint8
+	var addrBody []byte
+	var addrPort uint16
+	switch {
+	case addr == nil:
+		addrType = atypIPv4
+		addrBody = []byte{0, 0, 0, 0}
+	case addr.FQDN != "":
+		addrType = atypFQDN
+		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
+		addrPort = uint16(addr.Port)
+	case addr.IP.To4() != nil:
+		addrType = atypIPv4
+		addrBody = addr.IP.To4()
+		addrPort = uint16(addr.Port)
+	case addr.IP.To16() != nil:
+		addrType = atypIPv6
+		addrBody = addr.IP.To16()
+		addrPort = uint16(addr.Port)
+	default:
+		return fmt.Errorf("failed to format address: %v", addr)
+	}
+
+	msg := make([]byte, 6+len(addrBody))
+	msg[0] = socks5Version
+	msg[1] = resp
+	msg[2] = 0 // Reserved
+	msg[3] = addrType
+	copy(msg[4:], addrBody)
+	msg[4+len(addrBody)] = byte(addrPort >> 8)
+	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	_, err := w.Write(msg)
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/armon/go-socks5"
+)
+
+const socks4Version = uint8(4)
+
+// SOCKS4 reply codes. SOCKS4 has no finer failure codes than rejected.
+const (
+	socks4Granted  = uint8(90)
+	socks4Rejected = uint8(91)
+)
+
+// maxSOCKS4Field bounds the NUL-terminated user ID and SOCKS4a hostname.
+const maxSOCKS4Field = 255
+
+// serveSOCKS4 serves a SOCKS4 or SOCKS4a request whose version byte has
+// already been read. SOCKS4 carries a user ID but no password, so it is
+// accepted only when the SOCKS5 side would accept the client without one:
+// with no-auth allowed, or when the user ID passes the credential check
+// with an empty password (as it does for username hints without
+// -authfile).
+func (s *socksServer) serveSOCKS4(conn net.Conn, bufConn *bufio.Reader) error {
+	var hdr [7]byte
+	if _, err := io.ReadFull(bufConn, hdr[:]); err != nil {
+		return fmt.Errorf("failed to read SOCKS4 request: %w", err)
+	}
+	cmd := hdr[0]
+	port := int(binary.BigEndian.Uint16(hdr[1:3]))
+	ip := net.IPv4(hdr[3], hdr[4], hdr[5], hdr[6])
+	userID, err := readNulString(bufConn)
+	if err != nil {
+		return fmt.Errorf("failed to read SOCKS4 user ID: %w", err)
+	}
+	if cmd != socks5.ConnectCommand && cmd != socks5.BindCommand {
+		sendReply4(conn, socks4Rejected, nil)
+		return fmt.Errorf("unsupported SOCKS4 command: %d", cmd)
+	}
+	dest := &socks5.AddrSpec{IP: ip, Port: port}
+	// SOCKS4a: an address of 0.0.0.x, x != 0, means a hostname follows.
+	if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+		host, err := readNulString(bufConn)
+		if err != nil {
+			return fmt.Errorf("failed to read SOCKS4a hostname: %w", err)
+		}
+		dest = &socks5.AddrSpec{FQDN: host, Port: port}
+	}
+
+	store, noAuth := s.authPolicy()
+	var authContext *socks5.AuthContext
+	switch {
+	case store != nil && userID != "" && store.Valid(userID, ""):
+		authContext = &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: map[string]string{"Username": userID}}
+	case !noAuth:
+		sendReply4(conn, socks4Rejected, nil)
+		err := errors.New("SOCKS4 client rejected, authentication is required")
+		connLogger().Infow("socks: rejecting client", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return err
+	}
+
+	req := &socks5.Request{Version: socks4Version, Command: cmd, DestAddr: dest, AuthContext: authContext}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		req.RemoteAddr = &socks5.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	ctx := s.requestContext(conn, authContext)
+	logRequest(ctx, req, conn.RemoteAddr())
+
+	if err := s.handleRequest(ctx, req, conn, bufConn, sendReply4); err != nil {
+		err = fmt.Errorf("failed to handle SOCKS4 request: %w", err)
+		connLog(ctx).Infow("socks: request failed", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return err
+	}
+	return nil
+}
+
+// readNulString reads a NUL-terminated string of at most maxSOCKS4Field
+// bytes.
+func readNulString(r *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) == maxSOCKS4Field {
+			return "", fmt.Errorf("field longer than %d bytes", maxSOCKS4Field)
+		}
+		b = append(b, c)
+	}
+}
+
+// sendReply4 writes a SOCKS4 reply. Every SOCKS5 failure code maps to
+// rejected, and an IPv6 or nil addr is sent as 0.0.0.0:0.
+func sendReply4(w io.Writer, resp uint8, addr *socks5.AddrSpec) error {
+	msg := make([]byte, 8)
+	msg[1] = socks4Rejected
+	if resp == replySucceeded || resp == socks4Granted {
+		msg[1] = socks4Granted
+	}
+	if addr != nil {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(msg[2:4], uint16(addr.Port))
+			copy(msg[4:], ip4)
+		}
+	}
+	_, err := w.Write(msg)
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+// dialError wraps errno the way a failed net.Dialer.DialContext does.
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+var replyTests = []struct {
+	name string
+	err  error
+	want uint8
+}{
+	{"refused", dialError(syscall.ECONNREFUSED), replyConnectionRefused},
+	{"network unreachable", dialError(syscall.ENETUNREACH), replyNetworkUnreachable},
+	{"host unreachable", dialError(syscall.EHOSTUNREACH), replyHostUnreachable},
+	{"dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, replyTTLExpired},
+	{"context deadline", fmt.Errorf("custom dialer: %w", context.DeadlineExceeded), replyTTLExpired},
+	{"wrapped refused", fmt.Errorf("custom dialer: %w", dialError(syscall.ECONNREFUSED)), replyConnectionRefused},
+	{"empty pool", fmt.Errorf("custom dialer: %w", errEmptyPool), replyServerFailure},
+	{"no available IP", fmt.Errorf("custom dialer: %w", errNoAvailableIP), replyServerFailure},
+	{"refused by message", errors.New("upstream: connection refused"), replyConnectionRefused},
+	{"unreachable by message", errors.New("upstream: network is unreachable"), replyNetworkUnreachable},
+	{"unknown", errors.New("something else"), replyHostUnreachable},
+}
+
+func TestReplyForError(t *testing.T) {
+	for _, tt := range replyTests {
+		if got := replyForError(tt.err); got != tt.want {
+			t.Errorf("%s: replyForError(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// denyAll is a rule set that blocks every request.
+type denyAll struct{}
+
+func (denyAll) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	return ctx, false
+}
+
+// connectReply sends a CONNECT to 192.0.2.1:80 to server over an in-memory
+// connection and returns the reply code the client receives.
+func connectReply(t *testing.T, server *socksServer) uint8 {
+	t.Helper()
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.ServeConn(conn)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+
+	if _, err := client.Write([]byte{socks5Version, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil {
+		t.Fatalf("reading method selection: %v", err)
+	}
+	if _, err := client.Write([]byte{socks5Version, 1, 0, atypIPv4, 192, 0, 2, 1, 0, 80}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	return reply[1]
+}
+
+func TestConnectFailureReplies(t *testing.T) {
+	for _, tt := range replyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newSOCKSServer(&socks5.Config{
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return nil, tt.err
+				},
+			})
+			if got := connectReply(t, server); got != tt.want {
+				t.Errorf("client got reply %d, want %d", got, tt.want)
+			}
+		})
+	}
+	t.Run("rule denial", func(t *testing.T) {
+		server := newSOCKSServer(&socks5.Config{
+			Rules: denyAll{},
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				t.Error("denied request was dialed")
+				return nil, errors.New("unreachable")
+			},
+		})
+		if got := connectReply(t, server); got != replyRuleFailure {
+			t.Errorf("client got reply %d, want %d", got, replyRuleFailure)
+		}
+	})
+}
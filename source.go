@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// poolSources are the flags that make up the primary pool, kept so the
+// pool can be rebuilt when its sources change.
+type poolSources struct {
+	files         []string
+	tag           string
+	cidrs         []string
+	ranges        []string
+	start, end    string
+	excludes      []string
+	warnSpecial   bool
+	strictSpecial bool
+	specialPrefix int
+	autoExclude   bool
+	listenHosts   []string
+	mgmtIPs       string
+	shuffle       bool
+}
+
+// empty reports whether no pool source was given at all.
+func (src poolSources) empty() bool {
+	return len(src.files) == 0 && len(src.cidrs) == 0 && len(src.ranges) == 0 && src.start == "" && src.end == ""
+}
+
+// buildPool merges every source into a pool and applies exclusions,
+// special-address checks and shuffling. Every pool source is additive;
+// duplicates across sources are dropped. rng drives -sample and -shuffle.
+func buildPool(src poolSources, rng *rand.Rand) (*ipPool, error) {
+	var pool ipSet
+	var fileEntries []ipEntry
+	if len(src.files) > 0 {
+		var err error
+		fileEntries, err = loadIPFiles(src.files, src.tag, "tcp")
+		if err != nil && !errors.Is(err, errEmptyPool) {
+			return nil, fmt.Errorf("failed loading IPs from file: %w", err)
+		}
+		ivs := entryIntervals(fileEntries)
+		sugar.Infof("Loaded %s IPs from %d file(s): %s", countIPs(ivs), len(src.files), strings.Join(src.files, ","))
+		if src.tag != "" {
+			sugar.Infof("Pool restricted to IPs tagged %q", src.tag)
+		}
+		pool.add(ivs)
+	}
+	for _, cidr := range src.cidrs {
+		iv, err := cidrInterval(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -cidr: %w", err)
+		}
+		ivs := sampleInterval(iv, rng)
+		added := pool.add(ivs)
+		sugar.Infof("Using CIDR %s with %s IPs (%s new)", cidr, countIPs(ivs), added)
+	}
+	for _, spec := range src.ranges {
+		start, end, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid -range %q (want start-end, e.g. 10.1.0.1-10.1.0.254)", spec)
+		}
+		iv, err := parseIPRange(strings.TrimSpace(start), strings.TrimSpace(end))
+		if err != nil {
+			return nil, fmt.Errorf("invalid -range: %w", err)
+		}
+		ivs := sampleInterval(iv, rng)
+		added := pool.add(ivs)
+		sugar.Infof("Using range %s with %s IPs (%s new)", spec, countIPs(ivs), added)
+	}
+	switch {
+	case strings.Contains(src.start, "/"):
+		if src.end != "" {
+			return nil, fmt.Errorf("-start %s already has a CIDR suffix; do not also pass -end", src.start)
+		}
+		iv, err := cidrInterval(src.start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range: %w", err)
+		}
+		ivs := sampleInterval(iv, rng)
+		added := pool.add(ivs)
+		sugar.Infof("Using IP range with %s IPs (%s new): %s", countIPs(ivs), added, src.start)
+	case src.start != "" && src.end != "":
+		iv, err := parseIPRange(src.start, src.end)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range: %w", err)
+		}
+		ivs := sampleInterval(iv, rng)
+		added := pool.add(ivs)
+		sugar.Infof("Using IP range with %s IPs (%s new): %s - %s", countIPs(ivs), added, src.start, src.end)
+	case src.start != "" || src.end != "":
+		return nil, errors.New("-start and -end must be given together (or -start as a CIDR)")
+	}
+	ips := pool.pool
+
+	if len(src.excludes) > 0 {
+		exclusions, err := parseExclusions(src.excludes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -exclude: %w", err)
+		}
+		before := ips.total()
+		ips = ips.without(exclusions)
+		sugar.Infof("Excluded %s IPs from the pool (%s remain)", countString(before.sub(ips.total())), ips.count())
+	}
+
+	if src.warnSpecial || src.strictSpecial {
+		ips = checkSpecial(ips, src.specialPrefix, src.strictSpecial)
+	}
+
+	if src.autoExclude {
+		own, err := ownAddresses(src.listenHosts, src.mgmtIPs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine the proxy's own addresses: %w", err)
+		}
+		var drop []ipInterval
+		for _, ip := range own {
+			if ips.contains(ip) {
+				sugar.Warnw("Auto-excluded the proxy's own address from the pool", "ip", ip.String())
+				drop = append(drop, singleIP(ip))
+			}
+		}
+		ips = ips.without(drop)
+	}
+
+	ips = applyPoolEdits(ips).weighted(fileEntries)
+
+	if src.shuffle {
+		var ok bool
+		if ips, ok = ips.shuffled(rng); ok {
+			sugar.Infow("Shuffled IP pool", "pool_size", ips.count())
+		} else {
+			sugar.Warnw("IP pool is too large to shuffle, keeping address order", "pool_size", ips.count())
+		}
+	}
+	return ips, nil
+}
+
+var (
+	// refreshMu serializes pool rebuilds and admin edits.
+	refreshMu sync.Mutex
+	// poolRand drives -sample and -shuffle on rebuilds. Guarded by
+	// refreshMu.
+	poolRand *rand.Rand
+	// poolEdits are pool changes made through the admin API. Every rebuild
+	// re-applies them, so a refresh does not undo them. Guarded by
+	// refreshMu.
+	poolEdits struct {
+		added, removed []ipInterval
+	}
+)
+
+// rebuildPool rebuilds the pool from src and installs it. A pool with the
+// same addresses as the active one is not installed, so coverage progress
+// survives refreshes that change nothing. On error the active pool is
+// kept.
+func rebuildPool(src poolSources, reason string) error {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	ips, err := buildPool(src, poolRand)
+	if err != nil {
+		return err
+	}
+	if samePool(ips, currentPool()) {
+		sugar.Debugw("IP pool unchanged", "reason", reason, "pool_size", ips.count())
+		return nil
+	}
+	old := currentPool()
+	if err := setPool(ips); err != nil {
+		return err
+	}
+	if currentPool() != old {
+		sugar.Infow("Installed new IP pool", "reason", reason, "pool_size", currentPool().count())
+	}
+	return nil
+}
+
+// samePool reports whether a and b hold the same addresses with the same
+// weights, ignoring shuffling.
+func samePool(a, b *ipPool) bool {
+	if a == nil || b == nil {
+		return a.empty() && b.empty()
+	}
+	return sameIntervals(a, b) && a.weights.equal(b.weights)
+}
+
+// sameIntervals reports whether a and b hold the same addresses.
+func sameIntervals(a, b *ipPool) bool {
+	aIvs, bIvs := a.intervals(), b.intervals()
+	if len(aIvs) != len(bIvs) {
+		return false
+	}
+	for i := range aIvs {
+		if aIvs[i] != bIvs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshPool rebuilds the pool from src every interval, re-reading -file
+// paths and URLs. Failed refreshes are logged and keep the active pool.
+func refreshPool(src poolSources, interval time.Duration) {
+	sugar.Infow("Refreshing IP pool periodically", "interval", interval.String(), "files", strings.Join(src.files, ","))
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := rebuildPool(src, "refresh"); err != nil {
+				sugar.Errorw("IP pool refresh failed, keeping the active pool", "error", err)
+			}
+		}
+	}()
+}
+
+// applyPoolEdits adds and removes the admin API's edits to p.
+func applyPoolEdits(p *ipPool) *ipPool {
+	if len(poolEdits.added) > 0 {
+		p = newIPPool(append(p.intervals(), poolEdits.added...))
+	}
+	return p.without(poolEdits.removed)
+}
+
+// editPool records an admin edit and applies it to the active pool. An
+// address is either added or removed, so a later edit overrides an earlier
+// one. Weights from IP files are reapplied, and a shuffled pool is
+// reshuffled, since the pool's offsets changed.
+func editPool(add, remove []ipInterval) error {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	added := newIPPool(poolEdits.added).without(remove)
+	removed := newIPPool(poolEdits.removed).without(add)
+	if len(add) > 0 {
+		added = newIPPool(append(added.intervals(), add...))
+	}
+	if len(remove) > 0 {
+		removed = newIPPool(append(removed.intervals(), remove...))
+	}
+
+	old := currentPool()
+	ips := old
+	if len(add) > 0 {
+		ips = newIPPool(append(ips.intervals(), add...))
+	}
+	ips = ips.without(remove)
+	if old != nil && old.weights != nil {
+		ips = ips.weighted(old.weights.entries)
+	}
+	if old != nil && old.perm != nil {
+		ips, _ = ips.shuffled(poolRand)
+	}
+	if err := setPool(ips); err != nil {
+		return err
+	}
+	poolEdits.added, poolEdits.removed = added.intervals(), removed.intervals()
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// specialBlock is a set of addresses that share a special purpose.
+type specialBlock struct {
+	reason string
+	ivs    []ipInterval
+}
+
+func newSpecialBlock(reason string, cidrs ...string) specialBlock {
+	b := specialBlock{reason: reason}
+	for _, cidr := range cidrs {
+		iv, err := cidrInterval(cidr)
+		if err != nil {
+			panic(err)
+		}
+		b.ivs = append(b.ivs, iv)
+	}
+	return b
+}
+
+var (
+	unspecifiedBlock = newSpecialBlock("unspecified", "0.0.0.0/32", "::/128")
+	multicastBlock   = newSpecialBlock("multicast", "224.0.0.0/4", "ff00::/8")
+	broadcastBlock   = newSpecialBlock("limited broadcast", "255.255.255.255/32")
+)
+
+// specialBlocks are poor spoof sources: anything that is not ordinary
+// unicast.
+var specialBlocks = []specialBlock{
+	unspecifiedBlock,
+	newSpecialBlock("loopback", "127.0.0.0/8", "::1/128"),
+	multicastBlock,
+	broadcastBlock,
+	newSpecialBlock("link-local", "169.254.0.0/16", "fe80::/10"),
+}
+
+// unusableBlocks can never be a source address. Unlike specialBlocks they
+// leave out addresses such as loopback that are odd but still bindable.
+var unusableBlocks = []specialBlock{unspecifiedBlock, multicastBlock, broadcastBlock}
+
+// subnetEdges returns the IPv4 network and broadcast addresses of every
+// prefixLen subnet that p overlaps. Values of 31 or more return nothing.
+func subnetEdges(p *ipPool, prefixLen int) (network, broadcast specialBlock) {
+	network.reason, broadcast.reason = "network address", "broadcast address"
+	if prefixLen <= 0 || prefixLen >= 31 {
+		return network, broadcast
+	}
+	blockSize := uint64(1) << (32 - prefixLen)
+	for _, r := range p.intervals() {
+		if !r.v4 {
+			continue
+		}
+		// IPv4 addresses sit in the low 32 bits of the mapped form.
+		for base := r.lo.lo &^ (blockSize - 1); base <= r.hi.lo; base += blockSize {
+			if first := (u128{r.lo.hi, base}); !first.less(r.lo) {
+				network.ivs = append(network.ivs, ipInterval{lo: first, hi: first, v4: true})
+			}
+			if last := (u128{r.lo.hi, base + blockSize - 1}); !r.hi.less(last) {
+				broadcast.ivs = append(broadcast.ivs, ipInterval{lo: last, hi: last, v4: true})
+			}
+		}
+	}
+	return network, broadcast
+}
+
+// specialHit is the part of a pool that falls in one special block.
+type specialHit struct {
+	block specialBlock
+	ips   *ipPool
+}
+
+// specialBlocksFor returns the special blocks to check p against: the
+// fixed ones plus the network and broadcast addresses of its prefixLen
+// subnets.
+func specialBlocksFor(p *ipPool, prefixLen int) []specialBlock {
+	network, broadcast := subnetEdges(p, prefixLen)
+	return append(append([]specialBlock(nil), specialBlocks...), network, broadcast)
+}
+
+// findSpecial returns each kind of special-purpose IP in p.
+func findSpecial(p *ipPool, prefixLen int) []specialHit {
+	var hits []specialHit
+	for _, b := range specialBlocksFor(p, prefixLen) {
+		if hit := p.intersect(b.ivs); !hit.empty() {
+			hits = append(hits, specialHit{block: b, ips: hit})
+		}
+	}
+	return hits
+}
+
+// checkSpecial logs a warning for each kind of special-purpose IP in p,
+// with a count and an example. prefixLen is the subnet size used to spot
+// network and broadcast addresses. When strict is set those IPs are
+// dropped from the returned pool.
+func checkSpecial(p *ipPool, prefixLen int, strict bool) *ipPool {
+	var dropped u128
+	for _, b := range specialBlocksFor(p, prefixLen) {
+		hit := p.intersect(b.ivs)
+		if hit.empty() {
+			continue
+		}
+		sugar.Warnw("Pool contains special-purpose IPs",
+			"reason", b.reason,
+			"count", hit.count(),
+			"example", hit.at(u128{}).String(),
+			"prefix_len", prefixLen,
+			"dropped", strict,
+		)
+		if strict {
+			dropped = dropped.add(hit.total())
+			p = p.without(b.ivs)
+		}
+	}
+	if dropped != (u128{}) {
+		sugar.Warnf("Dropped %s special-purpose IPs from the pool (-strict-special)", countString(dropped))
+	}
+	return p
+}
+
+// dropUnusable removes addresses that can never be a source IP. It returns
+// the remaining pool and a summary of what was removed, such as
+// "2 unspecified, 1 multicast", or "" if nothing was.
+func dropUnusable(p *ipPool) (*ipPool, string) {
+	var reasons []string
+	for _, b := range unusableBlocks {
+		hit := p.intersect(b.ivs)
+		if hit.empty() {
+			continue
+		}
+		reasons = append(reasons, fmt.Sprintf("%s %s", hit.count(), b.reason))
+		p = p.without(b.ivs)
+	}
+	sort.Strings(reasons)
+	return p, strings.Join(reasons, ", ")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshFiles is the reloadable configuration of the -ssh-listen server: its
+// host key and the authorized_keys clients must be listed in.
+type sshFiles struct {
+	hostKeyFile, authorizedKeysFile string
+	cfg                             atomic.Pointer[ssh.ServerConfig]
+}
+
+// sshHandshakeTimeout bounds how long an SSH client may take to
+// authenticate.
+const sshHandshakeTimeout = 30 * time.Second
+
+// listenSSH holds the -ssh-listen settings, or nil when the SSH server is
+// off.
+var listenSSH *sshFiles
+
+func newSSHFiles(hostKeyFile, authorizedKeysFile string) (*sshFiles, error) {
+	f := &sshFiles{hostKeyFile: hostKeyFile, authorizedKeysFile: authorizedKeysFile}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload re-reads the host key and authorized keys. On failure the
+// previous configuration stays in effect; connected clients are untouched.
+func (f *sshFiles) Reload() error {
+	pem, err := os.ReadFile(f.hostKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read SSH host key '%s': %w", f.hostKeyFile, err)
+	}
+	hostKey, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return fmt.Errorf("failed to parse SSH host key '%s': %w", f.hostKeyFile, err)
+	}
+	data, err := os.ReadFile(f.authorizedKeysFile)
+	if err != nil {
+		return fmt.Errorf("failed to read SSH authorized keys '%s': %w", f.authorizedKeysFile, err)
+	}
+	var keys [][]byte
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse SSH authorized keys '%s': %w", f.authorizedKeysFile, err)
+		}
+		keys = append(keys, key.Marshal())
+		data = rest
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys found in SSH authorized keys '%s'", f.authorizedKeysFile)
+	}
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range keys {
+				if bytes.Equal(k, key.Marshal()) {
+					return &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": ssh.FingerprintSHA256(key)}}, nil
+				}
+			}
+			return nil, errors.New("unknown public key")
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	f.cfg.Store(cfg)
+	return nil
+}
+
+// serveSSH serves SSH clients on addr, a -ssh-listen value, until the
+// process exits. Clients forward connections with the usual tools, such
+// as ssh -D or -L, and each forwarded connection is dialed like a SOCKS
+// CONNECT, sharing the rules and pool. The SSH user name stands in for
+// the SOCKS username in client tags and sticky selection.
+func serveSSH(s *socksServer, files *sshFiles, addr string) error {
+	network, address := splitListenAddr(addr)
+	l, err := listenPlain(network, address, "")
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveSSHConn(files, conn)
+	}
+}
+
+func (s *socksServer) serveSSHConn(files *sshFiles, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, files.cfg.Load())
+	if err != nil {
+		connLogger().Infow("ssh: handshake failed", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sshConn.Close()
+	connLogger().Infow("ssh: client connected",
+		"client_addr", conn.RemoteAddr().String(),
+		"user", sshConn.User(),
+		"key", sshConn.Permissions.Extensions["pubkey-fp"],
+	)
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "direct-tcpip" {
+			newChan.Reject(ssh.UnknownChannelType, "only port forwarding is supported")
+			continue
+		}
+		go s.handleDirectTCPIP(sshConn, newChan)
+	}
+}
+
+// directTCPIP is the payload of a direct-tcpip channel request (RFC 4254
+// section 7.2).
+type directTCPIP struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// handleDirectTCPIP dials a forwarded connection's destination and relays
+// the channel to it. A failed dial rejects the channel.
+func (s *socksServer) handleDirectTCPIP(sshConn *ssh.ServerConn, newChan ssh.NewChannel) {
+	if draining.Load() {
+		drainRejected.Inc()
+		newChan.Reject(ssh.ResourceShortage, "proxy is draining")
+		return
+	}
+	activeSessions.Add(1)
+	defer activeSessions.Add(-1)
+
+	var msg directTCPIP
+	if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+	dest, err := parseDest(net.JoinHostPort(msg.Host, fmt.Sprint(msg.Port)))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	client := sshConn.RemoteAddr()
+	authContext := &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: map[string]string{"Username": sshConn.User()}}
+	req := &socks5.Request{Version: socks5Version, Command: socks5.ConnectCommand, DestAddr: dest, AuthContext: authContext}
+	if tcpAddr, ok := client.(*net.TCPAddr); ok {
+		req.RemoteAddr = &socks5.AddrSpec{IP: tcpAddr.IP, Port: tcpAddr.Port}
+	}
+	ctx := withClientTag(context.Background(), clientTagFor(client, sshConn.User()))
+	ctx = withSOCKSClient(ctx, client, sshConn.User())
+	logRequest(ctx, req, client)
+
+	target, err := s.dialConnect(ctx, req)
+	if err != nil {
+		reason := ssh.ConnectionFailed
+		if errors.Is(err, errBlocked) {
+			reason = ssh.Prohibited
+		}
+		newChan.Reject(reason, err.Error())
+		connLog(ctx).Infow("ssh: request failed", "client_addr", client.String(), "error", err)
+		return
+	}
+	defer target.Close()
+	ch, chReqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(chReqs)
+	if err := relay(sshChannel{ch}, ch, target); err != nil {
+		connLog(ctx).Infow("ssh: relay failed", "client_addr", client.String(), "error", err)
+	}
+}
+
+// sshChannel applies -half-close to a forwarded channel: without it, the
+// end of the upstream's data closes the channel in both directions.
+type sshChannel struct {
+	ssh.Channel
+}
+
+func (c sshChannel) CloseWrite() error {
+	if halfClose {
+		return c.Channel.CloseWrite()
+	}
+	return c.Channel.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stickyDestTTL keeps each destination on the same source IP for this long
+// after its last dial; 0 disables destination affinity.
+var stickyDestTTL time.Duration
+
+// stickyClientTTL keeps each SOCKS client on the same source IP for this
+// long after its last dial; 0 disables client affinity.
+var stickyClientTTL time.Duration
+
+// Values for -sticky-client-key.
+const (
+	stickyByAddr = "addr"
+	stickyByUser = "user"
+)
+
+// stickyClientKey is how SOCKS clients are told apart for client affinity.
+var stickyClientKey = stickyByAddr
+
+// rotateEvery holds one source IP for all dials for this long before
+// rotating to the next; 0 picks per dial.
+var rotateEvery time.Duration
+
+// stickySelector reuses the IP next chose for an earlier dial with the same
+// key, until the key has been idle for ttl, or with fixed set until ttl
+// after the IP was chosen. A remembered IP that has left the pool or
+// become unavailable is replaced.
+type stickySelector struct {
+	next  SourceSelector
+	ttl   time.Duration
+	fixed bool
+	kind  string // for logs
+	key   func(ctx context.Context, network, destAddr string) string
+
+	mu        sync.Mutex
+	entries   map[string]stickyEntry
+	lastSweep time.Time
+}
+
+type stickyEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func newStickySelector(next SourceSelector, ttl time.Duration, kind string, key func(ctx context.Context, network, destAddr string) string) *stickySelector {
+	return &stickySelector{next: next, ttl: ttl, kind: kind, key: key, entries: make(map[string]stickyEntry)}
+}
+
+// stickyScope separates UDP keys from TCP ones, since they may draw from
+// different pools.
+func stickyScope(network string) string {
+	if strings.HasPrefix(network, "udp") {
+		return "udp "
+	}
+	return "tcp "
+}
+
+// destKey keys destination affinity by dial address.
+func destKey(ctx context.Context, network, destAddr string) string {
+	return stickyScope(network) + destAddr
+}
+
+// windowKey shares one IP among all dials of a pool and address family.
+func windowKey(ctx context.Context, network, destAddr string) string {
+	return stickyScope(network) + destFamily(network, destAddr)
+}
+
+// socksClient identifies the SOCKS client a dial is made for.
+type socksClient struct {
+	ip      string
+	account string
+}
+
+// withSOCKSClient records the client's address and account name on ctx.
+// Username hints are stripped so the same account maps to the same key.
+func withSOCKSClient(ctx context.Context, addr net.Addr, username string) context.Context {
+	client := socksClient{}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		client.ip = tcpAddr.IP.String()
+	}
+	if username != "" {
+		client.account, _ = parseUsername(username)
+	}
+	return context.WithValue(ctx, ctxSOCKSClient, client)
+}
+
+// clientKey keys client affinity by the client's IP, or by its account
+// name under -sticky-client-key user. Clients without an account fall back
+// to their IP. Dials without a client, such as DNS lookups, are not sticky.
+func clientKey(ctx context.Context, network, destAddr string) string {
+	client, ok := ctx.Value(ctxSOCKSClient).(socksClient)
+	if !ok {
+		return ""
+	}
+	if stickyClientKey == stickyByUser && client.account != "" {
+		return stickyScope(network) + "user " + client.account
+	}
+	if client.ip == "" {
+		return ""
+	}
+	return stickyScope(network) + "addr " + client.ip
+}
+
+func (s *stickySelector) Select(ctx context.Context, network, destAddr string) (net.IP, error) {
+	key := s.key(ctx, network, destAddr)
+	if key == "" {
+		return s.next.Select(ctx, network, destAddr)
+	}
+	now := time.Now()
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if ok && now.Before(e.expires) && stickyUsable(e.ip, network, destAddr) {
+		if !s.fixed {
+			e.expires = now.Add(s.ttl)
+			s.entries[key] = e
+		}
+		s.mu.Unlock()
+		return cloneIP(e.ip), nil
+	}
+	s.mu.Unlock()
+
+	ip, err := s.next.Select(ctx, network, destAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = stickyEntry{ip: cloneIP(ip), expires: now.Add(s.ttl)}
+	if now.Sub(s.lastSweep) > s.ttl {
+		for k, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if ok {
+		connLog(ctx).Debugw("Sticky source IP reassigned", "kind", s.kind, "key", key, "old_ip", e.ip.String(), "local_ip", ip.String())
+	}
+	return ip, nil
+}
+
+// stickyUsable reports whether a remembered ip may still be used for a dial
+// to destAddr on network: it is still in a pool, healthy, and of the
+// destination's family.
+func stickyUsable(ip net.IP, network, destAddr string) bool {
+	if !poolFor(network).contains(ip) && !fallbackList.contains(ip) {
+		return false
+	}
+	if family := destFamily(network, destAddr); family != "" && ipFamily(ip) != family {
+		return false
+	}
+	return ipAvailable(ip)
+}
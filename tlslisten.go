@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// listenTLS holds the -tls-cert settings, or nil when TCP listeners serve
+// plain SOCKS.
+var listenTLS *tlsFiles
+
+// tlsFiles is the reloadable TLS configuration of the SOCKS listeners.
+// With a client CA, clients must present a certificate it signed.
+type tlsFiles struct {
+	certFile, keyFile, clientCAFile string
+	cfg                             atomic.Pointer[tls.Config]
+}
+
+func newTLSFiles(certFile, keyFile, clientCAFile string) (*tlsFiles, error) {
+	t := &tlsFiles{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload re-reads the certificate, key and client CA. On failure the
+// previous configuration stays in effect. New connections pick up the
+// change; established ones are untouched.
+func (t *tlsFiles) Reload() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate '%s': %w", t.certFile, err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.clientCAFile != "" {
+		pem, err := os.ReadFile(t.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS client CA '%s': %w", t.clientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no PEM certificates found in TLS client CA '%s'", t.clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	t.cfg.Store(cfg)
+	return nil
+}
+
+// wrap returns l serving TLS with the current configuration.
+func (t *tlsFiles) wrap(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.cfg.Load(), nil
+		},
+	})
+}
+
+// rawConn returns the TCP connection under a TLS or PROXY protocol client
+// connection, or conn itself.
+func rawConn(conn net.Conn) net.Conn {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return rawConn(c.NetConn())
+	case *proxyConn:
+		return c.Conn
+	}
+	return conn
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/armon/go-socks5"
+)
+
+// Values for -transparent-mode.
+const (
+	transparentRedirect = "redirect"
+	transparentTProxy   = "tproxy"
+)
+
+// transparentPort is the port of the -transparent listener.
+var transparentPort int
+
+// Socket options missing from package syscall.
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT
+	sockaddrInet4Size = 16
+)
+
+// transparentControl sets IP_TRANSPARENT on a -transparent-mode tproxy
+// listener, so it accepts connections addressed to any IP.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+			if opErr != nil {
+				return
+			}
+		}
+		// A dual-stack socket also needs IP_TRANSPARENT for IPv4 clients,
+		// which a v6-only one may refuse.
+		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1)
+		if network != "tcp6" {
+			opErr = err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if opErr != nil {
+		return fmt.Errorf("failed to set IP_TRANSPARENT (needs CAP_NET_ADMIN): %w", opErr)
+	}
+	return nil
+}
+
+// serveTransparent serves a connection intercepted by iptables, dialing
+// its original destination from a pool IP as if a SOCKS client had asked
+// for it.
+func (s *socksServer) serveTransparent(conn net.Conn) error {
+	dest, err := originalDst(conn, s.transparent)
+	if err != nil {
+		connLogger().Infow("transparent: rejecting client", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return err
+	}
+	req := &socks5.Request{Version: socks5Version, Command: socks5.ConnectCommand, DestAddr: &socks5.AddrSpec{IP: dest.IP, Port: dest.Port}}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		req.RemoteAddr = &socks5.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	ctx := s.requestContext(conn, nil)
+	logRequest(ctx, req, conn.RemoteAddr())
+	if err := s.handleRequest(ctx, req, conn, bufio.NewReader(conn), noReply); err != nil {
+		err = fmt.Errorf("failed to handle transparent connection: %w", err)
+		connLog(ctx).Infow("transparent: request failed", "client_addr", conn.RemoteAddr().String(), "error", err)
+		return err
+	}
+	return nil
+}
+
+// noReply is the replyFunc of transparent connections, whose clients do
+// not know a proxy is involved. A failed dial just closes the connection.
+func noReply(w io.Writer, resp uint8, addr *socks5.AddrSpec) error {
+	return nil
+}
+
+// originalDst returns where an intercepted connection was headed: the
+// SO_ORIGINAL_DST of a REDIRECTed connection, or the local address of a
+// TPROXY one. A connection made straight to the listener is refused, as
+// dialing it would loop back to the proxy.
+func originalDst(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	if mode == transparentTProxy {
+		if local.Port == transparentPort {
+			return nil, fmt.Errorf("connection to the proxy's own port %d was not intercepted", local.Port)
+		}
+		return local, nil
+	}
+	var tcpConn *net.TCPConn
+	switch c := conn.(type) {
+	case *clientConn:
+		tcpConn = c.TCPConn
+	case *net.TCPConn:
+		tcpConn = c
+	default:
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dest *net.TCPAddr
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		dest, optErr = getOriginalDst(int(fd), local.IP.To4() == nil)
+	}); err != nil {
+		return nil, err
+	}
+	if optErr != nil {
+		return nil, fmt.Errorf("failed to read SO_ORIGINAL_DST, was the connection REDIRECTed?: %w", optErr)
+	}
+	if dest.IP.Equal(local.IP) && dest.Port == local.Port {
+		return nil, fmt.Errorf("connection to %v was not intercepted", local)
+	}
+	return dest, nil
+}
+
+// getOriginalDst reads SO_ORIGINAL_DST, or IP6T_SO_ORIGINAL_DST for an
+// IPv6 client. The syscall package has no getsockopt for a sockaddr, so it
+// borrows the ones of same-sized structs, as is customary. IPv4 clients of
+// a dual-stack socket are read as IPv4, the family conntrack saw.
+func getOriginalDst(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	if ipv6 {
+		info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			return nil, err
+		}
+		// Port is in network byte order.
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		return &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(port[0])<<8 | int(port[1])}, nil
+	}
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	sa := mreq.Multiaddr[:sockaddrInet4Size]
+	return &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(sa[2])<<8 | int(sa[3])}, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// maxDatagram is the largest UDP payload relayed.
+const maxDatagram = 65535
+
+// udpAssociation relays the datagrams of one UDP ASSOCIATE. The client
+// sends to relay, a socket on the address it reached the proxy on; each
+// destination address family gets an upstream socket bound to a pool IP,
+// picked when the association first sends to that family. The association
+// lasts as long as the client's TCP connection.
+type udpAssociation struct {
+	ctx      context.Context
+	resolver socks5.NameResolver
+	rules    socks5.RuleSet
+	relay    *net.UDPConn
+	clientIP net.IP
+
+	mu       sync.Mutex
+	client   *net.UDPAddr // where replies go, learned from the first datagram
+	upstream map[string]*net.UDPConn
+	closed   bool
+}
+
+// handleAssociate serves a UDP ASSOCIATE request. The request's address is
+// where the client will send from; an unspecified IP or zero port is
+// learned from the first datagram instead. Datagrams from other IPs than
+// the client's TCP connection are dropped.
+func (s *socksServer) handleAssociate(ctx context.Context, req *socks5.Request, conn net.Conn, bufConn *bufio.Reader, reply replyFunc) error {
+	ctx, ok := s.rules.Allow(ctx, req)
+	if !ok {
+		if err := reply(conn, replyRuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("associate from %v blocked by rules", req.DestAddr)
+	}
+	local, okLocal := conn.LocalAddr().(*net.TCPAddr)
+	remote, okRemote := conn.RemoteAddr().(*net.TCPAddr)
+	if !okLocal || !okRemote {
+		if err := reply(conn, replyCommandNotSupported, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return errors.New("UDP ASSOCIATE needs a TCP client connection")
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		if err := reply(conn, replyServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("failed to open UDP relay: %w", err)
+	}
+
+	a := &udpAssociation{
+		ctx:      ctx,
+		resolver: s.resolver,
+		rules:    s.rules,
+		relay:    relay,
+		clientIP: remote.IP,
+		upstream: make(map[string]*net.UDPConn),
+	}
+	if ip := req.DestAddr.IP; ip != nil && !ip.IsUnspecified() && req.DestAddr.Port != 0 {
+		a.client = &net.UDPAddr{IP: ip, Port: req.DestAddr.Port}
+	}
+	defer a.close()
+
+	bindPort := relay.LocalAddr().(*net.UDPAddr).Port
+	if err := reply(conn, replySucceeded, &socks5.AddrSpec{IP: local.IP, Port: bindPort}); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	connLog(ctx).Infow("UDP association established",
+		"client_addr", remote.String(),
+		"relay_addr", relay.LocalAddr().String(),
+	)
+
+	go a.fromClient()
+	// The association ends when the client closes its TCP connection.
+	if _, err := io.Copy(io.Discard, bufConn); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	a.relay.Close()
+	for _, up := range a.upstream {
+		up.Close()
+	}
+}
+
+// fromClient relays the client's datagrams to their destinations.
+// Datagrams to ports the rules refuse are dropped. Send outcomes feed the
+// source IP's quarantine and circuit breaker the way dial outcomes do:
+// every failed send counts, but only the first successful send on each
+// upstream socket, so a chatty association cannot mask its failures.
+func (a *udpAssociation) fromClient() {
+	log := connLog(a.ctx)
+	buf := make([]byte, maxDatagram)
+	confirmed := make(map[*net.UDPConn]bool)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.acceptFrom(from) {
+			log.Debugw("Dropping UDP datagram from another address", "from", from.String())
+			continue
+		}
+		dest, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			log.Debugw("Dropping malformed UDP datagram", "from", from.String(), "error", err)
+			continue
+		}
+		if dr, ok := a.rules.(datagramRule); ok && !dr.allowDatagram(dest.Port) {
+			log.Debugw("Dropping UDP datagram to denied port", "dest_addr", dest.String(), "dest_port", dest.Port)
+			continue
+		}
+		dst, err := a.resolve(dest)
+		if err != nil {
+			log.Debugw("Dropping UDP datagram", "dest_addr", dest.String(), "error", err)
+			continue
+		}
+		up, err := a.upstreamFor(dst)
+		if err != nil {
+			log.Errorw("Failed to open UDP upstream socket", "dest_addr", dst.String(), "error", err)
+			continue
+		}
+		localIP := up.LocalAddr().(*net.UDPAddr).IP
+		if _, err := up.WriteToUDP(payload, dst); err != nil {
+			log.Debugw("Failed to send UDP datagram", "dest_addr", dst.String(), "local_ip", localIP.String(), "error", err)
+			recordDial(localIP, true)
+			recordCircuit(localIP, true)
+			continue
+		}
+		if !confirmed[up] {
+			confirmed[up] = true
+			recordDial(localIP, false)
+			recordCircuit(localIP, false)
+		}
+	}
+}
+
+// acceptFrom reports whether a datagram from addr belongs to the client,
+// learning the client's address from its first datagram.
+func (a *udpAssociation) acceptFrom(addr *net.UDPAddr) bool {
+	if !addr.IP.Equal(a.clientIP) {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = addr
+		return true
+	}
+	return a.client.IP.Equal(addr.IP) && a.client.Port == addr.Port
+}
+
+// resolve returns the UDP address of a datagram's destination.
+func (a *udpAssociation) resolve(dest *socks5.AddrSpec) (*net.UDPAddr, error) {
+	if dest.FQDN == "" {
+		return &net.UDPAddr{IP: dest.IP, Port: dest.Port}, nil
+	}
+	if resolveMode == resolveClient {
+		return nil, fmt.Errorf("hostname %q rejected, -resolve is %s", dest.FQDN, resolveClient)
+	}
+	_, ip, err := a.resolver.Resolve(a.ctx, dest.FQDN)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: dest.Port}, nil
+}
+
+// upstreamFor returns the upstream socket for dst's address family,
+// opening it from a freshly selected pool IP on first use.
+func (a *udpAssociation) upstreamFor(dst *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if dst.IP.To4() != nil {
+		network = "udp4"
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, net.ErrClosed
+	}
+	if up, ok := a.upstream[network]; ok {
+		return up, nil
+	}
+	localIP, err := sourceSelector.Select(a.ctx, network, dst.String())
+	if err != nil {
+		return nil, err
+	}
+	if localIP == nil || localIP.IsUnspecified() {
+		return nil, errNoAvailableIP
+	}
+	lc := net.ListenConfig{Control: controlSocket}
+	pc, err := lc.ListenPacket(a.ctx, network, net.JoinHostPort(localIP.String(), "0"))
+	if err != nil {
+		markSourceFailed(localIP)
+		recordDial(localIP, true)
+		recordCircuit(localIP, true)
+		return nil, err
+	}
+	up := pc.(*net.UDPConn)
+	a.upstream[network] = up
+	connLog(a.ctx).Infow("Opened UDP upstream socket",
+		"network", network,
+		"local_addr", up.LocalAddr().String(),
+	)
+	go a.toClient(up)
+	return up, nil
+}
+
+// toClient relays datagrams arriving on up back to the client.
+func (a *udpAssociation) toClient(up *net.UDPConn) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := up.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+		if client == nil {
+			continue
+		}
+		msg := append(udpHeader(from), buf[:n]...)
+		if _, err := a.relay.WriteToUDP(msg, client); err != nil {
+			connLog(a.ctx).Debugw("Failed to relay UDP datagram to client", "client_addr", client.String(), "error", err)
+		}
+	}
+}
+
+// parseUDPHeader splits a client datagram (RFC 1928 section 7) into its
+// destination and payload. Fragments are not supported.
+func parseUDPHeader(b []byte) (*socks5.AddrSpec, []byte, error) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		return nil, nil, errors.New("short or invalid header")
+	}
+	if b[2] != 0 {
+		return nil, nil, errors.New("fragmented datagrams are not supported")
+	}
+	dest := &socks5.AddrSpec{}
+	rest := b[4:]
+	switch b[3] {
+	case atypIPv4:
+		if len(rest) < net.IPv4len+2 {
+			return nil, nil, errors.New("short IPv4 address")
+		}
+		dest.IP = net.IP(append([]byte(nil), rest[:net.IPv4len]...))
+		rest = rest[net.IPv4len:]
+	case atypIPv6:
+		if len(rest) < net.IPv6len+2 {
+			return nil, nil, errors.New("short IPv6 address")
+		}
+		dest.IP = net.IP(append([]byte(nil), rest[:net.IPv6len]...))
+		rest = rest[net.IPv6len:]
+	case atypFQDN:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 {
+			return nil, nil, errors.New("short hostname")
+		}
+		dest.FQDN = string(rest[1 : 1+rest[0]])
+		rest = rest[1+rest[0]:]
+	default:
+		return nil, nil, fmt.Errorf("unknown address type %d", b[3])
+	}
+	dest.Port = int(binary.BigEndian.Uint16(rest[:2]))
+	return dest, rest[2:], nil
+}
+
+// udpHeader returns the header of a datagram relayed to the client from
+// addr.
+func udpHeader(addr *net.UDPAddr) []byte {
+	hdr := []byte{0, 0, 0}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		hdr = append(append(hdr, atypIPv4), ip4...)
+	} else {
+		hdr = append(append(hdr, atypIPv6), addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(hdr, uint16(addr.Port))
+}
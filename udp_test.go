@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// startUDPEcho runs a UDP echo server on a random loopback port. Every
+// datagram it receives is also sent on the returned channel.
+func startUDPEcho(t *testing.T) (*net.UDPAddr, <-chan string) {
+	t.Helper()
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	got := make(chan string, 16)
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			got <- string(buf[:n])
+			pc.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr), got
+}
+
+// associate opens a UDP association through the proxy at proxyAddr and
+// returns a socket connected to its relay. The association lasts until the
+// test ends.
+func associate(t *testing.T, proxyAddr string) *net.UDPConn {
+	t.Helper()
+	ctrl, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Close() })
+	if _, err := ctrl.Write([]byte{socks5Version, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ctrl, make([]byte, 2)); err != nil {
+		t.Fatalf("reading method selection: %v", err)
+	}
+	if _, err := ctrl.Write([]byte{socks5Version, socks5.AssociateCommand, 0, atypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if reply[1] != replySucceeded {
+		t.Fatalf("UDP ASSOCIATE got reply %d", reply[1])
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+	conn, err := net.DialUDP("udp4", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendTo sends payload through the association to dest.
+func sendTo(t *testing.T, conn *net.UDPConn, dest *net.UDPAddr, payload string) {
+	t.Helper()
+	if _, err := conn.Write(append(udpHeader(dest), payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPPortRules(t *testing.T) {
+	usePool(t, "127.0.0.1")
+	allowed, allowedGot := startUDPEcho(t)
+	denied, deniedGot := startUDPEcho(t)
+	proxyAddr := startServer(t, newSOCKSServer(&socks5.Config{
+		Dial:  customDialer,
+		Rules: ruleChain{&portRuleSet{deny: []portRange{{lo: denied.Port, hi: denied.Port}}}},
+	}))
+	conn := associate(t, proxyAddr)
+
+	sendTo(t, conn, denied, "to denied")
+	sendTo(t, conn, allowed, "to allowed")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxDatagram)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("reading relayed reply: %v", err)
+	}
+	want := append(udpHeader(allowed), "to allowed"...)
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("client got %q, want the allowed port's echo %q", buf[:n], want)
+	}
+	if got := <-allowedGot; got != "to allowed" {
+		t.Errorf("allowed port got %q", got)
+	}
+	select {
+	case got := <-deniedGot:
+		t.Errorf("denied port got %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPortRuleSetDatagrams(t *testing.T) {
+	rules := ruleChain{handshakeRule{}, &portRuleSet{
+		allow: []portRange{{lo: 53, hi: 53}, {lo: 100, hi: 200}},
+		deny:  []portRange{{lo: 150, hi: 150}},
+	}}
+	for port, want := range map[int]bool{53: true, 123: true, 150: false, 161: true, 443: false} {
+		if got := rules.allowDatagram(port); got != want {
+			t.Errorf("allowDatagram(%d) = %v, want %v", port, got, want)
+		}
+	}
+}
+
+func TestUDPSendFailureRecorded(t *testing.T) {
+	usePool(t, "127.0.0.1")
+	prevFailures := circuitFailures
+	t.Cleanup(func() {
+		circuitFailures = prevFailures
+		circuitMu.Lock()
+		circuits = make(map[netip.Addr]*dialCircuit)
+		circuitMu.Unlock()
+	})
+	circuitFailures = 100
+	proxyAddr := startServer(t, newSOCKSServer(&socks5.Config{Dial: customDialer}))
+	conn := associate(t, proxyAddr)
+
+	// Linux refuses to send to port 0.
+	sendTo(t, conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, "nowhere")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		circuitMu.Lock()
+		c := circuits[addrKey(net.IPv4(127, 0, 0, 1))]
+		failed := c != nil && c.consecutive > 0
+		circuitMu.Unlock()
+		if failed {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed UDP send was not recorded against the source IP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
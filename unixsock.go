@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks a -listen address as a Unix socket path.
+const unixPrefix = "unix:"
+
+// Unix socket settings, from -socket-mode and -socket-owner.
+var (
+	socketMode  fs.FileMode = 0o660
+	socketOwner string
+)
+
+// splitListenAddr returns the network and address to listen on for a
+// -listen value: "unix" and the path for unix:PATH, "tcp" otherwise.
+func splitListenAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// removeStaleSocket removes a socket file left at path by a previous run
+// that did not shut down cleanly. Anything other than a socket is left
+// alone, so the listen fails instead of deleting a regular file.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&fs.ModeSocket == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// setSocketPerms applies -socket-mode and -socket-owner to the socket at
+// path.
+func setSocketPerms(path string) error {
+	if err := os.Chmod(path, socketMode); err != nil {
+		return fmt.Errorf("failed to set mode of socket '%s': %w", path, err)
+	}
+	if socketOwner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(socketOwner)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to set owner of socket '%s': %w", path, err)
+	}
+	return nil
+}
+
+// lookupOwner resolves USER[:GROUP], by name or number, to a uid and gid.
+// An omitted user or group is returned as -1, which chown leaves unchanged.
+func lookupOwner(spec string) (uid, gid int, err error) {
+	userName, groupName, _ := strings.Cut(spec, ":")
+	uid, gid = -1, -1
+	if userName != "" {
+		if uid, err = strconv.Atoi(userName); err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid -socket-owner user %q: %w", userName, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if groupName != "" {
+		if gid, err = strconv.Atoi(groupName); err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid -socket-owner group %q: %w", groupName, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// upstreamProxy is the -upstream proxy that outbound connections are
+// chained through, or nil to connect directly. The connection to it still
+// comes from the selected pool IP.
+var upstreamProxy *url.URL
+
+// parseUpstream parses -upstream, a socks5://, socks5h:// or http:// URL
+// with optional user:password.
+func parseUpstream(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -upstream %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("invalid -upstream scheme %q (want socks5 or http)", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("invalid -upstream %q: missing port", raw)
+	}
+	return u, nil
+}
+
+// upstreamConnect asks the upstream proxy on conn to connect to addr. It
+// must finish within dialTimeout.
+func upstreamConnect(conn net.Conn, addr string) error {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	var err error
+	if upstreamProxy.Scheme == "http" {
+		err = httpConnect(conn, addr)
+	} else {
+		err = socks5Connect(conn, addr)
+	}
+	if err != nil {
+		return fmt.Errorf("upstream %s: %w", upstreamProxy.Redacted(), err)
+	}
+	return nil
+}
+
+// httpConnect performs an HTTP CONNECT to addr. The response is read a
+// byte at a time so no data the target sends first is buffered away.
+func httpConnect(conn net.Conn, addr string) error {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if user := upstreamProxy.User; user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return err
+	}
+	var head []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) > 8192 {
+			return errors.New("CONNECT response header too long")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return fmt.Errorf("failed to read CONNECT response: %w", err)
+		}
+		head = append(head, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return fmt.Errorf("invalid CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT to %s refused: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect performs a SOCKS5 CONNECT to addr, authenticating with the
+// URL's user:password when given.
+func socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+
+	method := byte(0x00)
+	if upstreamProxy.User != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("failed to read method reply: %w", err)
+	}
+	if resp[0] != socks5Version || resp[1] != method {
+		return fmt.Errorf("authentication method %d not accepted", method)
+	}
+	if method == 0x02 {
+		user := upstreamProxy.User.Username()
+		password, _ := upstreamProxy.User.Password()
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(password))), password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return fmt.Errorf("failed to read auth reply: %w", err)
+		}
+		if resp[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, 1, 0}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		req = append(append(req, atypFQDN, byte(len(host))), host...)
+	case ip.To4() != nil:
+		req = append(append(req, atypIPv4), ip.To4()...)
+	default:
+		req = append(append(req, atypIPv6), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return fmt.Errorf("failed to read connect reply: %w", err)
+	}
+	if hdr[1] != replySucceeded {
+		return fmt.Errorf("connect to %s failed: %w", addr, socksReplyError(hdr[1]))
+	}
+	// Skip the bound address and port.
+	var skip int
+	switch hdr[3] {
+	case atypIPv4:
+		skip = net.IPv4len + 2
+	case atypIPv6:
+		skip = net.IPv6len + 2
+	case atypFQDN:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("unknown address type %d in connect reply", hdr[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// socksReplyError maps an upstream SOCKS5 failure reply to the errno a
+// direct dial would have failed with, so our own reply to the client
+// matches.
+func socksReplyError(rep uint8) error {
+	switch rep {
+	case replyNetworkUnreachable:
+		return syscall.ENETUNREACH
+	case replyHostUnreachable:
+		return syscall.EHOSTUNREACH
+	case replyConnectionRefused:
+		return syscall.ECONNREFUSED
+	case replyTTLExpired:
+		return syscall.ETIMEDOUT
+	}
+	return fmt.Errorf("SOCKS reply %d", rep)
+}
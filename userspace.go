@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// userspaceNet is the -userspace stack, or nil when connections are made
+// by the kernel.
+var userspaceNet *userspaceStack
+
+// userspaceNIC is the ID of the userspace stack's only NIC.
+const userspaceNIC tcpip.NICID = 1
+
+// userspaceStack is a gVisor TCP/IP stack that sends and receives raw
+// Ethernet frames on an interface through an AF_PACKET socket, under its
+// own MAC address. It answers ARP for pool IPs and accepts packets sent to
+// them, so pool IPs work on the local segment without the kernel owning or
+// routing them.
+type userspaceStack struct {
+	stack *stack.Stack
+	link  *channel.Endpoint
+	fd    int
+	mac   net.HardwareAddr
+}
+
+// startUserspace brings up the userspace stack on iface. mac is the
+// stack's MAC address; nil derives one from the interface's by flipping
+// its locally administered bit, so it never collides with the kernel's.
+// gateway is the next hop for off-link destinations; nil takes the
+// interface's default route from the kernel.
+func startUserspace(iface string, mac net.HardwareAddr, gateway net.IP) (*userspaceStack, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -userspace interface: %w", err)
+	}
+	if len(ifi.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("-userspace interface %s is not Ethernet", iface)
+	}
+	if mac == nil {
+		mac = append(net.HardwareAddr(nil), ifi.HardwareAddr...)
+		mac[0] ^= 0x02
+	}
+	subnet, err := interfaceSubnet(ifi)
+	if err != nil {
+		return nil, err
+	}
+	if gateway == nil {
+		if gateway, err = defaultGateway(ifi.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open AF_PACKET socket (needs CAP_NET_RAW): %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: ifi.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind AF_PACKET socket to %s: %w", iface, err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to enable PACKET_AUXDATA: %w", err)
+	}
+	// Frames to our own MAC only reach the socket in promiscuous mode.
+	mreq := unix.PacketMreq{Ifindex: int32(ifi.Index), Type: unix.PACKET_MR_PROMISC}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to make %s promiscuous: %w", iface, err)
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	link := channel.New(512, uint32(ifi.MTU+header.EthernetMinimumSize), tcpip.LinkAddress(mac))
+	if err := s.CreateNIC(userspaceNIC, ethernet.New(link)); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to create userspace NIC: %s", err)
+	}
+	// Spoofing lets connections use any source address and promiscuous
+	// mode accepts packets to any address. readFrames only lets through
+	// frames for pool IPs, so nothing else on the segment is answered.
+	s.SetSpoofing(userspaceNIC, true)
+	s.SetPromiscuousMode(userspaceNIC, true)
+	routes := []tcpip.Route{{Destination: subnet, NIC: userspaceNIC}}
+	if gateway != nil {
+		routes = append(routes, tcpip.Route{Destination: header.IPv4EmptySubnet, Gateway: tcpip.AddrFrom4Slice(gateway.To4()), NIC: userspaceNIC})
+	}
+	s.SetRouteTable(routes)
+
+	u := &userspaceStack{stack: s, link: link, fd: fd, mac: mac}
+	go u.readFrames()
+	go u.writeFrames()
+	sugar.Infow("Userspace network stack up",
+		"interface", iface,
+		"mac", mac.String(),
+		"subnet", subnet.String(),
+		"gateway", gateway,
+	)
+	return u, nil
+}
+
+// dial connects to addr from localIP through the userspace stack.
+func (u *userspaceStack) dial(ctx context.Context, localIP net.IP, addr string) (net.Conn, error) {
+	remote, err := net.ResolveTCPAddr("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	local4 := localIP.To4()
+	if local4 == nil || remote.IP.To4() == nil {
+		return nil, errors.New("-userspace only supports IPv4")
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	return gonet.DialTCPWithBind(ctx, u.stack,
+		tcpip.FullAddress{NIC: userspaceNIC, Addr: tcpip.AddrFrom4Slice(local4)},
+		tcpip.FullAddress{NIC: userspaceNIC, Addr: tcpip.AddrFrom4Slice(remote.IP.To4()), Port: uint16(remote.Port)},
+		ipv4.ProtocolNumber,
+	)
+}
+
+// readFrames passes frames from the interface to the stack: ARP requests
+// for pool IPs, ARP replies to our MAC, and IPv4 packets to pool IPs.
+// Everything else belongs to the kernel or other hosts and is dropped.
+func (u *userspaceStack) readFrames() {
+	buf := make([]byte, 65536)
+	oob := make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.TpacketAuxdata{}))))
+	for {
+		n, oobn, _, _, err := unix.Recvmsg(u.fd, buf, oob, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			fatalf("Userspace stack failed to read frames: %v", err)
+		}
+		frame := buf[:n]
+		if !u.wantFrame(frame) {
+			continue
+		}
+		if checksumPending(oob[:oobn]) {
+			completeTCPChecksum(frame)
+		}
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(append([]byte(nil), frame...))})
+		u.link.InjectInbound(0, pkt)
+		pkt.DecRef()
+	}
+}
+
+// checksumPending reports whether the kernel says a frame's transport
+// checksum was left for offload by a sender on this host, such as a
+// container behind a veth, and so is not filled in yet.
+func checksumPending(oob []byte) bool {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return false
+	}
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_PACKET || m.Header.Type != unix.PACKET_AUXDATA || len(m.Data) < int(unsafe.Sizeof(unix.TpacketAuxdata{})) {
+			continue
+		}
+		aux := (*unix.TpacketAuxdata)(unsafe.Pointer(&m.Data[0]))
+		return aux.Status&unix.TP_STATUS_CSUMNOTREADY != 0
+	}
+	return false
+}
+
+// completeTCPChecksum fills in the TCP checksum of an IPv4 frame in place,
+// as the offloading NIC would have.
+func completeTCPChecksum(frame []byte) {
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+	if !ip.IsValid(len(ip)) || ip.TransportProtocol() != header.TCPProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+		return
+	}
+	payload := ip.Payload()
+	if len(payload) < header.TCPMinimumSize {
+		return
+	}
+	tcpHdr := header.TCP(payload)
+	tcpHdr.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(payload)))
+	tcpHdr.SetChecksum(^checksum.Checksum(payload, xsum))
+}
+
+func (u *userspaceStack) wantFrame(frame []byte) bool {
+	if len(frame) < header.EthernetMinimumSize {
+		return false
+	}
+	eth := header.Ethernet(frame)
+	dst := eth.DestinationAddress()
+	if dst != header.EthernetBroadcastAddress && dst != tcpip.LinkAddress(u.mac) {
+		return false
+	}
+	payload := frame[header.EthernetMinimumSize:]
+	switch eth.Type() {
+	case header.ARPProtocolNumber:
+		a := header.ARP(payload)
+		if !a.IsValid() {
+			return false
+		}
+		if a.Op() == header.ARPRequest {
+			return anyPoolContains(net.IP(a.ProtocolAddressTarget()))
+		}
+		return dst == tcpip.LinkAddress(u.mac)
+	case header.IPv4ProtocolNumber:
+		if len(payload) < header.IPv4MinimumSize {
+			return false
+		}
+		dstIP := header.IPv4(payload).DestinationAddress()
+		return dst == tcpip.LinkAddress(u.mac) && anyPoolContains(net.IP(dstIP.AsSlice()))
+	}
+	return false
+}
+
+// writeFrames sends the stack's outbound frames on the interface.
+func (u *userspaceStack) writeFrames() {
+	for {
+		pkt := u.link.ReadContext(context.Background())
+		if pkt == nil {
+			return
+		}
+		view := pkt.ToView()
+		if _, err := syscall.Write(u.fd, view.AsSlice()); err != nil {
+			sugar.Debugw("Userspace stack failed to send frame", "error", err)
+		}
+		view.Release()
+		pkt.DecRef()
+	}
+}
+
+// interfaceSubnet returns the IPv4 subnet of ifi's first IPv4 address,
+// which the userspace stack treats as on-link.
+func interfaceSubnet(ifi *net.Interface) (tcpip.Subnet, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return tcpip.Subnet{}, err
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		return tcpip.NewSubnet(tcpip.AddrFrom4Slice(ipNet.IP.Mask(ipNet.Mask).To4()), tcpip.MaskFromBytes(ipNet.Mask))
+	}
+	return tcpip.Subnet{}, fmt.Errorf("-userspace interface %s has no IPv4 address", ifi.Name)
+}
+
+// defaultGateway reads iface's IPv4 default gateway from the kernel's
+// routing table, or returns nil when it has none.
+func defaultGateway(iface string) (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != iface || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 {
+			continue
+		}
+		// The gateway is in host (little-endian) byte order.
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+		return ip, nil
+	}
+	return nil, scanner.Err()
+}
+
+// htons converts a port or protocol number to network byte order.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
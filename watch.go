@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long a watched file must stay quiet before the pool
+// is rebuilt.
+const watchDebounce = 500 * time.Millisecond
+
+// watchPoolFiles rebuilds the pool when a local -file changes. Events are
+// debounced so an editor's write-rename-chmod burst causes one reload, and
+// a file that fails to parse keeps the active pool. URLs are skipped; use
+// -refresh for those.
+func watchPoolFiles(src poolSources) error {
+	watched := make(map[string]bool)
+	for _, path := range src.files {
+		if isURL(path) {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		watched[abs] = true
+	}
+	if len(watched) == 0 {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch the directories rather than the files: tools that replace a
+	// file by renaming over it would otherwise end the watch.
+	dirs := make(map[string]bool)
+	for path := range watched {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+		dirs[dir] = true
+	}
+
+	var (
+		mu    sync.Mutex
+		timer *time.Timer
+	)
+	reload := func() {
+		if err := rebuildPool(src, "file change"); err != nil {
+			sugar.Errorw("Failed to reload IP pool after file change, keeping the active pool", "error", err)
+		}
+	}
+	go func() {
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !watched[filepath.Clean(ev.Name)] || ev.Op == fsnotify.Chmod {
+					continue
+				}
+				sugar.Debugw("IP file changed", "file", ev.Name, "op", ev.Op.String())
+				mu.Lock()
+				if timer == nil {
+					timer = time.AfterFunc(watchDebounce, reload)
+				} else {
+					timer.Reset(watchDebounce)
+				}
+				mu.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				sugar.Warnw("IP file watcher error", "error", err)
+			}
+		}
+	}()
+	sugar.Infow("Watching IP files for changes", "files", len(watched), "debounce", watchDebounce.String())
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math/bits"
+	"net"
+	"sort"
+)
+
+// poolWeights makes random selection favor some addresses of a pool. Every
+// address has weight 1 unless an IP file entry gave it more; an address of
+// weight w is drawn w times as often as one of weight 1. Draws cover the
+// pool's own offsets followed by an extra region per weight, holding each
+// address of that weight w-1 times.
+type poolWeights struct {
+	entries []ipEntry // the file entries the weights came from
+	extra   []weightRegion
+	total   uint64 // pool size plus every region's size
+}
+
+// weightRegion is the extra region for the addresses with one weight.
+type weightRegion struct {
+	members *ipPool
+	offset  uint64 // start of the region, counted from the end of the pool
+	size    uint64 // members' size times (weight - 1)
+}
+
+// entryIntervals returns the addresses of entries.
+func entryIntervals(entries []ipEntry) []ipInterval {
+	ivs := make([]ipInterval, len(entries))
+	for i, e := range entries {
+		ivs[i] = e.iv
+	}
+	return ivs
+}
+
+// weighted returns p with the weights of entries applied to the addresses
+// it contains. An address listed with several weights takes the highest.
+// Weights are dropped, with a warning, when the weighted pool would hold
+// 2^64 or more draws.
+func (p *ipPool) weighted(entries []ipEntry) *ipPool {
+	byWeight := make(map[int][]ipInterval)
+	var weights []int
+	for _, e := range entries {
+		if e.weight <= 1 {
+			continue
+		}
+		if _, ok := byWeight[e.weight]; !ok {
+			weights = append(weights, e.weight)
+		}
+		byWeight[e.weight] = append(byWeight[e.weight], e.iv)
+	}
+	if p.empty() || len(weights) == 0 {
+		return p
+	}
+	if p.size.hi > 0 {
+		sugar.Warnw("IP pool is too large for weights, selecting uniformly", "pool_size", p.count())
+		return p
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(weights)))
+
+	w := &poolWeights{entries: entries, total: p.size.lo}
+	var taken []ipInterval
+	for _, weight := range weights {
+		members := p.intersect(byWeight[weight]).without(taken)
+		if members.empty() {
+			continue
+		}
+		taken = append(taken, members.intervals()...)
+		hi, size := bits.Mul64(members.size.lo, uint64(weight-1))
+		end, carry := bits.Add64(w.total, size, 0)
+		if hi > 0 || carry > 0 {
+			sugar.Warnw("IP pool weights are too large, selecting uniformly", "pool_size", p.count(), "weight", weight)
+			return p
+		}
+		w.extra = append(w.extra, weightRegion{members: members, offset: w.total - p.size.lo, size: size})
+		w.total = end
+	}
+	if len(w.extra) == 0 {
+		return p
+	}
+	out := *p
+	out.weights = w
+	return &out
+}
+
+// equal reports whether w and o give every address the same weight. A nil
+// w, as on an unweighted pool, equals only another nil.
+func (w *poolWeights) equal(o *poolWeights) bool {
+	if w == nil || o == nil {
+		return w == o
+	}
+	if w.total != o.total || len(w.extra) != len(o.extra) {
+		return false
+	}
+	for i, r := range w.extra {
+		if r.size != o.extra[i].size || !sameIntervals(r.members, o.extra[i].members) {
+			return false
+		}
+	}
+	return true
+}
+
+// randomWeighted returns a random address of p drawn by weight.
+func (p *ipPool) randomWeighted(r intSource) net.IP {
+	n := randBelowOrEqual(u128{0, p.weights.total - 1}, r).lo
+	if n < p.size.lo {
+		return p.at(u128{0, n})
+	}
+	n -= p.size.lo
+	regions := p.weights.extra
+	i := sort.Search(len(regions), func(i int) bool { return n < regions[i].offset+regions[i].size })
+	region := regions[i]
+	return region.members.at(u128{0, (n - region.offset) % region.members.size.lo})
+}
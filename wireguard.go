@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// wgMTU is the MTU of the -wg-config tunnel device, as wg-quick picks for
+// an IPv4 or IPv6 underlay.
+const wgMTU = 1420
+
+// wgConfig is a parsed -wg-config file.
+type wgConfig struct {
+	uapi      string         // device settings in wireguard-go's UAPI form
+	addresses []netip.Prefix // Address: the tunnel address space pool IPs come from
+	allowed   []netip.Prefix // every peer's AllowedIPs: destinations reached through the tunnel
+}
+
+// parseWGConfig reads a wg(8) configuration file with wg-quick's Address
+// line, e.g.
+//
+//	[Interface]
+//	PrivateKey = ...
+//	Address = 10.99.0.0/16
+//
+//	[Peer]
+//	PublicKey = ...
+//	Endpoint = 203.0.113.5:51820
+//	AllowedIPs = 10.200.0.0/16
+//	PersistentKeepalive = 25
+func parseWGConfig(path string) (*wgConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open -wg-config: %w", err)
+	}
+	defer f.Close()
+
+	cfg := &wgConfig{}
+	var uapi strings.Builder
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line[1 : len(line)-1])
+			if section != "interface" && section != "peer" {
+				return nil, fmt.Errorf("%s:%d: unknown section %s", path, lineNo, line)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY = VALUE in a section", path, lineNo)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if err := cfg.set(&uapi, section, key, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, lineNo, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read -wg-config: %w", err)
+	}
+	if len(cfg.addresses) == 0 {
+		return nil, fmt.Errorf("%s: [Interface] needs an Address for the pool IPs", path)
+	}
+	if len(cfg.allowed) == 0 {
+		return nil, fmt.Errorf("%s: no [Peer] with AllowedIPs", path)
+	}
+	cfg.uapi = uapi.String()
+	return cfg, nil
+}
+
+// set applies one KEY = VALUE line of section to cfg and uapi.
+func (cfg *wgConfig) set(uapi *strings.Builder, section, key, value string) error {
+	switch section + "." + key {
+	case "interface.privatekey":
+		k, err := wgKeyHex(value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(uapi, "private_key=%s\n", k)
+	case "interface.listenport":
+		if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		fmt.Fprintf(uapi, "listen_port=%s\n", value)
+	case "interface.address":
+		prefixes, err := parsePrefixList(value)
+		if err != nil {
+			return err
+		}
+		cfg.addresses = append(cfg.addresses, prefixes...)
+	case "peer.publickey":
+		k, err := wgKeyHex(value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(uapi, "public_key=%s\n", k)
+	case "peer.presharedkey":
+		k, err := wgKeyHex(value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(uapi, "preshared_key=%s\n", k)
+	case "peer.endpoint":
+		addr, err := net.ResolveUDPAddr("udp", value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(uapi, "endpoint=%s\n", addr)
+	case "peer.allowedips":
+		prefixes, err := parsePrefixList(value)
+		if err != nil {
+			return err
+		}
+		for _, p := range prefixes {
+			fmt.Fprintf(uapi, "allowed_ip=%s\n", p)
+		}
+		cfg.allowed = append(cfg.allowed, prefixes...)
+	case "peer.persistentkeepalive":
+		if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+			return fmt.Errorf("invalid interval %q", value)
+		}
+		fmt.Fprintf(uapi, "persistent_keepalive_interval=%s\n", value)
+	default:
+		return fmt.Errorf("unsupported key in [%s]", section)
+	}
+	return nil
+}
+
+// wgKeyHex converts a base64 WireGuard key to the hex UAPI expects.
+func wgKeyHex(key string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid key")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parsePrefixList parses comma-separated CIDRs; a bare address is a
+// single-address prefix.
+func parsePrefixList(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// wgTunnel is a running -wg-config tunnel and the host routing set up for
+// it.
+type wgTunnel struct {
+	dev  *device.Device
+	name string
+	undo [][]string // ip commands that remove the routing, run on Close
+}
+
+// startWireGuard brings up the tunnel of the -wg-config file at path on a
+// TUN device named name. Connections from the Address pool IPs look up
+// routing table table, which sends the peers' AllowedIPs into the tunnel;
+// other traffic, including the tunnel's own UDP packets, is routed as
+// before. The Address space is also routed locally (AnyIP), so replies
+// arriving through the tunnel are accepted.
+func startWireGuard(path, name string, table int) (*wgTunnel, error) {
+	cfg, err := parseWGConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	tunDev, err := tun.CreateTUN(name, wgMTU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TUN device %s: %w", name, err)
+	}
+	if name, err = tunDev.Name(); err != nil {
+		tunDev.Close()
+		return nil, err
+	}
+	log := sugar.Named("wireguard")
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), &device.Logger{Verbosef: log.Debugf, Errorf: log.Errorf})
+	t := &wgTunnel{dev: dev, name: name}
+	if err := dev.IpcSet(cfg.uapi); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to configure WireGuard: %w", err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to bring up WireGuard: %w", err)
+	}
+
+	tableStr := strconv.Itoa(table)
+	if err := ipCommand("link", "set", "dev", name, "up"); err != nil {
+		t.Close()
+		return nil, err
+	}
+	// Routes on the device go away with it; rules and local routes do not.
+	for _, p := range cfg.allowed {
+		if err := ipCommand(ipFamilyFlag(p), "route", "replace", p.String(), "dev", name, "table", tableStr); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	for _, p := range cfg.addresses {
+		rule := []string{ipFamilyFlag(p), "rule", "add", "from", p.String(), "lookup", tableStr}
+		// Clear a rule a crashed run left behind, so it is not doubled.
+		ipCommand(ipFamilyFlag(p), "rule", "del", "from", p.String(), "lookup", tableStr)
+		if err := ipCommand(rule...); err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.undo = append(t.undo, []string{ipFamilyFlag(p), "rule", "del", "from", p.String(), "lookup", tableStr})
+		if err := ipCommand(ipFamilyFlag(p), "route", "replace", "local", p.String(), "dev", "lo"); err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.undo = append(t.undo, []string{ipFamilyFlag(p), "route", "del", "local", p.String(), "dev", "lo"})
+	}
+	sugar.Infow("WireGuard tunnel up",
+		"device", name,
+		"addresses", cfg.addresses,
+		"routes", cfg.allowed,
+		"table", table,
+	)
+	return t, nil
+}
+
+// Close removes the tunnel's routing and shuts the device down.
+func (t *wgTunnel) Close() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		if err := ipCommand(t.undo[i]...); err != nil {
+			sugar.Warnw("Failed to remove WireGuard routing", "error", err)
+		}
+	}
+	t.dev.Close()
+}
+
+// ipFamilyFlag returns the ip(8) family option for p.
+func ipFamilyFlag(p netip.Prefix) string {
+	if p.Addr().Is4() {
+		return "-4"
+	}
+	return "-6"
+}
+
+// ipCommand runs ip(8) with args.
+func ipCommand(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}